@@ -0,0 +1,8 @@
+package pgmig
+
+import (
+	"github.com/jackc/pgx/v4"
+)
+
+// wrapTx returns executor for mocked pgx v4 transaction
+func wrapTx(tx pgx.Tx) TxExecutor { return v4Tx{tx} }
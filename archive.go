@@ -0,0 +1,352 @@
+// This file holds archive source.
+// Packages are read from tar (optionally gzipped) or zip bundle into memory, so bundle is not unpacked to disk.
+// Bundle may hold SHA256SUMS manifest (sha256sum output), then every bundle file must be listed in it
+// with valid checksum.
+
+package pgmig
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+
+	"github.com/pgmig/gitinfo"
+)
+
+// ArchiveManifest holds name of bundle checksums file
+const ArchiveManifest = "SHA256SUMS"
+
+// archiveMeta holds names of bundle files which are not listed in manifest
+var archiveMeta = map[string]bool{ArchiveManifest: true, ArchiveSignature: true, ArchiveMinisig: true}
+
+// ArchiveFS is a FileSystem which holds files of archive in memory.
+type ArchiveFS struct {
+	name     string
+	files    map[string]*memFile
+	dirs     map[string]map[string]bool // child names by dir
+	verified bool
+	signed   bool
+}
+
+// memFile holds archive file
+type memFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+// OpenArchive reads archive into ArchiveFS and verifies its manifest if any.
+// Format is chosen by name extension: .tar, .tar.gz, .tgz or .zip
+func OpenArchive(name string) (*ArchiveFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fs := newArchiveFS(name)
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		var st os.FileInfo
+		if st, err = f.Stat(); err == nil {
+			err = fs.readZip(f, st.Size())
+		}
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(f); err == nil {
+			err = fs.readTar(gz, "")
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		err = fs.readTar(f, "")
+	default:
+		return nil, errors.New("Unknown archive format of " + name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Read "+name)
+	}
+	if err = fs.verify(); err != nil {
+		return nil, errors.Wrap(err, "Verify "+name)
+	}
+	return fs, nil
+}
+
+// newArchiveFS returns empty ArchiveFS
+func newArchiveFS(name string) *ArchiveFS {
+	return &ArchiveFS{name: name, files: map[string]*memFile{}, dirs: map[string]map[string]bool{"": {}}}
+}
+
+// Name returns archive name
+func (fs *ArchiveFS) Name() string { return fs.name }
+
+// Verified returns true if archive files were checked by manifest
+func (fs *ArchiveFS) Verified() bool { return fs.verified }
+
+// readTar loads regular files of tar stream into dir
+func (fs *ArchiveFS) readTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			return errors.Errorf("Unsupported type of %s", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err = fs.add(path.Join(dir, hdr.Name), data, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip loads regular files of zip archive
+func (fs *ArchiveFS) readZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return errors.Errorf("Unsupported type of %s", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err = fs.add(f.Name, data, f.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add registers file and its parent dirs
+func (fs *ArchiveFS) add(name string, data []byte, modTime time.Time) error {
+	clean := cleanPath(name)
+	if clean == "" {
+		return errors.New("Bad file name " + name)
+	}
+	if _, ok := fs.files[clean]; ok {
+		return errors.New("Duplicate file " + clean)
+	}
+	fs.files[clean] = &memFile{name: path.Base(clean), data: data, modTime: modTime}
+	for child := clean; child != ""; {
+		dir := path.Dir(child)
+		if dir == "." {
+			dir = ""
+		}
+		if fs.dirs[dir] == nil {
+			fs.dirs[dir] = map[string]bool{}
+		}
+		fs.dirs[dir][path.Base(child)] = true
+		child = dir
+	}
+	return nil
+}
+
+// verify checks files by manifest if it exists
+func (fs *ArchiveFS) verify() error {
+	m, ok := fs.files[ArchiveManifest]
+	if !ok {
+		return nil
+	}
+	sums, err := parseChecksums(m.data)
+	if err != nil {
+		return errors.Wrap(err, ArchiveManifest)
+	}
+	var problems []string
+	for name, sum := range sums {
+		f, ok := fs.files[name]
+		if !ok {
+			problems = append(problems, "missing "+name)
+			continue
+		}
+		got := sha256.Sum256(f.data)
+		if hex.EncodeToString(got[:]) != sum {
+			problems = append(problems, "checksum mismatch "+name)
+		}
+	}
+	for name := range fs.files {
+		if _, ok := sums[name]; !ok && !archiveMeta[name] {
+			problems = append(problems, "not in manifest "+name)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, ", "))
+	}
+	fs.verified = true
+	return nil
+}
+
+// parseChecksums parses sha256sum output
+func parseChecksums(data []byte) (map[string]string, error) {
+	rv := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimRight(scanner.Text(), "\r")
+		if s == "" {
+			continue
+		}
+		pos := strings.IndexByte(s, ' ')
+		if pos != sha256.Size*2 || len(s) < pos+3 {
+			return nil, errors.Errorf("line %d: checksum and file name expected", line)
+		}
+		// "  " separates text mode entry, " *" - binary one
+		rv[cleanPath(s[pos+2:])] = strings.ToLower(s[:pos])
+	}
+	return rv, scanner.Err()
+}
+
+// cleanPath returns archive path without leading "./" and "/"
+func cleanPath(name string) string {
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	return strings.TrimPrefix(clean, "/")
+}
+
+// Open opens archive file or directory
+func (fs *ArchiveFS) Open(name string) (File, error) {
+	clean := cleanPath(name)
+	if f, ok := fs.files[clean]; ok {
+		return &memHandle{Reader: bytes.NewReader(f.data), info: memInfo{name: f.name, size: int64(len(f.data)),
+			modTime: f.modTime}}, nil
+	}
+	children, ok := fs.dirs[clean]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	names := make([]string, 0, len(children))
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	entries := make([]os.FileInfo, 0, len(names))
+	for _, child := range names {
+		if f, ok := fs.files[path.Join(clean, child)]; ok {
+			entries = append(entries, memInfo{name: child, size: int64(len(f.data)), modTime: f.modTime})
+		} else {
+			entries = append(entries, memInfo{name: child, dir: true})
+		}
+	}
+	return &memHandle{Reader: bytes.NewReader(nil), info: memInfo{name: path.Base("/" + clean), dir: true},
+		entries: entries}, nil
+}
+
+// Walk calls wf for regular files of root directory like defaultFS does
+func (fs *ArchiveFS) Walk(root string, wf filepath.WalkFunc) error {
+	d, err := fs.Open(root)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	files, err := d.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			if err := wf(root, file, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GitInfo reads package git info from gitinfo file of package dir
+func (fs *ArchiveFS) GitInfo(dir, file string) (*gitinfo.GitInfo, error) {
+	if file == "" {
+		file = "gitinfo.json"
+	}
+	return gitinfo.New(logr.Discard(), gitinfo.Config{File: file}).Read(gitinfoFileSystem{fs}, dir)
+}
+
+// memHandle is an opened archive file or directory
+type memHandle struct {
+	*bytes.Reader
+	info    memInfo
+	entries []os.FileInfo
+}
+
+// Close does nothing
+func (h *memHandle) Close() error { return nil }
+
+// Stat returns file info
+func (h *memHandle) Stat() (os.FileInfo, error) { return h.info, nil }
+
+// Readdir returns directory entries
+func (h *memHandle) Readdir(count int) ([]os.FileInfo, error) {
+	if !h.info.dir {
+		return nil, &os.PathError{Op: "readdir", Path: h.info.name, Err: errors.New("not a directory")}
+	}
+	if count <= 0 {
+		rv := h.entries
+		h.entries = nil
+		return rv, nil
+	}
+	if len(h.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(h.entries) {
+		count = len(h.entries)
+	}
+	rv := h.entries[:count]
+	h.entries = h.entries[count:]
+	return rv, nil
+}
+
+// memInfo holds archive file info
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return fi.size }
+func (fi memInfo) ModTime() time.Time { return fi.modTime }
+func (fi memInfo) IsDir() bool        { return fi.dir }
+func (fi memInfo) Sys() interface{}   { return nil }
+
+// Mode returns 0444 for files and directory mode for dirs
+func (fi memInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0o555
+	}
+	return 0o444
+}
@@ -0,0 +1,141 @@
+package pgmig
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bundleFiles holds content of test bundle
+var bundleFiles = map[string]string{
+	"app/pgmig.json":      `{"schemas": ["app"]}`,
+	"app/gitinfo.json":    `{"version": "v1.2.0", "repository": "https://example.com/app"}`,
+	"app/01_schema.sql":   "CREATE SCHEMA app;",
+	"app/02_app.test.sql": "SELECT 1;",
+	"app/sub/ignored.sql": "SELECT 2;",
+	"lib/01_lib.once.sql": "CREATE TABLE lib.t();",
+}
+
+// checksums returns SHA256SUMS content for files
+func checksums(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(files[name]))
+		fmt.Fprintf(&b, "%s  ./%s\n", hex.EncodeToString(sum[:]), name)
+	}
+	return b.String()
+}
+
+// writeTarGz writes gzipped tar with files
+func writeTarGz(t *testing.T, name string, files map[string]string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./app/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0o644,
+			Size: int64(len(data)), ModTime: time.Unix(1700000000, 0)}))
+		_, err := io.WriteString(tw, data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, os.WriteFile(name, buf.Bytes(), 0o644))
+}
+
+// writeZip writes zip with files
+func writeZip(t *testing.T, name string, files map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(name, buf.Bytes(), 0o644))
+}
+
+// withManifest returns copy of files with SHA256SUMS
+func withManifest(files map[string]string) map[string]string {
+	rv := map[string]string{ArchiveManifest: checksums(files)}
+	for k, v := range files {
+		rv[k] = v
+	}
+	return rv
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	tgz := filepath.Join(dir, "bundle.tar.gz")
+	writeTarGz(t, tgz, withManifest(bundleFiles))
+	zipName := filepath.Join(dir, "bundle.zip")
+	writeZip(t, zipName, bundleFiles)
+
+	for _, tt := range []struct {
+		name     string
+		verified bool
+	}{{tgz, true}, {zipName, false}} {
+		fs, err := OpenArchive(tt.name)
+		require.NoError(t, err)
+		assert.Equal(t, tt.verified, fs.Verified(), tt.name)
+
+		mig := New(logr.Discard(), Config{Manifest: "pgmig.json", InitIncludes: []string{"*.sql"},
+			TestIncludes: []string{"*.test.sql"}}, fs, "")
+		pkgs, err := mig.lookupFiles(CmdInit, mig.Config.InitIncludes, nil, nil, false, []string{"app", "lib"})
+		require.NoError(t, err)
+		require.Len(t, pkgs, 2)
+		assert.Equal(t, []fileDef{{Name: "01_schema.sql"}, {Name: "02_app.test.sql"}}, pkgs[0].Files)
+		assert.Equal(t, []string{"app"}, pkgs[0].Manifest.Schemas)
+		data, err := mig.readFile(pkgs[1], pkgs[1].Files[0])
+		require.NoError(t, err)
+		assert.Equal(t, "CREATE TABLE lib.t();", string(data))
+
+		info, err := mig.gitInfo("app")
+		require.NoError(t, err)
+		assert.Equal(t, "v1.2.0", info.Version)
+		_, err = mig.gitInfo("lib")
+		assert.Error(t, err, "git info must not be made for archive")
+
+		_, err = fs.Open("app/none.sql")
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestOpenArchiveVerify(t *testing.T) {
+	dir := t.TempDir()
+	files := withManifest(bundleFiles)
+	files["app/01_schema.sql"] = "DROP SCHEMA app;"
+	files["app/03_extra.sql"] = "SELECT 3;"
+	delete(files, "lib/01_lib.once.sql")
+	name := filepath.Join(dir, "bundle.tgz")
+	writeTarGz(t, name, files)
+	_, err := OpenArchive(name)
+	assert.EqualError(t, err, "Verify "+name+": checksum mismatch app/01_schema.sql, missing lib/01_lib.once.sql, "+
+		"not in manifest app/03_extra.sql")
+
+	name = filepath.Join(dir, "bundle.rar")
+	require.NoError(t, os.WriteFile(name, nil, 0o644))
+	_, err = OpenArchive(name)
+	assert.EqualError(t, err, "Unknown archive format of "+name)
+}
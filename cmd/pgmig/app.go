@@ -7,25 +7,65 @@ package main
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/jackc/pgx/v4"
 	// TODO	"github.com/jackc/pgx/v4/log/logrusadapter"
 
 	"github.com/pgmig/pgmig"
 	"github.com/pgmig/pgmig/cmd/pgmig/internal/sql"
+	"github.com/pgmig/pgmig/pgxv4"
 )
 
 // Config holds all config vars
 type Config struct {
 	Flags
-	DSN  string `long:"dsn" default:"" description:"Database URL"`
-	Args struct {
+	DSN      string `long:"dsn" default:"" description:"Database URL"`
+	Parallel int    `long:"parallel" default:"1" description:"Run tests in N databases cloned from tested one"`
+	JSON     string `long:"events_json" description:"Write events as JSON lines to file"`
+	JUnit    string `long:"junit" description:"Write test results as JUnit XML to file"`
+	Analyze  bool   `long:"analyze-locks" description:"Show locks taken by plan statements and warn about dangerous ones"`
+	Prepare  string `long:"prepare" description:"Prepare transaction with given id instead of commit (see commit-prepared, rollback-prepared)"`
+	From     string `long:"from" description:"Diff source: database URL or directory with package snapshots"`
+	To       string `long:"to" description:"Diff target: database URL or directory with package snapshots"`
+	Args     struct {
 		//nolint:staticcheck // Multiple struct tag "choice" is allowed
-		Command  string   `choice:"init" choice:"test" choice:"drop" choice:"erase" choice:"reinit" description:"init|test|drop|erase|reinit"`
-		Packages []string `description:"dirnames under SQL sources directory in create order"`
+		Command  string   `choice:"init" choice:"test" choice:"drop" choice:"erase" choice:"reinit" choice:"history" choice:"plan" choice:"lint" choice:"commit-prepared" choice:"rollback-prepared" choice:"snapshot" choice:"drift" choice:"diff" choice:"new" choice:"watch" description:"init|test|drop|erase|reinit|history|plan|lint|commit-prepared|rollback-prepared|snapshot|drift|diff|new|watch"`
+		Packages []string `description:"dirnames under SQL sources directory in create order (plan, watch: command and dirnames, *-prepared: transaction id, new: package <name> or file <pkg> <init|once|new|test> <title>)"`
 	} `positional-args:"yes" required:"yes"`
-	Mig pgmig.Config `group:"Migrator Options" namespace:"mig"`
+	Mig     pgmig.Config        `group:"Migrator Options" namespace:"mig"`
+	History pgmig.HistoryFilter `group:"History Options" namespace:"history"`
+
+	Targets      []string `long:"target" description:"Target database URL, may be repeated to run command in several databases"`
+	TargetsFile  string   `long:"targets_file" description:"File with target database URLs, one per line"`
+	ServiceGroup string   `long:"service_group" description:"Run command in pg_service.conf services matching mask (e.g. shard_*)"`
+	Jobs         int      `long:"jobs" default:"1" description:"Run command in N target databases in parallel"`
+	FailFast     bool     `long:"fail_fast" description:"Do not start other targets after first failure"`
+	TwoPhase     bool     `long:"two_phase" description:"Prepare transactions in all targets and commit only if all of them succeeded"`
+
+	WatchInterval time.Duration `long:"watch_interval" default:"1s" description:"Package files poll interval in watch mode"`
+	WatchTest     bool          `long:"watch_test" description:"Run test after command in watch mode"`
+
+	MetricsFile string `long:"metrics_file" description:"Write Prometheus metrics to file (node_exporter textfile) after run"`
+	MetricsAddr string `long:"metrics_addr" description:"Serve Prometheus metrics on this address while running (e.g. :9187)"`
+
+	TraceEndpoint string `long:"trace_endpoint" description:"Export OpenTelemetry spans to OTLP/HTTP collector (host:port or URL)"`
+	TraceFile     string `long:"trace_file" description:"Write OpenTelemetry spans as JSON to file"`
+
+	Source           string `long:"source" description:"Run packages from archive (.tar, .tar.gz, .tgz, .zip) or git revision (git:<ref>) instead of SQL sources directory"`
+	PublicKey        string `long:"public_key" description:"Source archive signature key: ed25519 (base64) or minisign public key, or file with it"`
+	Signature        string `long:"signature" description:"Source archive manifest signature file (default: SHA256SUMS.minisig or SHA256SUMS.sig in archive)"`
+	RequireSignature bool   `long:"require_signature" description:"Refuse source archive without valid signature"`
 
 	// SQL packages root. Not used with embedded fs
 	// SQLRoot        string            `long:"sql" default:"sql" description:"SQL sources directory"` // TODO: pkg/*/sql
@@ -48,24 +88,77 @@ func (fs pgmigFileSystem) Open(name string) (pgmig.File, error) { return fs.File
 // Run app and exit via given exitFunc
 func Run(exitFunc func(code int)) {
 	cfg, err := SetupConfig()
-	log := SetupLog(err != nil || cfg.Debug)
-	defer func() { Shutdown(exitFunc, err, log) }()
+	if err == nil {
+		// secret values are needed for log redaction
+		err = cfg.Mig.ResolveVars()
+	}
+	log, closeLog, e := NewLog(logOptions(cfg))
+	if e != nil {
+		log, closeLog = SetupLog(true), func() error { return nil }
+		if err == nil {
+			err = e
+		}
+	}
+	defer func() {
+		Shutdown(exitFunc, err, log)
+		closeLog()
+	}()
 	log.Info("pgmig. Postgresql drop/create migrations.", "v", version)
 	if err != nil || cfg.Version {
 		return
 	}
 
-	fs, e := sql.NewUnionFS(SQLRoot)
+	fs, e := openSource(log, cfg)
 	if e != nil {
 		err = e
 		return
 	}
 
-	cfg.Mig.GitInfo.Root = SQLRoot
-	mig := pgmig.New(log, cfg.Mig, pgmigFileSystem{fs}, "")
+	mig := pgmig.New(log, cfg.Mig, fs, "")
+	mig.Version = version
+
+	closeSinks, e := setupSinks(mig, cfg)
+	if e != nil {
+		err = e
+		return
+	}
+	defer func() {
+		if er := closeSinks(); er != nil && err == nil {
+			err = er
+		}
+	}()
 
 	ctx := context.Background()
-	dbh, e := mig.Connect(ctx, cfg.DSN)
+	if cfg.Args.Command == pgmig.CmdLint {
+		err = runLint(mig, cfg)
+		return
+	}
+	if cfg.Args.Command == pgmig.CmdNew {
+		err = runNew(mig, cfg)
+		return
+	}
+	if cfg.Args.Command == pgmig.CmdDiff {
+		err = runDiff(ctx, mig, cfg)
+		return
+	}
+	if cfg.Args.Command == pgmig.CmdPlan && !cfg.Analyze {
+		err = runPlan(ctx, mig, nil, cfg)
+		return
+	}
+	targets, e := loadTargets(cfg)
+	if e != nil {
+		err = e
+		return
+	}
+	if len(targets) > 0 {
+		err = runTargets(ctx, mig, targets, cfg)
+		return
+	}
+	if cfg.Parallel > 1 && cfg.Args.Command == pgmig.CmdTest {
+		err = pgxv4.RunParallel(ctx, mig, cfg.DSN, cfg.Args.Packages, cfg.Parallel)
+		return
+	}
+	dbh, e := pgxv4.Connect(ctx, mig, cfg.DSN)
 	if e != nil {
 		err = e
 		return
@@ -75,28 +168,415 @@ func Run(exitFunc func(code int)) {
 		log.Error(err, ">>>>>>>>>")
 		return
 	}
-	tx, e := dbh.Begin(ctx)
-	if e != nil {
-		err = e
+	if cfg.Args.Command == pgmig.CmdHistory {
+		err = printHistory(ctx, mig, dbh, cfg)
 		return
 	}
-	defer func() {
-		er := tx.Rollback(ctx)
-		if er != nil && er != pgx.ErrTxClosed {
-			mig.Log.Error(er, "Run error")
+	if cfg.Args.Command == pgmig.CmdPlan {
+		err = runPlan(ctx, mig, dbh, cfg)
+		return
+	}
+	switch cfg.Args.Command {
+	case pgmig.CmdWatch:
+		err = runWatch(ctx, mig, dbh, cfg)
+		return
+	case pgmig.CmdSnapshot, pgmig.CmdDrift:
+		err = runSnapshot(ctx, mig, dbh, cfg)
+		return
+	case pgmig.CmdCommitPrepared, pgmig.CmdRollbackPrepared:
+		gid := preparedID(cfg)
+		if err = mig.FinishPrepared(ctx, pgxv4.WrapConn(dbh), gid, cfg.Args.Command == pgmig.CmdCommitPrepared); err == nil {
+			log.Info("Finished prepared transaction", "gid", gid, "command", cfg.Args.Command)
 		}
-	}()
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go mig.PrintMessages(&wg)
-	commit, err := mig.Run(tx, cfg.Args.Command, cfg.Args.Packages)
-	if err == nil && *commit {
-		err = tx.Commit(ctx)
+		if er := mig.SaveHistory(ctx, pgxv4.WrapConn(dbh), nil); er != nil {
+			log.Error(er, "Save history error")
+		}
+		return
+	}
+	var commit bool
+	if cfg.Prepare != "" {
+		commit, err = mig.PrepareTx(ctx, pgxv4.WrapConn(dbh), cfg.Args.Command, cfg.Args.Packages, cfg.Prepare)
+	} else {
+		commit, err = pgxv4.RunTx(ctx, mig, dbh, cfg.Args.Command, cfg.Args.Packages)
+	}
+	if er := mig.SaveHistory(ctx, pgxv4.WrapConn(dbh), err); er != nil {
+		log.Error(er, "Save history error")
 	}
-	close(mig.MessageChan)
-	wg.Wait()
 	if err == nil || err != pgx.ErrTxClosed { // shutdown shows error otherwise
-		log.Info("Saved", "commit", *commit)
+		log.Info("Saved", "commit", commit, "prepared", cfg.Prepare)
+	}
+}
+
+// openSource returns file system of SQL packages: archive or git revision if --source is set,
+// SQL sources otherwise
+func openSource(log logr.Logger, cfg *Config) (pgmig.FileSystem, error) {
+	ref := strings.TrimPrefix(cfg.Source, pgmig.GitSourcePrefix)
+	isGit := ref != cfg.Source
+	if (cfg.Source == "" || isGit) && (cfg.PublicKey != "" || cfg.Signature != "" || cfg.RequireSignature) {
+		return nil, errors.New("signature is supported for archive source only")
+	}
+	if cfg.Source != "" && cfg.Args.Command == pgmig.CmdSnapshot {
+		// snapshot is saved into SQL sources directory which is not the source of packages
+		return nil, errors.New("snapshot is saved into SQL sources, run it without --source")
+	}
+	if cfg.Source == "" {
+		fs, err := sql.NewUnionFS(SQLRoot)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Mig.GitInfo.Root = SQLRoot
+		return pgmigFileSystem{fs}, nil
+	}
+	if isGit {
+		gi := cfg.Mig.GitInfo
+		gi.Root = SQLRoot
+		fs, err := pgmig.OpenGit(gi, ref)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Source git revision", "ref", ref, "version", fs.Version())
+		return fs, nil
+	}
+	fs, err := pgmig.OpenArchive(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySource(log, fs, cfg); err != nil {
+		return nil, err
+	}
+	log.Info("Source archive", "file", cfg.Source, "verified", fs.Verified(), "signed", fs.Signed())
+	return fs, nil
+}
+
+// verifySource checks source archive signature if public key is set.
+// Unsigned archive is refused only if signature is required
+func verifySource(log logr.Logger, fs *pgmig.ArchiveFS, cfg *Config) error {
+	if cfg.PublicKey == "" {
+		if cfg.RequireSignature {
+			return errors.New("--require_signature needs --public_key")
+		}
+		return nil
+	}
+	keyData := cfg.PublicKey
+	if data, err := os.ReadFile(cfg.PublicKey); err == nil {
+		keyData = string(data)
+	}
+	key, err := pgmig.ParsePublicKey(keyData)
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	if cfg.Signature != "" {
+		if sig, err = os.ReadFile(cfg.Signature); err != nil {
+			return err
+		}
+	}
+	err = fs.VerifySignature(key, sig)
+	if err == pgmig.ErrNoSignature && !cfg.RequireSignature {
+		log.Info("Source archive is not signed", "file", cfg.Source)
+		return nil
+	}
+	return err
+}
+
+// preparedID returns prepared transaction id from command args or --prepare
+func preparedID(cfg *Config) string {
+	if len(cfg.Args.Packages) > 0 {
+		return cfg.Args.Packages[0]
+	}
+	return cfg.Prepare
+}
+
+// setupSinks registers event sinks and returns func which closes them
+func setupSinks(mig *pgmig.Migrator, cfg *Config) (func() error, error) {
+	var files []*os.File
+	var srv *http.Server
+	var flushTrace func(context.Context) error
+	closeAll := func() error {
+		if srv != nil {
+			srv.Close()
+		}
+		err := mig.CloseSinks()
+		if flushTrace != nil {
+			if e := flushTrace(context.Background()); e != nil && err == nil {
+				err = e
+			}
+		}
+		for _, f := range files {
+			if e := f.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	mig.AddSink(pgmig.NewConsoleSink(os.Stdout, mig.IsTerminal))
+	if cfg.JSON != "" {
+		f, err := os.Create(cfg.JSON)
+		if err != nil {
+			return closeAll, err
+		}
+		files = append(files, f)
+		mig.AddSink(pgmig.NewJSONSink(f))
+	}
+	if cfg.JUnit != "" {
+		f, err := os.Create(cfg.JUnit)
+		if err != nil {
+			return closeAll, err
+		}
+		files = append(files, f)
+		mig.AddSink(pgmig.NewJUnitSink(f))
+	}
+	if cfg.MetricsFile != "" || cfg.MetricsAddr != "" {
+		ms := pgmig.NewMetricsSink(cfg.MetricsFile)
+		mig.AddSink(ms)
+		if cfg.MetricsAddr != "" {
+			ln, err := net.Listen("tcp", cfg.MetricsAddr)
+			if err != nil {
+				return closeAll, err
+			}
+			srv = &http.Server{Handler: ms, ReadHeaderTimeout: 10 * time.Second}
+			go srv.Serve(ln) //nolint:errcheck // returns ErrServerClosed on close
+		}
+	}
+	if cfg.TraceEndpoint != "" || cfg.TraceFile != "" {
+		var w io.Writer
+		if cfg.TraceFile != "" {
+			f, err := os.Create(cfg.TraceFile)
+			if err != nil {
+				return closeAll, err
+			}
+			files = append(files, f)
+			w = f
+		}
+		sink, flush, err := setupTracing(cfg, w)
+		if err != nil {
+			return closeAll, err
+		}
+		flushTrace = flush
+		mig.AddSink(sink)
+	}
+	return closeAll, nil
+}
+
+// runPlan shows files of planned command and analyzes their locks if dbh is set
+func runPlan(ctx context.Context, mig *pgmig.Migrator, dbh *pgx.Conn, cfg *Config) error {
+	if len(cfg.Args.Packages) == 0 {
+		return errors.New("plan requires command")
+	}
+	if dbh == nil {
+		_, err := mig.Plan(nil, cfg.Args.Packages[0], cfg.Args.Packages[1:])
+		return err
+	}
+	tx, err := dbh.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck // tx is read only
+	_, err = mig.Plan(pgxv4.WrapTx(tx), cfg.Args.Packages[0], cfg.Args.Packages[1:])
+	return err
+}
+
+// runWatch runs command on package changes until interrupted
+func runWatch(ctx context.Context, mig *pgmig.Migrator, dbh *pgx.Conn, cfg *Config) error {
+	if len(cfg.Args.Packages) == 0 {
+		return errors.New("watch requires command")
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	opts := pgmig.WatchOptions{Interval: cfg.WatchInterval, Test: cfg.WatchTest}
+	return mig.Watch(ctx, pgxv4.WrapConn(dbh), cfg.Args.Packages[0], cfg.Args.Packages[1:], opts)
+}
+
+// runSnapshot saves package schema snapshots or compares schemas with them.
+// Drift returns error if any package schema differs from its snapshot
+func runSnapshot(ctx context.Context, mig *pgmig.Migrator, dbh *pgx.Conn, cfg *Config) error {
+	tx, err := dbh.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck // tx is read only
+	if cfg.Args.Command == pgmig.CmdDrift {
+		drifts, err := mig.Drift(pgxv4.WrapTx(tx), cfg.Args.Packages)
+		if err != nil {
+			return err
+		}
+		for _, d := range drifts {
+			if len(d.Items) > 0 {
+				return fmt.Errorf("schema drift found in package %s", d.Pkg)
+			}
+		}
+		return nil
+	}
+	snaps, err := mig.Snapshot(pgxv4.WrapTx(tx), cfg.Args.Packages)
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		name, err := mig.SaveSnapshot(SQLRoot, s)
+		if err != nil {
+			return err
+		}
+		mig.Log.Info("Snapshot saved", "pkg", s.Pkg, "file", name, "objects", len(s.Objects))
+	}
+	return nil
+}
+
+// runNew creates package or file in SQL sources directory
+func runNew(mig *pgmig.Migrator, cfg *Config) error {
+	args := cfg.Args.Packages
+	var files []string
+	switch {
+	case len(args) == 2 && args[0] == "package":
+		names, err := mig.NewPackage(SQLRoot, args[1])
+		if err != nil {
+			return err
+		}
+		files = names
+	case len(args) >= 4 && args[0] == "file":
+		name, err := mig.NewFile(SQLRoot, args[1], args[2], strings.Join(args[3:], " "))
+		if err != nil {
+			return err
+		}
+		files = []string{name}
+	default:
+		return errors.New("usage: new package <name> | new file <pkg> <init|once|new|test> <title>")
+	}
+	for _, f := range files {
+		mig.Log.Info("Created", "file", f)
+	}
+	return nil
+}
+
+// runDiff shows schema changes between --from and --to and returns error if they differ
+func runDiff(ctx context.Context, mig *pgmig.Migrator, cfg *Config) error {
+	if cfg.From == "" || cfg.To == "" {
+		return errors.New("diff requires --from and --to")
+	}
+	diffs, err := pgxv4.Diff(ctx, mig, cfg.From, cfg.To, cfg.Args.Packages)
+	if err != nil {
+		return err
+	}
+	cnt := 0
+	for _, d := range diffs {
+		cnt += len(d.Items)
+	}
+	if cnt > 0 {
+		return fmt.Errorf("%d difference(s) found", cnt)
+	}
+	return nil
+}
+
+// loadTargets returns target databases from all configured sources
+func loadTargets(cfg *Config) ([]pgmig.Target, error) {
+	var rv []pgmig.Target
+	for _, dsn := range cfg.Targets {
+		t, err := pgxv4.NewTarget(dsn)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, t)
+	}
+	if cfg.TargetsFile != "" {
+		f, err := os.Open(cfg.TargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		targets, err := pgxv4.ReadTargets(f)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, targets...)
+	}
+	if cfg.ServiceGroup != "" {
+		targets, err := pgmig.ServiceTargets("", cfg.ServiceGroup)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no services match %s", cfg.ServiceGroup)
+		}
+		rv = append(rv, targets...)
+	}
+	return rv, nil
+}
+
+// runTargets runs command in several databases and returns error if any of them failed
+func runTargets(ctx context.Context, mig *pgmig.Migrator, targets []pgmig.Target, cfg *Config) error {
+	switch cfg.Args.Command {
+	case pgmig.CmdHistory, pgmig.CmdPlan, pgmig.CmdLint, pgmig.CmdSnapshot, pgmig.CmdDrift, pgmig.CmdWatch:
+		return fmt.Errorf("%s does not support several targets", cfg.Args.Command)
+	}
+	opts := pgmig.MultiOptions{Jobs: cfg.Jobs, FailFast: cfg.FailFast, TwoPhase: cfg.TwoPhase}
+	switch cfg.Args.Command {
+	case pgmig.CmdCommitPrepared, pgmig.CmdRollbackPrepared:
+		opts.GID = preparedID(cfg)
+	default:
+		if cfg.Prepare != "" {
+			// keep transactions prepared for commit-prepared
+			opts.TwoPhase, opts.GID, opts.Hold = true, cfg.Prepare, true
+		}
+	}
+	rep, err := pgxv4.RunTargets(ctx, mig, targets, cfg.Args.Command, cfg.Args.Packages, opts)
+	if err != nil {
+		return err
+	}
+	if rep.Failed > 0 {
+		return fmt.Errorf("%d of %d targets failed", rep.Failed, len(rep.Results))
+	}
+	return nil
+}
+
+// runLint prints lint report and returns error if issues found
+func runLint(mig *pgmig.Migrator, cfg *Config) error {
+	rep, err := mig.Lint(cfg.Args.Packages)
+	if err != nil {
+		return err
+	}
+	switch cfg.Mig.LintFormat {
+	case "json":
+		err = rep.WriteJSON(os.Stdout)
+	case "sarif":
+		err = rep.WriteSARIF(os.Stdout)
+	default:
+		err = rep.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rep.Issues) > 0 {
+		return fmt.Errorf("%d lint issue(s) found", len(rep.Issues))
+	}
+	return nil
+}
+
+// printHistory prints run history records
+func printHistory(ctx context.Context, mig *pgmig.Migrator, dbh *pgx.Conn, cfg *Config) error {
+	runs, err := mig.QueryHistory(ctx, pgxv4.WrapConn(dbh), cfg.Args.Packages, cfg.History)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		fmt.Printf("# %d %s %s %v %s\n", r.ID, r.Started.Format(time.RFC3339), r.Command, r.Packages, r.Outcome)
+		fmt.Printf("  user: %s (os: %s@%s %s), pgmig: %s, duration: %s\n", r.DBUser, r.OSUser, r.ClientHost, r.ClientAddr,
+			r.AppVersion, r.Finished.Sub(r.Started).Round(time.Millisecond))
+		if r.GID != "" {
+			fmt.Printf("  prepared: %s\n", r.GID)
+		}
+		pkgs := make([]string, 0, len(r.Sources))
+		for pkg := range r.Sources {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		for _, pkg := range pkgs {
+			fmt.Printf("  source: %s %s from %s\n", pkg, r.Sources[pkg].Version, r.Sources[pkg].Repo)
+		}
+		if r.Error != "" {
+			fmt.Printf("  error: %s\n", r.Error)
+		}
+		for _, f := range r.Files {
+			fmt.Printf("  %s.%s %s %s %s\n", f.Pkg, f.Op, f.File, f.MD5, f.Duration.Round(time.Millisecond))
+		}
 	}
+	return nil
 }
@@ -24,6 +24,9 @@ func TestRunErrors(t *testing.T) {
 	}{
 		{"Help", 3, []string{"-h"}},
 		{"UnknownFlag", 2, []string{"-0"}},
+		{"SignatureWithoutArchive", 1, []string{"--require_signature", "lint"}},
+		{"SignatureWithGit", 1, []string{"--source", "git:HEAD", "--public_key", "key", "lint"}},
+		{"SnapshotWithSource", 1, []string{"--source", "git:HEAD", "snapshot"}},
 	}
 	for _, tt := range tests {
 		os.Args = append([]string{a[0]}, tt.args...)
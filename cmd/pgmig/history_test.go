@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pgmig/pgmig"
+	"github.com/pgmig/pgmig/cmd/pgmig/internal/sql"
+)
+
+// emptyRows is an empty query result
+type emptyRows struct{}
+
+func (emptyRows) Next() bool                     { return false }
+func (emptyRows) Scan(dest ...interface{}) error { return nil }
+func (emptyRows) Err() error                     { return nil }
+func (emptyRows) Close()                         {}
+
+// logDB is a pgmig.DB which logs statements
+type logDB struct {
+	sql []string
+}
+
+func (db *logDB) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	db.sql = append(db.sql, sql)
+	return nil
+}
+
+func (db *logDB) Query(ctx context.Context, sql string, args ...interface{}) (pgmig.Rows, error) {
+	db.sql = append(db.sql, sql)
+	return emptyRows{}, nil
+}
+
+func (db *logDB) BeginTx(ctx context.Context) (pgmig.TxExecutor, error) { return db, nil }
+func (db *logDB) Commit(ctx context.Context) error                      { return nil }
+func (db *logDB) Rollback(ctx context.Context) error                    { return nil }
+
+// TestEmbeddedHistory checks that history of binary run is saved with embedded core package
+func TestEmbeddedHistory(t *testing.T) {
+	ctx := context.Background()
+	cfg := pgmig.Config{NoHooks: true}
+	mig := pgmig.New(logr.Discard(), cfg, pgmigFileSystem{sql.FS()}, "")
+	db := &logDB{}
+	_, err := mig.RunExec(db, pgmig.CmdInit, []string{pgmig.CorePackage})
+	require.NoError(t, err)
+	require.NoError(t, mig.SaveHistory(ctx, db, nil))
+	setup := fmt.Sprintf(pgmig.SQLHistorySetup, `"`+pgmig.HistorySchema+`"`)
+	assert.Contains(t, db.sql, setup)
+	assert.True(t, strings.HasPrefix(db.sql[len(db.sql)-1], "INSERT INTO "+`"`+pgmig.HistorySchema+`".run `))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"github.com/mattn/go-colorable"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/pgmig/pgmig"
+)
+
+// Log formats
+const (
+	LogText   = "text"
+	LogJSON   = "json"
+	LogLogfmt = "logfmt"
+)
+
+// LogOptions holds logger options
+type LogOptions struct {
+	// Format holds log format, default is text with debug level and json otherwise
+	Format string
+	// Level holds min level: debug, info or error
+	Level string
+	// File holds log file name, text is written to stdout and other formats to stderr if empty
+	File string
+	// Secrets holds values replaced in log
+	Secrets []string
+}
+
+// logOptions returns logger options from config
+func logOptions(cfg *Config) LogOptions {
+	if cfg == nil {
+		return LogOptions{Level: "debug"}
+	}
+	opts := LogOptions{Format: cfg.LogFormat, Level: cfg.LogLevel, File: cfg.LogFile, Secrets: cfg.Mig.SecretValues()}
+	if cfg.Debug || cfg.Mig.Debug {
+		opts.Level = "debug"
+	}
+	return opts
+}
+
+// NewLog creates logger and returns func which closes log file.
+// DSN passwords and secrets are replaced in messages, strings and errors.
+func NewLog(opts LogOptions, zapOpts ...zap.Option) (logr.Logger, func() error, error) {
+	level := zapcore.InfoLevel
+	switch opts.Level {
+	case "debug":
+		level = zapcore.DebugLevel
+	case "", "info":
+	case "error":
+		level = zapcore.ErrorLevel
+	default:
+		return logr.Discard(), nil, fmt.Errorf("unknown log level %q", opts.Level)
+	}
+	format := opts.Format
+	if format == "" {
+		format = LogJSON
+		if level == zapcore.DebugLevel {
+			format = LogText
+		}
+	}
+	closeFunc := func() error { return nil }
+	var out zapcore.WriteSyncer
+	switch {
+	case opts.File != "":
+		f, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return logr.Discard(), nil, err
+		}
+		out, closeFunc = zapcore.Lock(f), f.Close
+	case format == LogText:
+		out = zapcore.AddSync(colorable.NewColorableStdout())
+	default:
+		out = zapcore.Lock(os.Stderr)
+	}
+	var core zapcore.Core
+	switch format {
+	case LogText:
+		ec := zap.NewDevelopmentEncoderConfig()
+		if opts.File == "" {
+			ec.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+		core = zapcore.NewCore(zapcore.NewConsoleEncoder(ec), out, level)
+	case LogJSON:
+		core = zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, level)
+	case LogLogfmt:
+		core = &logfmtCore{LevelEnabler: level, out: out}
+	default:
+		closeFunc()
+		return logr.Discard(), nil, fmt.Errorf("unknown log format %q", format)
+	}
+	core = &redactCore{Core: core, redact: redactor(opts.Secrets)}
+	zapOpts = append(zapOpts, zap.AddCaller())
+	return zapr.NewLogger(zap.New(core, zapOpts...)), closeFunc, nil
+}
+
+// redactor returns func which replaces DSN passwords and secrets in string
+func redactor(secrets []string) func(string) string {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, pgmig.RedactedValue)
+		}
+	}
+	r := strings.NewReplacer(pairs...)
+	return func(s string) string {
+		return r.Replace(pgmig.RedactDSN(s))
+	}
+}
+
+// redactCore replaces secrets in entries of wrapped core
+type redactCore struct {
+	zapcore.Core
+	redact func(string) string
+}
+
+// With adds redacted fields to core
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.fields(fields)), redact: c.redact}
+}
+
+// Check adds core to checked entry if level is enabled
+func (c *redactCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// Write writes redacted entry
+func (c *redactCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	e.Message = c.redact(e.Message)
+	return c.Core.Write(e, c.fields(fields))
+}
+
+// fields returns fields with secrets replaced.
+// Non string fields are replaced by redacted string only if their text contains secrets
+func (c *redactCore) fields(fields []zapcore.Field) []zapcore.Field {
+	rv := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = c.redact(f.String)
+		case zapcore.ErrorType, zapcore.StringerType, zapcore.ReflectType:
+			if f.Interface != nil {
+				s := fmt.Sprintf("%+v", f.Interface)
+				if rs := c.redact(s); rs != s {
+					f = zap.String(f.Key, rs)
+				}
+			}
+		}
+		rv[i] = f
+	}
+	return rv
+}
+
+// logfmtCore writes entries in logfmt format
+type logfmtCore struct {
+	zapcore.LevelEnabler
+	out    zapcore.WriteSyncer
+	fields []zapcore.Field
+}
+
+// With returns core with added context fields
+func (c *logfmtCore) With(fields []zapcore.Field) zapcore.Core {
+	all := append(c.fields[:len(c.fields):len(c.fields)], fields...)
+	return &logfmtCore{LevelEnabler: c.LevelEnabler, out: c.out, fields: all}
+}
+
+// Check adds core to checked entry if level is enabled
+func (c *logfmtCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// Write writes entry as logfmt line
+func (c *logfmtCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	var b strings.Builder
+	writeLogfmt(&b, "ts", e.Time.Format(time.RFC3339Nano))
+	writeLogfmt(&b, "level", e.Level.String())
+	if e.LoggerName != "" {
+		writeLogfmt(&b, "logger", e.LoggerName)
+	}
+	if e.Caller.Defined {
+		writeLogfmt(&b, "caller", e.Caller.TrimmedPath())
+	}
+	writeLogfmt(&b, "msg", e.Message)
+	for _, f := range append(c.fields[:len(c.fields):len(c.fields)], fields...) {
+		enc := zapcore.NewMapObjectEncoder()
+		f.AddTo(enc)
+		keys := make([]string, 0, len(enc.Fields))
+		for k := range enc.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeLogfmt(&b, k, logfmtValue(enc.Fields[k]))
+		}
+	}
+	b.WriteByte('\n')
+	_, err := c.out.Write([]byte(b.String()))
+	return err
+}
+
+// Sync flushes output
+func (c *logfmtCore) Sync() error {
+	return c.out.Sync()
+}
+
+// writeLogfmt writes key=value pair, value is quoted if needed
+func writeLogfmt(b *strings.Builder, key, value string) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}) >= 0 {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(value)
+}
+
+// logfmtValue returns text of field value, complex values are encoded as JSON
+func logfmtValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	case time.Duration:
+		return val.String()
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(val)
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -4,10 +4,7 @@ import (
 	"errors"
 
 	"github.com/go-logr/logr"
-	"github.com/go-logr/zapr"
-	"github.com/mattn/go-colorable"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 
 	"github.com/jessevdk/go-flags"
 )
@@ -18,6 +15,10 @@ import (
 type Flags struct {
 	Version bool `long:"version"                       description:"Show version and exit"`
 	Debug   bool `long:"debug"                         description:"Show debug data"`
+
+	LogFormat string `long:"log_format" choice:"text" choice:"json" choice:"logfmt" description:"Log format (default: text with --debug, json otherwise)"`
+	LogLevel  string `long:"log_level" choice:"debug" choice:"info" choice:"error" default:"info" description:"Min log level, --debug sets debug"`
+	LogFile   string `long:"log_file" description:"Write log to file"`
 }
 
 var (
@@ -47,26 +48,13 @@ func SetupConfig(args ...string) (*Config, error) {
 	return cfg, nil
 }
 
-// SetupLog creates logger
+// SetupLog creates logger with default format
 func SetupLog(withDebug bool, opts ...zap.Option) logr.Logger {
-	var log logr.Logger
+	lo := LogOptions{}
 	if withDebug {
-		aa := zap.NewDevelopmentEncoderConfig()
-		zo := append(opts, zap.AddCaller())
-		aa.EncodeLevel = zapcore.CapitalColorLevelEncoder
-		zapLog := zap.New(zapcore.NewCore(
-			zapcore.NewConsoleEncoder(aa),
-			zapcore.AddSync(colorable.NewColorableStdout()),
-			zapcore.DebugLevel,
-		),
-			zo...,
-		)
-		log = zapr.NewLogger(zapLog)
-	} else {
-		zc := zap.NewProductionConfig()
-		zapLog, _ := zc.Build(opts...)
-		log = zapr.NewLogger(zapLog)
+		lo.Level = "debug"
 	}
+	log, _, _ := NewLog(lo, opts...)
 	return log
 }
 
@@ -2,9 +2,12 @@ package main_test
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -54,3 +57,49 @@ func TestShutdown(t *testing.T) {
 	assert.Equal(t, 1, c)
 	assert.Equal(t, []string{"Run error"}, logRows)
 }
+
+func TestNewLog(t *testing.T) {
+	secretErr := errors.New("connect postgres://op:pass@db/app failed")
+	tests := []struct {
+		name   string
+		opts   cmd.LogOptions
+		want   []string
+		absent []string
+	}{
+		{"Logfmt", cmd.LogOptions{Format: cmd.LogLogfmt, Secrets: []string{"s3cr3t"}}, []string{
+			`level=info caller=`,
+			`msg="Set var" name=token value=*****`,
+			`level=error`,
+			`msg="Run error" error="connect postgres://op:*****@db/app failed"`,
+		}, []string{"s3cr3t", "pass@", "debug"}},
+		{"JSON", cmd.LogOptions{Format: cmd.LogJSON, Level: "debug", Secrets: []string{"s3cr3t"}}, []string{
+			`"level":"debug","ts":`,
+			`"msg":"Set var","name":"token","value":"*****"`,
+			`"error":"connect postgres://op:*****@db/app failed"`,
+		}, []string{"s3cr3t", "pass@"}},
+		{"Text", cmd.LogOptions{Format: cmd.LogText, Level: "error"}, []string{
+			"ERROR\t",
+		}, []string{"Set var"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.File = filepath.Join(t.TempDir(), "pgmig.log")
+			l, closeLog, err := cmd.NewLog(tt.opts)
+			require.NoError(t, err)
+			l.V(1).Info("debug")
+			l.Info("Set var", "name", "token", "value", "s3cr3t")
+			l.Error(secretErr, "Run error")
+			require.NoError(t, closeLog())
+			data, err := os.ReadFile(tt.opts.File)
+			require.NoError(t, err)
+			for _, s := range tt.want {
+				assert.Contains(t, string(data), s)
+			}
+			for _, s := range tt.absent {
+				assert.NotContains(t, string(data), s)
+			}
+		})
+	}
+	_, _, err := cmd.NewLog(cmd.LogOptions{Format: "xml"})
+	assert.EqualError(t, err, `unknown log format "xml"`)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgmig/pgmig"
+)
+
+func TestOpenSourceSnapshot(t *testing.T) {
+	cfg := &Config{Source: "git:HEAD"}
+	cfg.Args.Command = pgmig.CmdSnapshot
+	_, err := openSource(logr.Discard(), cfg)
+	assert.EqualError(t, err, "snapshot is saved into SQL sources, run it without --source")
+}
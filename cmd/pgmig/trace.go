@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/pgmig/pgmig"
+	"github.com/pgmig/pgmig/pgmigotel"
+)
+
+// setupTracing returns sink which exports spans to OTLP collector if cfg.TraceEndpoint is set
+// and to w if it is not nil, and func which flushes spans on close.
+// Spans are children of TRACEPARENT span, so the run is a part of rollout trace.
+func setupTracing(cfg *Config, w io.Writer) (pgmig.EventSink, func(context.Context) error, error) {
+	ctx := context.Background()
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(resource.NewSchemaless(
+		attribute.String("service.name", "pgmig"),
+		attribute.String("service.version", version),
+	))}
+	if cfg.TraceEndpoint != "" {
+		var exp sdktrace.SpanExporter
+		var err error
+		if strings.Contains(cfg.TraceEndpoint, "://") {
+			exp, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.TraceEndpoint))
+		} else {
+			exp, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(cfg.TraceEndpoint), otlptracehttp.WithInsecure())
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	if w != nil {
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	return pgmigotel.NewSink(traceParent(ctx), tp.Tracer("github.com/pgmig/pgmig")), tp.Shutdown, nil
+}
+
+// traceParent returns ctx with span context from TRACEPARENT and TRACESTATE env vars if set
+func traceParent(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
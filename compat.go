@@ -0,0 +1,80 @@
+//go:build !pgmig_nopgxv4
+
+// This file holds deprecated pgx v4 API which is kept for one release, use pgxv4 package instead.
+// pgxv4 package can't be called from here because it imports pgmig, so its adapter is repeated.
+// Build with pgmig_nopgxv4 tag to drop pgx v4 dependency of this package.
+
+package pgmig
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Connect makes connection which passes notices to Migrator.
+// Deprecated: use pgxv4.Connect.
+func (mig *Migrator) Connect(ctx context.Context, dsn string) (*pgx.Conn, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.OnNotice = func(_ *pgconn.PgConn, n *pgconn.Notice) {
+		mig.ProcessNotice(n.Code, n.Message, n.Detail)
+	}
+	config.BuildStatementCache = nil // disable stmt cache for `reinit pgmig`
+	return pgx.ConnectConfig(ctx, config)
+}
+
+// Run does all work in pgx v4 transaction.
+// Deprecated: use pgxv4.Run.
+func (mig *Migrator) Run(tx pgx.Tx, command string, packages []string) (*bool, error) {
+	return mig.RunExec(v4Tx{tx}, command, packages)
+}
+
+// v4Tx is the executor for pgx v4 transaction
+type v4Tx struct {
+	tx pgx.Tx
+}
+
+func (t v4Tx) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	_, err := t.tx.Exec(ctx, sql, args...)
+	return v4Error(err)
+}
+
+func (t v4Tx) Query(ctx context.Context, sql string, args ...interface{}) (Rows, error) {
+	r, err := t.tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, v4Error(err)
+	}
+	return v4Rows{r}, nil
+}
+
+func (t v4Tx) Commit(ctx context.Context) error { return v4Error(t.tx.Commit(ctx)) }
+
+func (t v4Tx) Rollback(ctx context.Context) error {
+	if err := t.tx.Rollback(ctx); !errors.Is(err, pgx.ErrTxClosed) {
+		return v4Error(err)
+	}
+	return nil
+}
+
+type v4Rows struct {
+	pgx.Rows
+}
+
+func (r v4Rows) Err() error { return v4Error(r.Rows.Err()) }
+
+// v4Error converts pgx v4 PG error like pgxv4.Error does
+func v4Error(err error) error {
+	var e *pgconn.PgError
+	if !errors.As(err, &e) {
+		return err
+	}
+	return &DBError{Severity: e.Severity, Code: e.Code, Message: e.Message, Detail: e.Detail, Hint: e.Hint,
+		Position: e.Position, InternalPosition: e.InternalPosition, InternalQuery: e.InternalQuery, Where: e.Where,
+		SchemaName: e.SchemaName, TableName: e.TableName, ColumnName: e.ColumnName, DataTypeName: e.DataTypeName,
+		ConstraintName: e.ConstraintName, File: e.File, Line: e.Line, Routine: e.Routine}
+}
@@ -0,0 +1,410 @@
+// This file holds SQL functions coverage collector.
+// Function calls are fetched from pg_stat_xact_user_functions before test transaction rollback,
+// plpgsql lines are fetched from plpgsql_check profiler if this extension is installed.
+// Calls are counted only if track_functions can be set to all (superuser) or is set already,
+// coverage is reported as unavailable otherwise. SQL functions inlined by planner are never counted.
+
+package pgmig
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SQLTrackFunctions fetches track_functions setting
+	SQLTrackFunctions = "SELECT current_setting('track_functions')"
+	// SQLSetTrackFunctions enables function call statistics for transaction
+	SQLSetTrackFunctions = "SELECT set_config('track_functions', 'all', true)"
+	// SQLProfilerExists checks if plpgsql_check extension is installed
+	SQLProfilerExists = "SELECT true FROM pg_extension WHERE extname = 'plpgsql_check'"
+	// SQLProfilerOn enables plpgsql_check profiler for transaction
+	SQLProfilerOn = "SELECT set_config('plpgsql_check.profiler', 'on', true)"
+	// SQLProfilerReset clears profiler data of functions in schemas
+	SQLProfilerReset = `SELECT plpgsql_profiler_reset(p.oid)
+  FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace JOIN pg_language l ON l.oid = p.prolang
+ WHERE n.nspname = ANY($1::text[]) AND l.lanname = 'plpgsql'`
+	// SQLFuncCalls fetches functions of schemas with calls count in current transaction
+	SQLFuncCalls = `SELECT p.oid, n.nspname, p.proname, pg_get_function_identity_arguments(p.oid), l.lanname
+     , coalesce(s.calls, 0)
+  FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace JOIN pg_language l ON l.oid = p.prolang
+  LEFT JOIN pg_stat_xact_user_functions s ON s.funcid = p.oid
+ WHERE n.nspname = ANY($1::text[]) AND l.lanname IN ('plpgsql', 'sql') AND p.prokind = 'f'
+ ORDER BY 2, 3, 4`
+	// SQLFuncLines fetches plpgsql function line counters from profiler
+	SQLFuncLines = "SELECT lineno, exec_stmts FROM plpgsql_profiler_function_tb($1::oid::regprocedure) WHERE cmds_on_row > 0"
+)
+
+// FuncCoverage holds coverage data of single function.
+type FuncCoverage struct {
+	Schema string
+	Name   string
+	Args   string
+	Lang   string
+	Calls  int64
+	// Lines holds statement line execution counters, nil if unavailable
+	Lines map[int]int64
+}
+
+// Signature returns function name with schema and args.
+func (f FuncCoverage) Signature() string {
+	return fmt.Sprintf("%s.%s(%s)", f.Schema, f.Name, f.Args)
+}
+
+// Coverage holds functions coverage message fields.
+type Coverage struct {
+	Funcs []FuncCoverage
+	// Unavailable holds the reason why function calls were not counted
+	Unavailable string `json:",omitempty"`
+}
+
+// coverageMode holds coverage collection mode of test transaction
+type coverageMode struct {
+	track string // track_functions value
+	lines bool   // plpgsql line profiler is available
+}
+
+// Called returns count of called functions.
+func (c Coverage) Called() (rv int) {
+	for _, f := range c.Funcs {
+		if f.Calls > 0 {
+			rv++
+		}
+	}
+	return
+}
+
+// LinesCount returns count of known and executed lines.
+func (c Coverage) LinesCount() (total, hit int) {
+	for _, f := range c.Funcs {
+		for _, cnt := range f.Lines {
+			total++
+			if cnt > 0 {
+				hit++
+			}
+		}
+	}
+	return
+}
+
+// merge adds counters of other coverage
+func (c *Coverage) merge(other *Coverage) {
+	if other == nil {
+		return
+	}
+	if other.Unavailable != "" {
+		c.Unavailable = other.Unavailable
+	}
+	if len(c.Funcs) == 0 {
+		c.Funcs = append(c.Funcs, other.Funcs...)
+		return
+	}
+	idx := map[string]int{}
+	for i, f := range c.Funcs {
+		idx[f.Signature()] = i
+	}
+	for _, f := range other.Funcs {
+		i, ok := idx[f.Signature()]
+		if !ok {
+			idx[f.Signature()] = len(c.Funcs)
+			c.Funcs = append(c.Funcs, f)
+			continue
+		}
+		c.Funcs[i].Calls += f.Calls
+		if f.Lines == nil {
+			continue
+		}
+		if c.Funcs[i].Lines == nil {
+			c.Funcs[i].Lines = map[int]int64{}
+		}
+		for line, cnt := range f.Lines {
+			c.Funcs[i].Lines[line] += cnt
+		}
+	}
+}
+
+// coverageSchemas returns schemas of packages as listed in their manifests, see pkgSchemas
+func coverageSchemas(pkgs []pkgDef) []string {
+	var rv []string
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, s := range pkgSchemas(pkg) {
+			if !seen[s] {
+				seen[s] = true
+				rv = append(rv, s)
+			}
+		}
+	}
+	return rv
+}
+
+// startCoverage enables function statistics for test transaction.
+// It returns track_functions value and plpgsql line profiler availability.
+func (mig *Migrator) startCoverage(tx Executor, schemas []string) (mode coverageMode, err error) {
+	ctx := context.Background()
+	if err = queryValue(tx, &mode.track, SQLTrackFunctions); err != nil {
+		return mode, errors.Wrap(err, "SQLTrackFunctions")
+	}
+	if mode.track != "all" {
+		// track_functions can be changed by superuser only, so do it in savepoint
+		if err = tx.Exec(ctx, "SAVEPOINT pgmig_coverage"); err != nil {
+			return mode, err
+		}
+		if err = tx.Exec(ctx, SQLSetTrackFunctions); err == nil {
+			mode.track = "all"
+			err = tx.Exec(ctx, "RELEASE SAVEPOINT pgmig_coverage")
+		} else {
+			mig.Log.Info("Warning: track_functions can not be set", "track_functions", mode.track, "error", err.Error())
+			err = tx.Exec(ctx, "ROLLBACK TO SAVEPOINT pgmig_coverage")
+		}
+		if err != nil {
+			return mode, err
+		}
+	}
+	var profiler bool
+	if err = queryValue(tx, &profiler, SQLProfilerExists); err != nil {
+		return mode, errors.Wrap(err, "SQLProfilerExists")
+	}
+	if !profiler {
+		return mode, nil
+	}
+	if err = tx.Exec(ctx, SQLProfilerOn); err != nil {
+		return mode, errors.Wrap(err, "SQLProfilerOn")
+	}
+	if err = tx.Exec(ctx, SQLProfilerReset, schemas); err != nil {
+		return mode, errors.Wrap(err, "SQLProfilerReset")
+	}
+	mode.lines = true
+	return mode, nil
+}
+
+// collectCoverage fetches function statistics of test transaction.
+// If track_functions is pl, sql functions are skipped because their calls are not counted
+func (mig *Migrator) collectCoverage(tx Executor, schemas []string, mode coverageMode) (*Coverage, error) {
+	ctx := context.Background()
+	rows, err := tx.Query(ctx, SQLFuncCalls, schemas)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLFuncCalls")
+	}
+	rv := &Coverage{}
+	if mode.track != "all" && mode.track != "pl" {
+		rv.Unavailable = "track_functions is " + mode.track + " and can be changed by superuser only"
+	}
+	var oids []uint32
+	for rows.Next() {
+		var oid uint32
+		f := FuncCoverage{}
+		if err = rows.Scan(&oid, &f.Schema, &f.Name, &f.Args, &f.Lang, &f.Calls); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "Incompartible value returned")
+		}
+		if mode.track == "pl" && f.Lang == "sql" {
+			continue
+		}
+		oids = append(oids, oid)
+		rv.Funcs = append(rv.Funcs, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !mode.lines {
+		return rv, nil
+	}
+	for i, oid := range oids {
+		if rv.Funcs[i].Lang != "plpgsql" {
+			continue
+		}
+		lines, err := tx.Query(ctx, SQLFuncLines, oid)
+		if err != nil {
+			return nil, errors.Wrap(err, "SQLFuncLines")
+		}
+		rv.Funcs[i].Lines = map[int]int64{}
+		for lines.Next() {
+			var line int
+			var cnt int64
+			if err = lines.Scan(&line, &cnt); err != nil {
+				lines.Close()
+				return nil, errors.Wrap(err, "Incompartible value returned")
+			}
+			rv.Funcs[i].Lines[line] = cnt
+		}
+		lines.Close()
+	}
+	return rv, nil
+}
+
+// reportCoverage sends coverage message and saves report file if configured.
+// Report file is not saved if coverage is unavailable
+func (mig *Migrator) reportCoverage(cov *Coverage) error {
+	mig.emit(cov)
+	cfg := mig.Config
+	if cfg.CoverageFile == "" {
+		return nil
+	}
+	if cov.Unavailable != "" {
+		return errors.New("Coverage is unavailable: " + cov.Unavailable)
+	}
+	fh, err := os.Create(cfg.CoverageFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	switch cfg.CoverageFormat {
+	case "lcov":
+		err = cov.WriteLcov(fh)
+	case "cobertura":
+		err = cov.WriteCobertura(fh, time.Now())
+	default:
+		err = cov.WriteText(fh)
+	}
+	return err
+}
+
+// WriteText writes coverage report as plain text.
+func (c Coverage) WriteText(w io.Writer) error {
+	if c.Unavailable != "" {
+		_, err := fmt.Fprintf(w, "total:\tunavailable\t%s\n", c.Unavailable)
+		return err
+	}
+	for _, f := range c.Funcs {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\n", f.Signature(), f.Lang, f.Calls); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "total:\t%d/%d\t%.1f%%\n", c.Called(), len(c.Funcs), percent(c.Called(), len(c.Funcs)))
+	return err
+}
+
+// WriteLcov writes coverage report in lcov tracefile format.
+// Every function is written as separate source file named by its signature.
+func (c Coverage) WriteLcov(w io.Writer) error {
+	for _, f := range c.Funcs {
+		hit := 0
+		if f.Calls > 0 {
+			hit = 1
+		}
+		fmt.Fprintf(w, "TN:\nSF:%s\nFN:1,%s\nFNDA:%d,%s\nFNF:1\nFNH:%d\n", f.Signature(), f.Name, f.Calls, f.Name, hit)
+		lines := sortedLines(f.Lines)
+		lh := 0
+		for _, line := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, f.Lines[line])
+			if f.Lines[line] > 0 {
+				lh++
+			}
+		}
+		if _, err := fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), lh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type coberturaLine struct {
+	Number int   `xml:"number,attr"`
+	Hits   int64 `xml:"hits,attr"`
+}
+
+type coberturaClass struct {
+	Name     string          `xml:"name,attr"`
+	Filename string          `xml:"filename,attr"`
+	LineRate string          `xml:"line-rate,attr"`
+	Lines    []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaPackage struct {
+	Name     string           `xml:"name,attr"`
+	LineRate string           `xml:"line-rate,attr"`
+	Classes  []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaReport struct {
+	XMLName   xml.Name           `xml:"coverage"`
+	LineRate  string             `xml:"line-rate,attr"`
+	Timestamp int64              `xml:"timestamp,attr"`
+	Version   string             `xml:"version,attr"`
+	Packages  []coberturaPackage `xml:"packages>package"`
+}
+
+// WriteCobertura writes coverage report in Cobertura XML format.
+// Schemas are written as packages and functions as classes.
+// Functions without line data are reported as single line hit by function calls.
+func (c Coverage) WriteCobertura(w io.Writer, ts time.Time) error {
+	rep := coberturaReport{Timestamp: ts.Unix(), Version: "pgmig"}
+	var total, hit int
+	pkgIdx := map[string]int{}
+	pkgCounts := map[string][2]int{}
+	for _, f := range c.Funcs {
+		cls := coberturaClass{Name: f.Signature(), Filename: f.Schema + "/" + f.Name + ".sql"}
+		if f.Lines == nil {
+			cls.Lines = []coberturaLine{{Number: 1, Hits: f.Calls}}
+		} else {
+			for _, line := range sortedLines(f.Lines) {
+				cls.Lines = append(cls.Lines, coberturaLine{Number: line, Hits: f.Lines[line]})
+			}
+		}
+		var ch int
+		for _, l := range cls.Lines {
+			if l.Hits > 0 {
+				ch++
+			}
+		}
+		cls.LineRate = rate(ch, len(cls.Lines))
+		total += len(cls.Lines)
+		hit += ch
+		i, ok := pkgIdx[f.Schema]
+		if !ok {
+			i = len(rep.Packages)
+			pkgIdx[f.Schema] = i
+			rep.Packages = append(rep.Packages, coberturaPackage{Name: f.Schema})
+		}
+		rep.Packages[i].Classes = append(rep.Packages[i].Classes, cls)
+		cnt := pkgCounts[f.Schema]
+		pkgCounts[f.Schema] = [2]int{cnt[0] + len(cls.Lines), cnt[1] + ch}
+	}
+	for i, p := range rep.Packages {
+		cnt := pkgCounts[p.Name]
+		rep.Packages[i].LineRate = rate(cnt[1], cnt[0])
+	}
+	rep.LineRate = rate(hit, total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func sortedLines(lines map[int]int64) []int {
+	rv := make([]int, 0, len(lines))
+	for line := range lines {
+		rv = append(rv, line)
+	}
+	sort.Ints(rv)
+	return rv
+}
+
+func percent(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+func rate(part, total int) string {
+	if total == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.4f", float64(part)/float64(total))
+}
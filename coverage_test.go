@@ -0,0 +1,157 @@
+package pgmig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCoverage() *Coverage {
+	return &Coverage{Funcs: []FuncCoverage{
+		{Schema: "a", Name: "f1", Args: "a_id integer", Lang: "plpgsql", Calls: 2, Lines: map[int]int64{3: 2, 5: 0}},
+		{Schema: "a", Name: "f2", Lang: "sql"},
+	}}
+}
+
+func TestCoverageMerge(t *testing.T) {
+	cov := &Coverage{}
+	cov.merge(testCoverage())
+	cov.merge(&Coverage{Funcs: []FuncCoverage{
+		{Schema: "a", Name: "f1", Args: "a_id integer", Lang: "plpgsql", Calls: 1, Lines: map[int]int64{5: 1}},
+		{Schema: "a", Name: "f2", Lang: "sql", Calls: 3},
+		{Schema: "b", Name: "f3", Lang: "sql"},
+	}})
+	cov.merge(nil)
+	require.Len(t, cov.Funcs, 3)
+	assert.Equal(t, int64(3), cov.Funcs[0].Calls)
+	assert.Equal(t, map[int]int64{3: 2, 5: 1}, cov.Funcs[0].Lines)
+	assert.Equal(t, int64(3), cov.Funcs[1].Calls)
+	assert.Equal(t, 2, cov.Called())
+	total, hit := cov.LinesCount()
+	assert.Equal(t, []int{2, 2}, []int{total, hit})
+}
+
+func TestCoverageSchemas(t *testing.T) {
+	pkgs := []pkgDef{
+		{Name: "a"},
+		{Name: "b", Manifest: &Manifest{Schemas: []string{"b_api", "a"}}},
+	}
+	assert.Equal(t, []string{"a", "b_api"}, coverageSchemas(pkgs))
+}
+
+func TestCoverageWriteText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, testCoverage().WriteText(buf))
+	assert.Equal(t, "a.f1(a_id integer)\tplpgsql\t2\na.f2()\tsql\t0\ntotal:\t1/2\t50.0%\n", buf.String())
+}
+
+func TestCoverageWriteLcov(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, testCoverage().WriteLcov(buf))
+	want := `TN:
+SF:a.f1(a_id integer)
+FN:1,f1
+FNDA:2,f1
+FNF:1
+FNH:1
+DA:3,2
+DA:5,0
+LF:2
+LH:1
+end_of_record
+TN:
+SF:a.f2()
+FN:1,f2
+FNDA:0,f2
+FNF:1
+FNH:0
+LF:0
+LH:0
+end_of_record
+`
+	assert.Equal(t, want, buf.String())
+}
+
+func TestCoverageWriteCobertura(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, testCoverage().WriteCobertura(buf, time.Unix(1, 0)))
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<coverage line-rate="0.3333" timestamp="1" version="pgmig">
+  <packages>
+    <package name="a" line-rate="0.3333">
+      <classes>
+        <class name="a.f1(a_id integer)" filename="a/f1.sql" line-rate="0.5000">
+          <lines>
+            <line number="3" hits="2"></line>
+            <line number="5" hits="0"></line>
+          </lines>
+        </class>
+        <class name="a.f2()" filename="a/f2.sql" line-rate="0.0000">
+          <lines>
+            <line number="1" hits="0"></line>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>
+`
+	assert.Equal(t, want, buf.String())
+}
+
+func TestCoverageUnavailable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	ct := pgconn.CommandTag{}
+	schemas := []string{"a"}
+
+	tx := NewMockTx(ctrl)
+	track, profiler, funcs := NewMockRows(ctrl), NewMockRows(ctrl), NewMockRows(ctrl)
+	gomock.InOrder(
+		tx.EXPECT().Query(ctx, SQLTrackFunctions).Return(track, nil),
+		track.EXPECT().Next().Return(true),
+		track.EXPECT().Scan(gomock.Any()).SetArg(0, "none"),
+		track.EXPECT().Close(),
+		tx.EXPECT().Exec(ctx, "SAVEPOINT pgmig_coverage").Return(ct, nil),
+		tx.EXPECT().Exec(ctx, SQLSetTrackFunctions).Return(ct, errors.New("permission denied")),
+		tx.EXPECT().Exec(ctx, "ROLLBACK TO SAVEPOINT pgmig_coverage").Return(ct, nil),
+		tx.EXPECT().Query(ctx, SQLProfilerExists).Return(profiler, nil),
+		profiler.EXPECT().Next().Return(false),
+		profiler.EXPECT().Close(),
+		tx.EXPECT().Query(ctx, SQLFuncCalls, schemas).Return(funcs, nil),
+		funcs.EXPECT().Next().Return(true),
+		funcs.EXPECT().Scan(gomock.Any()).Return(nil),
+		funcs.EXPECT().Next().Return(false),
+		funcs.EXPECT().Close(),
+		funcs.EXPECT().Err().Return(nil),
+	)
+	profiler.EXPECT().Err().Return(nil).AnyTimes()
+	track.EXPECT().Err().Return(nil).AnyTimes()
+
+	mig := New(logr.Discard(), Config{CoverageFile: t.TempDir() + "/coverage.txt"}, nil, "")
+	mode, err := mig.startCoverage(wrapTx(tx), schemas)
+	require.NoError(t, err)
+	assert.Equal(t, coverageMode{track: "none"}, mode)
+	cov, err := mig.collectCoverage(wrapTx(tx), schemas, mode)
+	require.NoError(t, err)
+	assert.Len(t, cov.Funcs, 1)
+	assert.Contains(t, cov.Unavailable, "track_functions is none")
+	assert.EqualError(t, mig.reportCoverage(cov), "Coverage is unavailable: "+cov.Unavailable)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, cov.WriteText(buf))
+	assert.Equal(t, "total:\tunavailable\t"+cov.Unavailable+"\n", buf.String())
+
+	merged := &Coverage{}
+	merged.merge(cov)
+	assert.Equal(t, cov.Unavailable, merged.Unavailable)
+}
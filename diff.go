@@ -0,0 +1,268 @@
+// This file holds schema diff between databases and snapshots.
+// Source is a database DSN or a directory with package snapshots (see snapshot.go).
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdDiff holds name of diff command
+	CmdDiff = "diff"
+)
+
+// Diff holds fields of package schema diff event.
+type Diff struct {
+	Pkg   string
+	From  string
+	To    string
+	Items []DriftItem
+}
+
+// Kind returns event kind
+func (*Diff) Kind() EventKind { return KindDiff }
+
+// isDSN returns true if diff source is database URL or keyword/value connection string
+func isDSN(src string) bool {
+	return strings.Contains(src, "://") || strings.Contains(src, "=")
+}
+
+// rePassword matches password of keyword/value connection string
+var rePassword = regexp.MustCompile(`\bpassword\s*=\s*('(\\.|[^'])*'|\S+)`)
+
+// sourceName returns diff source name without DSN password
+func sourceName(src string) string {
+	if !isDSN(src) {
+		return src
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme != "" {
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		q := u.Query()
+		q.Del("password")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return strings.Join(strings.Fields(rePassword.ReplaceAllString(src, "")), " ")
+}
+
+// DiffIn compares package schemas of from and to sources.
+// Database sources are connected by connect, see pgxv4.Diff.
+// Change DriftExtra means object was added in to, DriftMissing - removed.
+func (mig *Migrator) DiffIn(ctx context.Context, connect Connector, from, to string, packages []string) ([]*Diff, error) {
+	pkgs, err := mig.lookupFiles(CmdDiff, nil, nil, nil, false, packages)
+	if err != nil {
+		return nil, err
+	}
+	fromSnaps, err := mig.loadSnapshots(ctx, connect, from, pkgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Load from")
+	}
+	toSnaps, err := mig.loadSnapshots(ctx, connect, to, pkgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Load to")
+	}
+	rv := make([]*Diff, 0, len(pkgs))
+	for i, pkg := range pkgs {
+		d := &Diff{Pkg: pkg.Name, From: sourceName(from), To: sourceName(to),
+			Items: CompareSnapshots(fromSnaps[i], toSnaps[i])}
+		mig.emit(d)
+		rv = append(rv, d)
+	}
+	return rv, nil
+}
+
+// loadSnapshots returns snapshots of pkgs from database or snapshot directory
+func (mig *Migrator) loadSnapshots(ctx context.Context, connect Connector, src string, pkgs []pkgDef) ([]*Snapshot, error) {
+	rv := make([]*Snapshot, len(pkgs))
+	if !isDSN(src) {
+		for i, pkg := range pkgs {
+			name := filepath.Join(src, pkg.Name, mig.Config.SnapshotFile)
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			rv[i], err = ReadSnapshot(f)
+			f.Close()
+			if err != nil {
+				return nil, errors.Wrap(err, "Parse "+name)
+			}
+		}
+		return rv, nil
+	}
+	conn, err := connect(ctx, mig, src)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+	tx, err := conn.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck // tx is read only
+	for i, pkg := range pkgs {
+		if rv[i], err = querySnapshot(tx, pkg.Name, pkgSchemas(pkg)); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// SQL returns SQL-ish description of change which makes snapshot object the same as database one
+// (diff: makes from object the same as to one)
+func (i DriftItem) SQL() string {
+	switch i.Change {
+	case DriftExtra:
+		return createSQL(i.Kind, i.Name, i.Got)
+	case DriftMissing:
+		return dropSQL(i.Kind, i.Name, i.Want)
+	}
+	switch i.Kind {
+	case "table":
+		if strings.HasPrefix(i.Got, "view") || strings.HasPrefix(i.Got, "materialized view") {
+			if objectType(i.Got) == objectType(i.Want) {
+				return "CREATE OR REPLACE " + objectType(i.Got) + " " + i.Name
+			}
+		}
+		return fmt.Sprintf("-- %s %s -> %s", i.Name, objectType(i.Want), objectType(i.Got))
+	case "column":
+		table, col := splitName(i.Name)
+		return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s -- was: %s", table, col, i.Got, i.Want)
+	case "function":
+		return "CREATE OR REPLACE FUNCTION " + i.Name + " " + i.Got
+	case "grant":
+		return grantSQL(i.Name, i.Want, i.Got)
+	}
+	return dropSQL(i.Kind, i.Name, i.Want) + "; " + createSQL(i.Kind, i.Name, i.Got)
+}
+
+// createSQL describes creation of object
+func createSQL(kind, name, def string) string {
+	switch kind {
+	case "table":
+		return "CREATE " + objectType(def) + " " + name
+	case "column":
+		table, col := splitName(name)
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col, def)
+	case "constraint":
+		table, con := splitName(name)
+		return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", table, con, def)
+	case "index", "trigger":
+		return def
+	case "function":
+		return "CREATE FUNCTION " + name + " " + def
+	case "grant":
+		return grantSQL(name, "", def)
+	}
+	return fmt.Sprintf("-- create %s %s %s", kind, name, def)
+}
+
+// dropSQL describes removal of object
+func dropSQL(kind, name, def string) string {
+	switch kind {
+	case "table":
+		return "DROP " + objectType(def) + " " + name
+	case "column":
+		table, col := splitName(name)
+		return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, col)
+	case "constraint":
+		table, con := splitName(name)
+		return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", table, con)
+	case "index":
+		return "DROP INDEX " + name
+	case "trigger":
+		table, trg := splitName(name)
+		return fmt.Sprintf("DROP TRIGGER %s ON %s", trg, table)
+	case "function":
+		return "DROP FUNCTION " + name
+	case "grant":
+		return grantSQL(name, def, "")
+	}
+	return fmt.Sprintf("-- drop %s %s", kind, name)
+}
+
+// grantSQL describes privileges change of grant object "TYPE name TO role"
+func grantSQL(name, was, is string) string {
+	object, role := name, ""
+	if pos := strings.LastIndex(name, " TO "); pos >= 0 {
+		object, role = name[:pos], name[pos+4:]
+	}
+	wasSet, isSet := privileges(was), privileges(is)
+	var revoke, revokeOption, grant, grantOption []string
+	for p, option := range wasSet {
+		isOption, ok := isSet[p]
+		if !ok {
+			revoke = append(revoke, p)
+		} else if option && !isOption {
+			revokeOption = append(revokeOption, p)
+		}
+	}
+	for p, option := range isSet {
+		wasOption, ok := wasSet[p]
+		if option && !wasOption {
+			grantOption = append(grantOption, p)
+		} else if !ok {
+			grant = append(grant, p)
+		}
+	}
+	var rv []string
+	add := func(format string, privs []string) {
+		if len(privs) == 0 {
+			return
+		}
+		sort.Strings(privs)
+		rv = append(rv, fmt.Sprintf(format, strings.Join(privs, ", "), object, role))
+	}
+	add("REVOKE %s ON %s FROM %s", revoke)
+	add("REVOKE GRANT OPTION FOR %s ON %s FROM %s", revokeOption)
+	add("GRANT %s ON %s TO %s", grant)
+	add("GRANT %s ON %s TO %s WITH GRANT OPTION", grantOption)
+	return strings.Join(rv, "; ")
+}
+
+// privileges parses comma separated privileges list, * marks grant option which is set as map value
+func privileges(s string) map[string]bool {
+	rv := map[string]bool{}
+	for _, p := range strings.Split(s, ",") {
+		if p == "" {
+			continue
+		}
+		rv[strings.TrimSuffix(p, "*")] = strings.HasSuffix(p, "*")
+	}
+	return rv
+}
+
+// objectType returns object type of table snapshot definition, e.g. TABLE or VIEW
+func objectType(def string) string {
+	if pos := strings.Index(def, " md5 "); pos >= 0 {
+		def = def[:pos]
+	}
+	return strings.ToUpper(def)
+}
+
+// splitName splits qualified name into parent and last part, quoted identifiers are supported
+func splitName(name string) (string, string) {
+	quoted := false
+	for i := len(name) - 1; i >= 0; i-- {
+		switch name[i] {
+		case '"':
+			quoted = !quoted
+		case '.':
+			if !quoted {
+				return name[:i], name[i+1:]
+			}
+		}
+	}
+	return "", name
+}
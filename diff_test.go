@@ -0,0 +1,75 @@
+package pgmig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriftItemSQL(t *testing.T) {
+	tests := []struct {
+		item DriftItem
+		want string
+	}{
+		{DriftItem{Change: DriftExtra, Kind: "table", Name: "s.t", Got: "partitioned table"}, "CREATE PARTITIONED TABLE s.t"},
+		{DriftItem{Change: DriftMissing, Kind: "table", Name: "s.v", Want: "view md5 x"}, "DROP VIEW s.v"},
+		{DriftItem{Change: DriftChanged, Kind: "table", Name: "s.v", Want: "view md5 x", Got: "view md5 y"}, "CREATE OR REPLACE VIEW s.v"},
+		{DriftItem{Change: DriftExtra, Kind: "column", Name: `s."a.b".c`, Got: "text NOT NULL"}, `ALTER TABLE s."a.b" ADD COLUMN c text NOT NULL`},
+		{DriftItem{Change: DriftChanged, Kind: "column", Name: "s.t.c", Want: "integer", Got: "bigint"}, "ALTER TABLE s.t ALTER COLUMN c bigint -- was: integer"},
+		{DriftItem{Change: DriftMissing, Kind: "trigger", Name: "s.t.trg", Want: "CREATE TRIGGER trg ..."}, "DROP TRIGGER trg ON s.t"},
+		{DriftItem{Change: DriftChanged, Kind: "index", Name: "s.i", Want: "CREATE INDEX i ON s.t USING btree (a)", Got: "CREATE INDEX i ON s.t USING btree (b)"},
+			"DROP INDEX s.i; CREATE INDEX i ON s.t USING btree (b)"},
+		{DriftItem{Change: DriftChanged, Kind: "grant", Name: "TABLE s.t TO app", Want: "INSERT,SELECT", Got: "SELECT,UPDATE*"},
+			"REVOKE INSERT ON TABLE s.t FROM app; GRANT UPDATE ON TABLE s.t TO app WITH GRANT OPTION"},
+		{DriftItem{Change: DriftChanged, Kind: "grant", Name: "TABLE s.t TO app", Want: "DELETE*,SELECT*,UPDATE", Got: "DELETE,INSERT,SELECT*,UPDATE*"},
+			"REVOKE GRANT OPTION FOR DELETE ON TABLE s.t FROM app; GRANT INSERT ON TABLE s.t TO app; GRANT UPDATE ON TABLE s.t TO app WITH GRANT OPTION"},
+		{DriftItem{Change: DriftMissing, Kind: "grant", Name: "FUNCTION s.f(integer) TO PUBLIC", Want: "EXECUTE"},
+			"REVOKE EXECUTE ON FUNCTION s.f(integer) FROM PUBLIC"},
+		{DriftItem{Change: DriftExtra, Kind: "grant", Name: "SEQUENCE s.q TO app", Got: "SELECT,USAGE*"},
+			"GRANT SELECT ON SEQUENCE s.q TO app; GRANT USAGE ON SEQUENCE s.q TO app WITH GRANT OPTION"},
+		{DriftItem{Change: DriftMissing, Kind: "grant", Name: "SCHEMA s TO app", Want: "USAGE*"}, "REVOKE USAGE ON SCHEMA s FROM app"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.item.SQL())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	to := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(to, "snap"), 0o755))
+	err := os.WriteFile(filepath.Join(to, "snap", "pgmig.snapshot"),
+		[]byte("column\tsnap.t.id\tbigint NOT NULL\ntable\tsnap.t\ttable\ntable\tsnap.u\ttable\n"), 0o644)
+	require.NoError(t, err)
+
+	mig := New(logr.Discard(), Config{Manifest: "pgmig.json", SnapshotFile: "pgmig.snapshot"}, nil, "testdata")
+	got := []Event{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Event)
+	}))
+	diffs, err := mig.DiffIn(context.Background(), nil, "testdata", to, []string{"snap"})
+	require.NoError(t, err)
+	want := &Diff{Pkg: "snap", From: "testdata", To: to, Items: []DriftItem{
+		{Change: DriftChanged, Kind: "column", Name: "snap.t.id", Want: "integer NOT NULL", Got: "bigint NOT NULL"},
+		{Change: DriftMissing, Kind: "column", Name: "snap.t.name", Want: "text"},
+		{Change: DriftMissing, Kind: "function", Name: "snap.f(integer)",
+			Want: "returns integer language sql immutable md5 1f0e3dad99908345f7439f8ffabdffc4"},
+		{Change: DriftExtra, Kind: "table", Name: "snap.u", Got: "table"},
+	}}
+	assert.Equal(t, []*Diff{want}, diffs)
+	assert.Equal(t, []Event{want}, got)
+
+	_, err = mig.DiffIn(context.Background(), nil, "testdata", t.TempDir(), []string{"snap"})
+	assert.Error(t, err)
+}
+
+func TestSourceName(t *testing.T) {
+	assert.Equal(t, "testdata", sourceName("testdata"))
+	assert.Equal(t, "postgres://u@db:5432/app?sslmode=disable",
+		sourceName("postgres://u:secret@db:5432/app?password=x&sslmode=disable"))
+	assert.Equal(t, "host=db dbname=app", sourceName("host=db password='a b' dbname=app"))
+}
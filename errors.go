@@ -0,0 +1,30 @@
+// This file holds PG error type which does not depend on database driver.
+// Driver adapters convert PG errors to DBError, so Migrator can show file line of error.
+
+package pgmig
+
+// DBError holds PG server error fields.
+type DBError struct {
+	Severity         string
+	Code             string
+	Message          string
+	Detail           string
+	Hint             string
+	Position         int32
+	InternalPosition int32
+	InternalQuery    string
+	Where            string
+	SchemaName       string
+	TableName        string
+	ColumnName       string
+	DataTypeName     string
+	ConstraintName   string
+	File             string
+	Line             int32
+	Routine          string
+}
+
+// Error formats error like PG drivers do
+func (e *DBError) Error() string {
+	return e.Severity + ": " + e.Message + " (SQLSTATE " + e.Code + ")"
+}
@@ -0,0 +1,192 @@
+// This file holds event API.
+// Migrator sends every event to all registered sinks.
+// MessageChan, if set, receives events known before event API was introduced.
+
+package pgmig
+
+import (
+	"time"
+)
+
+// EventKind holds event type name
+type EventKind string
+
+const (
+	// KindStatus is the kind of Status event
+	KindStatus EventKind = "status"
+	// KindOp is the kind of Op event
+	KindOp EventKind = "op"
+	// KindVersion is the kind of Version event
+	KindVersion EventKind = "version"
+	// KindNewVersion is the kind of NewVersion event
+	KindNewVersion EventKind = "new_version"
+	// KindRunFile is the kind of RunFile event
+	KindRunFile EventKind = "run_file"
+	// KindTestCount is the kind of TestCount event
+	KindTestCount EventKind = "test_count"
+	// KindTestOk is the kind of TestOk event
+	KindTestOk EventKind = "test_ok"
+	// KindTestFail is the kind of TestFail event
+	KindTestFail EventKind = "test_fail"
+	// KindError is the kind of PgError event
+	KindError EventKind = "error"
+	// KindCoverage is the kind of Coverage event
+	KindCoverage EventKind = "coverage"
+	// KindFileDone is the kind of FileDone event
+	KindFileDone EventKind = "file_done"
+	// KindHookDone is the kind of HookDone event
+	KindHookDone EventKind = "hook_done"
+	// KindSummary is the kind of Summary event
+	KindSummary EventKind = "summary"
+	// KindSettings is the kind of SessionSettings event
+	KindSettings EventKind = "settings"
+	// KindRetry is the kind of Retry event
+	KindRetry EventKind = "retry"
+	// KindPlan is the kind of Plan event
+	KindPlan EventKind = "plan"
+	// KindTargetStart is the kind of TargetStart event
+	KindTargetStart EventKind = "target_start"
+	// KindTargetDone is the kind of TargetDone event
+	KindTargetDone EventKind = "target_done"
+	// KindMultiReport is the kind of MultiReport event
+	KindMultiReport EventKind = "multi_report"
+	// KindDrift is the kind of Drift event
+	KindDrift EventKind = "drift"
+	// KindDiff is the kind of Diff event
+	KindDiff EventKind = "diff"
+	// KindWatch is the kind of WatchChange event
+	KindWatch EventKind = "watch"
+	// KindRunDone is the kind of RunDone event
+	KindRunDone EventKind = "run_done"
+	// KindStatementDone is the kind of StatementDone event
+	KindStatementDone EventKind = "statement_done"
+)
+
+// Event is implemented by all Migrator messages.
+type Event interface {
+	Kind() EventKind
+}
+
+// Envelope holds event with common event fields.
+type Envelope struct {
+	Time     time.Time `json:"time"`
+	Sequence int64     `json:"seq"`
+	Package  string    `json:"pkg,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Kind     EventKind `json:"kind"`
+	Event    Event     `json:"data"`
+}
+
+// EventSink receives Migrator events.
+// Events are sent synchronously, from one goroutine at a time.
+type EventSink interface {
+	Emit(e Envelope)
+	// Close is called when sink will not receive events anymore
+	Close() error
+}
+
+// SinkFunc is an EventSink made from function.
+type SinkFunc func(e Envelope)
+
+// Emit calls f(e)
+func (f SinkFunc) Emit(e Envelope) { f(e) }
+
+// Close does nothing
+func (f SinkFunc) Close() error { return nil }
+
+// PgError holds PG error event fields.
+type PgError struct {
+	*DBError
+}
+
+// AddSink registers sink which will receive all following events.
+func (mig *Migrator) AddSink(sink EventSink) {
+	mig.sinkLock.Lock()
+	defer mig.sinkLock.Unlock()
+	mig.sinks = append(mig.sinks, sink)
+}
+
+// CloseSinks closes all registered sinks and unregisters them.
+// It returns first error occured.
+func (mig *Migrator) CloseSinks() (err error) {
+	mig.sinkLock.Lock()
+	defer mig.sinkLock.Unlock()
+	for _, sink := range mig.sinks {
+		if e := sink.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	mig.sinks = nil
+	return
+}
+
+// emit wraps event into envelope and sends it to sinks and MessageChan
+func (mig *Migrator) emit(ev Event) {
+	mig.emitAt(ev, time.Now())
+}
+
+// emitAt sends event which happened at given time, e.g. collected by parallel worker
+func (mig *Migrator) emitAt(ev Event, at time.Time) {
+	ev = mig.redactEvent(ev)
+	mig.sinkLock.Lock()
+	defer mig.sinkLock.Unlock()
+	switch v := ev.(type) {
+	case *Op:
+		mig.curPkg = v.Pkg
+		mig.curFile = ""
+	case *RunFile:
+		mig.curFile = v.Name
+	}
+	mig.seq++
+	env := Envelope{
+		Time:     at,
+		Sequence: mig.seq,
+		Package:  mig.curPkg,
+		File:     mig.curFile,
+		Kind:     ev.Kind(),
+		Event:    ev,
+	}
+	for _, sink := range mig.sinks {
+		sink.Emit(env)
+	}
+	if mig.MessageChan == nil {
+		return
+	}
+	switch v := ev.(type) {
+	case *PgError:
+		// channel receivers got PG error itself before event API
+		mig.MessageChan <- v.DBError
+	case *Status, *Op, *Version, *NewVersion, *RunFile, *TestCount, *TestOk, *TestFail:
+		mig.MessageChan <- ev
+	}
+}
+
+// Kind returns event kind
+func (*Status) Kind() EventKind { return KindStatus }
+
+// Kind returns event kind
+func (*Op) Kind() EventKind { return KindOp }
+
+// Kind returns event kind
+func (*Version) Kind() EventKind { return KindVersion }
+
+// Kind returns event kind
+func (*NewVersion) Kind() EventKind { return KindNewVersion }
+
+// Kind returns event kind
+func (*RunFile) Kind() EventKind { return KindRunFile }
+
+// Kind returns event kind
+func (*TestCount) Kind() EventKind { return KindTestCount }
+
+// Kind returns event kind
+func (*TestOk) Kind() EventKind { return KindTestOk }
+
+// Kind returns event kind
+func (*TestFail) Kind() EventKind { return KindTestFail }
+
+// Kind returns event kind
+func (*PgError) Kind() EventKind { return KindError }
+
+// Kind returns event kind
+func (*Coverage) Kind() EventKind { return KindCoverage }
@@ -0,0 +1,88 @@
+package pgmig
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmit(t *testing.T) {
+	mig := New(logr.Discard(), Config{}, nil, "")
+	mig.MessageChan = make(chan interface{}, 10)
+	got := []Envelope{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		e.Time = e.Time.UTC().Truncate(0)
+		got = append(got, e)
+	}))
+	pgErr := &DBError{Message: "error"}
+	mig.emit(&Op{Pkg: "a", Op: CmdInit})
+	mig.emit(&RunFile{Name: "01.sql"})
+	mig.emit(&PgError{DBError: pgErr})
+	mig.emit(&Op{Pkg: "b", Op: CmdInit})
+	mig.emit(&Summary{})
+	assert.NoError(t, mig.CloseSinks())
+	mig.emit(&Status{})
+	close(mig.MessageChan)
+
+	type short struct {
+		Seq  int64
+		Pkg  string
+		File string
+		Kind EventKind
+	}
+	gotShort := []short{}
+	for _, e := range got {
+		assert.False(t, e.Time.IsZero())
+		gotShort = append(gotShort, short{e.Sequence, e.Package, e.File, e.Kind})
+	}
+	assert.Equal(t, []short{
+		{1, "a", "", KindOp},
+		{2, "a", "01.sql", KindRunFile},
+		{3, "a", "01.sql", KindError},
+		{4, "b", "", KindOp},
+		{5, "b", "", KindSummary},
+	}, gotShort)
+
+	chGot := []interface{}{}
+	for m := range mig.MessageChan {
+		chGot = append(chGot, m)
+	}
+	assert.Equal(t, []interface{}{
+		&Op{Pkg: "a", Op: CmdInit},
+		&RunFile{Name: "01.sql"},
+		pgErr,
+		&Op{Pkg: "b", Op: CmdInit},
+		&Status{},
+	}, chGot)
+}
+
+func TestEmitSinkOnly(t *testing.T) {
+	mig := New(logr.Discard(), Config{}, nil, "")
+	assert.Nil(t, mig.MessageChan)
+	count := 0
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		count++
+	}))
+	for i := 0; i < 500; i++ {
+		mig.emit(&RunFile{Name: "01.sql"})
+	}
+	assert.Equal(t, 500, count)
+}
+
+func TestProcessNoticeWithoutChan(t *testing.T) {
+	mig := New(logr.Discard(), Config{}, nil, "")
+	got := []Event{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Event)
+	}))
+	mig.ProcessNotice(pgStatusTestCount, "2", "")
+	mig.ProcessNotice(pgStatusTestOk, "first", "")
+	mig.ProcessNotice(pgStatusTestFail, "second", "detail")
+	assert.Equal(t, []Event{
+		&TestCount{Count: 2},
+		&TestOk{Current: 1, Message: "first"},
+		&TestFail{Current: 2, Message: "second", Detail: "detail"},
+	}, got)
+	assert.True(t, mig.noCommit())
+}
@@ -0,0 +1,54 @@
+// This file holds executor interface which hides database driver from Migrator.
+// Adapters for pgx v4, pgx v5 and database/sql are in pgxv4, pgxv5 and sqldb packages.
+// Driver errors must be returned as *DBError, so Migrator can show file line of error.
+
+package pgmig
+
+import (
+	"context"
+)
+
+// Executor runs SQL statements.
+type Executor interface {
+	// Exec runs statement(s), multiple statements are allowed if there are no args
+	Exec(ctx context.Context, sql string, args ...interface{}) error
+	// Query runs query and returns its rows
+	Query(ctx context.Context, sql string, args ...interface{}) (Rows, error)
+}
+
+// Rows holds query result.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close()
+}
+
+// TxExecutor runs statements in transaction.
+type TxExecutor interface {
+	Executor
+	Commit(ctx context.Context) error
+	// Rollback must return nil if transaction is already finished
+	Rollback(ctx context.Context) error
+}
+
+// TxStarter starts transactions.
+type TxStarter interface {
+	BeginTx(ctx context.Context) (TxExecutor, error)
+}
+
+// DB runs statements in and out of transactions, e.g. connection or pool.
+type DB interface {
+	Executor
+	TxStarter
+}
+
+// Conn is a database connection which is closed after run.
+type Conn interface {
+	DB
+	Close(ctx context.Context) error
+}
+
+// Connector connects to database given by dsn.
+// Notices of connection must be passed to mig.ProcessNotice.
+type Connector func(ctx context.Context, mig *Migrator, dsn string) (Conn, error)
@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/pgmig/gitinfo"
 )
 
 // FileSystem holds all of used filesystem access methods
@@ -24,6 +26,13 @@ type File interface {
 	Stat() (os.FileInfo, error)
 }
 
+// GitInfoFS is implemented by file systems which are not git work trees (e.g. archives).
+// Package git info is read from such file system only, it is not made by git.
+type GitInfoFS interface {
+	// GitInfo returns git info of package in dir, file holds gitinfo file name
+	GitInfo(dir, file string) (*gitinfo.GitInfo, error)
+}
+
 type defaultFS struct{}
 
 func (fs defaultFS) Walk(path string, wf filepath.WalkFunc) error {
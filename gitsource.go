@@ -0,0 +1,141 @@
+// This file holds git revision source.
+// Files of packages directory at given revision are read by `git archive`, so work tree is not changed.
+// Submodules are not included by `git archive`, so they are read from their initialized repositories.
+// Package git info is taken from revision, not from gitinfo.json.
+
+package pgmig
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pgmig/gitinfo"
+)
+
+// GitSourcePrefix marks git revision source, e.g. git:v1.4
+const GitSourcePrefix = "git:"
+
+// GitFS is a FileSystem which holds files of git revision in memory.
+type GitFS struct {
+	*ArchiveFS
+	info gitinfo.GitInfo
+}
+
+// OpenGit reads files of cfg.Root directory (current directory if empty) at git revision ref.
+// Repository is found by cfg.Root, cfg.GitBin is used to run git
+func OpenGit(cfg gitinfo.Config, ref string) (*GitFS, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, errors.New("Bad git revision " + ref)
+	}
+	dir := cfg.Root
+	if dir == "" {
+		dir = "."
+	}
+	bin := cfg.GitBin
+	if bin == "" {
+		bin = "git"
+	}
+	commit, err := gitOutput(bin, dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unknown git revision "+ref)
+	}
+	top, err := gitOutput(bin, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := gitOutput(bin, dir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+	fs := &GitFS{ArchiveFS: newArchiveFS(GitSourcePrefix + ref)}
+	if err = fs.readTree(bin, top, commit, prefix, ""); err != nil {
+		return nil, errors.Wrap(err, "Read "+fs.name)
+	}
+	if fs.info.Version, err = gitOutput(bin, dir, "describe", "--tags", "--always", commit); err != nil {
+		return nil, err
+	}
+	if fs.info.Repository, err = gitOutput(bin, dir, "config", "--get", "remote.origin.url"); err != nil {
+		// repo without remote
+		fs.info.Repository = "file://" + filepath.ToSlash(top)
+	}
+	ts, err := gitOutput(bin, dir, "show", "-s", "--format=format:%ct", commit)
+	if err != nil {
+		return nil, err
+	}
+	if err = gitinfo.MkTime([]byte(ts), &fs.info.Modified); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// readTree loads files of repo directory prefix at commit into dir, submodules are loaded recursively
+func (fs *GitFS) readTree(bin, repo, commit, prefix, dir string) error {
+	// archive is made in top dir because git limits it by current dir otherwise
+	data, err := gitRun(bin, repo, "archive", "--format=tar", commit+":"+prefix)
+	if err != nil {
+		return err
+	}
+	if err = fs.readTar(bytes.NewReader(data), dir); err != nil {
+		return err
+	}
+	tree, err := gitRun(bin, repo, "ls-tree", "-r", "-z", commit+":"+prefix)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(tree), "\x00") {
+		// line is "<mode> <type> <object>\t<path>", submodule has type commit
+		pos := strings.IndexByte(line, '\t')
+		if pos < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:pos])
+		if len(fields) != 3 || fields[1] != "commit" {
+			continue
+		}
+		name := line[pos+1:]
+		sub := filepath.Join(repo, filepath.FromSlash(prefix), filepath.FromSlash(name))
+		if _, err = os.Stat(filepath.Join(sub, ".git")); err != nil {
+			return errors.Errorf("Submodule %s is not initialized, run `git submodule update --init`", path.Join(dir, name))
+		}
+		if err = fs.readTree(bin, sub, fields[2], "", path.Join(dir, name)); err != nil {
+			return errors.Wrap(err, "Submodule "+path.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// GitInfo returns git info of revision for every package
+func (fs *GitFS) GitInfo(dir, file string) (*gitinfo.GitInfo, error) {
+	info := fs.info
+	return &info, nil
+}
+
+// Version returns git describe of revision
+func (fs *GitFS) Version() string { return fs.info.Version }
+
+// gitOutput runs git in dir and returns its output without trailing newline
+func gitOutput(bin, dir string, args ...string) (string, error) {
+	out, err := gitRun(bin, dir, args...)
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+// gitRun runs git in dir and returns its output, git error message is returned as error
+func gitRun(bin, dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(bin, append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return nil, errors.Wrap(err, "git "+args[0])
+	}
+	return out, nil
+}
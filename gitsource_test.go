@@ -0,0 +1,112 @@
+package pgmig
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pgmig/gitinfo"
+)
+
+// gitRepo creates repo with sql/app package in two commits, first is tagged v1.0
+func gitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"},
+			args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	write := func(name, data string) {
+		name = filepath.Join(dir, "sql", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(t, os.WriteFile(name, []byte(data), 0o644))
+	}
+	git("init", "-q")
+	write("app/01_schema.sql", "CREATE SCHEMA app;")
+	write("app/gitinfo.json", `{"version": "from file"}`)
+	git("add", ".")
+	git("commit", "-q", "-m", "v1.0")
+	git("tag", "v1.0")
+	write("app/01_schema.sql", "CREATE SCHEMA IF NOT EXISTS app;")
+	write("app/02_t.sql", "CREATE TABLE app.t();")
+	git("add", ".")
+	git("commit", "-q", "-m", "next")
+	return dir
+}
+
+func TestOpenGit(t *testing.T) {
+	dir := gitRepo(t)
+	cfg := gitinfo.Config{Root: filepath.Join(dir, "sql")}
+
+	fs, err := OpenGit(cfg, "v1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "git:v1.0", fs.Name())
+	assert.Equal(t, "v1.0", fs.Version())
+
+	mig := New(logr.Discard(), Config{InitIncludes: []string{"*.sql"}}, fs, "")
+	pkgs, err := mig.lookupFiles(CmdInit, mig.Config.InitIncludes, nil, nil, false, []string{"app"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, []fileDef{{Name: "01_schema.sql"}}, pkgs[0].Files)
+	data, err := mig.readFile(pkgs[0], pkgs[0].Files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE SCHEMA app;", string(data))
+
+	info, err := mig.gitInfo("app")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0", info.Version, "version must be taken from revision")
+	assert.Equal(t, "file://"+filepath.ToSlash(dir), info.Repository)
+	assert.False(t, info.Modified.IsZero())
+
+	fs, err = OpenGit(cfg, "HEAD")
+	require.NoError(t, err)
+	assert.Regexp(t, `^v1\.0-1-g[0-9a-f]+$`, fs.Version())
+	f, err := fs.Open("app/02_t.sql")
+	require.NoError(t, err)
+	f.Close()
+
+	_, err = OpenGit(cfg, "v9.9")
+	assert.Error(t, err)
+	_, err = OpenGit(cfg, "--output=x")
+	assert.EqualError(t, err, "Bad git revision --output=x")
+}
+
+func TestOpenGitSubmodule(t *testing.T) {
+	dir := gitRepo(t)
+	lib := t.TempDir()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com",
+			"-c", "protocol.file.allow=always"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git(lib, "init", "-q")
+	require.NoError(t, os.WriteFile(filepath.Join(lib, "01_lib.sql"), []byte("CREATE SCHEMA lib;"), 0o644))
+	git(lib, "add", ".")
+	git(lib, "commit", "-q", "-m", "lib")
+	git(dir, "submodule", "-q", "add", lib, "sql/lib")
+	git(dir, "commit", "-q", "-m", "add lib")
+	cfg := gitinfo.Config{Root: filepath.Join(dir, "sql")}
+
+	fs, err := OpenGit(cfg, "HEAD")
+	require.NoError(t, err)
+	f, err := fs.Open("lib/01_lib.sql")
+	require.NoError(t, err, "submodule files must be read")
+	f.Close()
+	f, err = fs.Open("app/02_t.sql")
+	require.NoError(t, err)
+	f.Close()
+
+	git(dir, "submodule", "-q", "deinit", "-f", "sql/lib")
+	_, err = OpenGit(cfg, "HEAD")
+	assert.EqualError(t, err, "Read git:HEAD: Submodule lib is not initialized, run `git submodule update --init`")
+}
@@ -0,0 +1,340 @@
+// This file holds run history support.
+// Migrator collects run data while running and saves it in history tables afterwards.
+// History tables are created by Migrator in HistorySchema, which differs from CorePackage schema,
+// so history survives core package reinit.
+
+package pgmig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdHistory holds name of history command
+	CmdHistory = "history"
+
+	// OutcomeCommit means run changes were committed
+	OutcomeCommit = "commit"
+	// OutcomeRollback means run changes were rolled back without errors
+	OutcomeRollback = "rollback"
+	// OutcomeError means run was finished with error
+	OutcomeError = "error"
+	// OutcomePrepared means run transaction was prepared for two-phase commit
+	OutcomePrepared = "prepared"
+
+	// HistorySchema holds schema of run history tables
+	HistorySchema = "pgmig_history"
+	// HistoryTable holds name of run history table
+	HistoryTable = "run"
+
+	// SQLHistorySetup creates history tables if they do not exist
+	SQLHistorySetup = `CREATE SCHEMA IF NOT EXISTS %[1]s;
+CREATE TABLE IF NOT EXISTS %[1]s.run (
+  id          BIGSERIAL PRIMARY KEY
+, command     TEXT NOT NULL
+, packages    TEXT[] NOT NULL
+, db_user     TEXT NOT NULL DEFAULT session_user
+, os_user     TEXT
+, client_host TEXT
+, client_addr INET DEFAULT inet_client_addr()
+, app_version TEXT
+, sources     JSONB
+, gid         TEXT
+, started_at  TIMESTAMPTZ NOT NULL
+, finished_at TIMESTAMPTZ NOT NULL
+, outcome     TEXT NOT NULL
+, error       TEXT
+);
+ALTER TABLE %[1]s.run ADD COLUMN IF NOT EXISTS gid TEXT;
+CREATE TABLE IF NOT EXISTS %[1]s.run_file (
+  run_id      BIGINT REFERENCES %[1]s.run(id) ON DELETE CASCADE
+, seq         INTEGER
+, pkg         TEXT NOT NULL
+, op          TEXT NOT NULL
+, file        TEXT NOT NULL
+, md5         TEXT NOT NULL
+, started_at  TIMESTAMPTZ NOT NULL
+, duration    INTERVAL NOT NULL
+, CONSTRAINT run_file_pkey PRIMARY KEY (run_id, seq)
+);`
+
+	// SQLHistoryRun saves run record
+	SQLHistoryRun = `INSERT INTO %s.run (command, packages, os_user, client_host, app_version, sources, gid
+, started_at, finished_at, outcome, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+	// SQLHistoryFile saves run file record
+	SQLHistoryFile = `INSERT INTO %s.run_file (run_id, seq, pkg, op, file, md5, started_at, duration)
+ VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	// SQLHistoryRuns fetches run records
+	SQLHistoryRuns = `SELECT id, command, packages, db_user, coalesce(os_user, ''), coalesce(client_host, '')
+, coalesce(host(client_addr), ''), coalesce(app_version, ''), coalesce(sources, '{}'), coalesce(gid, ''), started_at, finished_at
+, outcome, coalesce(error, '')
+  FROM %s.run
+ WHERE ($1::text[] IS NULL OR packages && $1::text[])
+   AND ($2::timestamptz IS NULL OR started_at >= $2)
+   AND ($3::timestamptz IS NULL OR started_at < $3)
+   AND ($4::text = '' OR db_user = $4 OR os_user = $4)
+   AND ($5::text = '' OR command = $5)
+   AND ($6::text = '' OR outcome = $6)
+ ORDER BY id DESC
+ LIMIT $7`
+	// SQLHistoryFiles fetches file records of run
+	SQLHistoryFiles = `SELECT pkg, op, file, md5, started_at, extract(epoch FROM duration)
+  FROM %s.run_file WHERE run_id = $1 ORDER BY seq`
+)
+
+// SourceInfo holds package source version.
+type SourceInfo struct {
+	Version string `json:"version"`
+	Repo    string `json:"repo"`
+}
+
+// FileRecord holds executed file history data.
+type FileRecord struct {
+	Pkg      string
+	Op       string
+	File     string
+	MD5      string
+	Started  time.Time
+	Duration time.Duration
+}
+
+// RunRecord holds run history data.
+type RunRecord struct {
+	ID         int64
+	Command    string
+	Packages   []string
+	DBUser     string
+	OSUser     string
+	ClientHost string
+	ClientAddr string
+	AppVersion string
+	Sources    map[string]SourceInfo
+	GID        string // prepared transaction id
+	Started    time.Time
+	Finished   time.Time
+	Outcome    string
+	Error      string
+	Files      []FileRecord
+}
+
+// HistoryFilter holds history command filters.
+type HistoryFilter struct {
+	Since   string `long:"since" description:"Show runs started at or after this time (RFC3339 or YYYY-MM-DD)"`
+	Until   string `long:"until" description:"Show runs started before this time (RFC3339 or YYYY-MM-DD)"`
+	User    string `long:"user" description:"Show runs of this DB or OS user"`
+	Command string `long:"command" description:"Show runs of this command"`
+	Outcome string `long:"outcome" description:"Show runs with this outcome (commit|rollback|error|prepared)"`
+	Limit   int    `long:"limit" default:"20" description:"Max runs count"`
+	Files   bool   `long:"files" description:"Show executed files"`
+}
+
+// startHistory creates new run record
+func (mig *Migrator) startHistory(command string, packages []string) {
+	rec := &RunRecord{
+		Command:    command,
+		Packages:   append([]string{}, packages...),
+		AppVersion: mig.Version,
+		Sources:    map[string]SourceInfo{},
+		Started:    time.Now(),
+	}
+	if u, err := user.Current(); err == nil {
+		rec.OSUser = u.Username
+	}
+	if h, err := os.Hostname(); err == nil {
+		rec.ClientHost = h
+	}
+	mig.history = rec
+}
+
+// addHistorySource saves package source version in run record
+func (mig *Migrator) addHistorySource(pkg, version, repo string) {
+	if mig.history != nil {
+		mig.history.Sources[pkg] = SourceInfo{Version: version, Repo: repo}
+	}
+}
+
+// addHistoryFile saves executed file data in run record
+func (mig *Migrator) addHistoryFile(rec FileRecord) {
+	if mig.history != nil {
+		mig.history.Files = append(mig.history.Files, rec)
+	}
+}
+
+// setHistoryGID saves prepared transaction id in run record
+func (mig *Migrator) setHistoryGID(gid string) {
+	if mig.history != nil {
+		mig.history.GID = gid
+	}
+}
+
+// setHistoryOutcome saves run result in run record
+func (mig *Migrator) setHistoryOutcome(outcome string, err error) {
+	if mig.history == nil {
+		return
+	}
+	mig.history.Outcome = outcome
+	if err != nil {
+		mig.history.Error = err.Error()
+	}
+}
+
+// SaveHistory saves data of last Run or FinishPrepared in history tables.
+// It must be called after run transaction is finished, so history is saved even if run was rolled back.
+// runErr is the error of run commit if any.
+// History tables are created if they do not exist.
+func (mig *Migrator) SaveHistory(ctx context.Context, db TxStarter, runErr error) error {
+	rec := mig.history
+	if rec == nil {
+		return nil
+	}
+	mig.history = nil
+	if rec.Outcome == "" {
+		rec.Outcome = OutcomeRollback
+	}
+	if runErr != nil {
+		rec.Outcome = OutcomeError
+		rec.Error = runErr.Error()
+	}
+	rec.Finished = time.Now()
+
+	schema := quoteIdent(HistorySchema)
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if er := tx.Rollback(ctx); er != nil {
+			mig.Log.Error(er, "History rollback error")
+		}
+	}()
+	if err = tx.Exec(ctx, fmt.Sprintf(SQLHistorySetup, schema)); err != nil {
+		return errors.Wrap(err, "SQLHistorySetup")
+	}
+	sources, err := json.Marshal(rec.Sources)
+	if err != nil {
+		return err
+	}
+	var errText, gid *string
+	if rec.Error != "" {
+		errText = &rec.Error
+	}
+	if rec.GID != "" {
+		gid = &rec.GID
+	}
+	err = queryValue(tx, &rec.ID, fmt.Sprintf(SQLHistoryRun, schema), rec.Command, rec.Packages, rec.OSUser, rec.ClientHost,
+		rec.AppVersion, string(sources), gid, rec.Started, rec.Finished, rec.Outcome, errText)
+	if err != nil {
+		return errors.Wrap(err, "SQLHistoryRun")
+	}
+	for i, f := range rec.Files {
+		err = tx.Exec(ctx, fmt.Sprintf(SQLHistoryFile, schema), rec.ID, i+1, f.Pkg, f.Op, f.File, f.MD5, f.Started, f.Duration)
+		if err != nil {
+			return errors.Wrap(err, "SQLHistoryFile")
+		}
+	}
+	mig.Log.V(1).Info("Run history saved", "id", rec.ID)
+	return tx.Commit(ctx)
+}
+
+// QueryHistory returns run history records filtered by packages and filter.
+func (mig *Migrator) QueryHistory(ctx context.Context, conn Executor, packages []string, filter HistoryFilter) ([]RunRecord, error) {
+	schema := quoteIdent(HistorySchema)
+	var exists bool
+	if err := queryValue(conn, &exists, SQLPgMigExists, HistorySchema, HistoryTable); err != nil {
+		return nil, errors.Wrap(err, "Check history")
+	}
+	if !exists {
+		return nil, nil
+	}
+	since, err := parseTime(filter.Since)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse since")
+	}
+	until, err := parseTime(filter.Until)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse until")
+	}
+	var pkgs []string
+	if len(packages) > 0 {
+		pkgs = packages
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	rows, err := conn.Query(ctx, fmt.Sprintf(SQLHistoryRuns, schema), pkgs, since, until, filter.User,
+		filter.Command, filter.Outcome, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLHistoryRuns")
+	}
+	var rv []RunRecord
+	for rows.Next() {
+		rec := RunRecord{}
+		var sources []byte
+		err = rows.Scan(&rec.ID, &rec.Command, &rec.Packages, &rec.DBUser, &rec.OSUser, &rec.ClientHost, &rec.ClientAddr,
+			&rec.AppVersion, &sources, &rec.GID, &rec.Started, &rec.Finished, &rec.Outcome, &rec.Error)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "Incompartible value returned")
+		}
+		if err = json.Unmarshal(sources, &rec.Sources); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "Parse sources")
+		}
+		rv = append(rv, rec)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !filter.Files {
+		return rv, nil
+	}
+	for i := range rv {
+		if rv[i].Files, err = queryHistoryFiles(ctx, conn, schema, rv[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+func queryHistoryFiles(ctx context.Context, conn Executor, schema string, id int64) ([]FileRecord, error) {
+	rows, err := conn.Query(ctx, fmt.Sprintf(SQLHistoryFiles, schema), id)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLHistoryFiles")
+	}
+	defer rows.Close()
+	var rv []FileRecord
+	for rows.Next() {
+		f := FileRecord{}
+		var seconds float64
+		if err = rows.Scan(&f.Pkg, &f.Op, &f.File, &f.MD5, &f.Started, &seconds); err != nil {
+			return nil, errors.Wrap(err, "Incompartible value returned")
+		}
+		f.Duration = time.Duration(seconds * float64(time.Second))
+		rv = append(rv, f)
+	}
+	return rv, rows.Err()
+}
+
+// parseTime parses RFC3339 time or date, empty string means no time
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,108 @@
+package pgmig
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pgmig/gitinfo"
+)
+
+func (ss *ServerSuite) TestRunHistory() {
+	ctx := context.Background()
+	ctrl := gomock.NewController(ss.T())
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+
+	rv := NewMockRows(ctrl)
+	rv.EXPECT().Next().Return(false).AnyTimes()
+	rv.EXPECT().Close().AnyTimes()
+
+	mig := New(ss.srv.Log, ss.cfg, defaultFS{}, "testdata")
+	mig.Version = "v1.0"
+	gi := gitinfo.GitInfo{}
+	helperLoadJSON(ss.T(), "a/gitinfo", &gi)
+
+	ex := tx.EXPECT()
+	ex.Query(ctx, gomock.Any(), gomock.Any()).Return(rv, nil).AnyTimes()
+	ex.Exec(ctx, gomock.Any(), gomock.Any()).Return(pgconn.CommandTag{}, nil).AnyTimes()
+	commit, err := mig.RunExec(wrapTx(tx), CmdInit, []string{"a"})
+	require.NoError(ss.T(), err)
+	assert.True(ss.T(), *commit)
+
+	rec := mig.history
+	require.NotNil(ss.T(), rec)
+	assert.Equal(ss.T(), CmdInit, rec.Command)
+	assert.Equal(ss.T(), []string{"a"}, rec.Packages)
+	assert.Equal(ss.T(), "v1.0", rec.AppVersion)
+	assert.Equal(ss.T(), OutcomeCommit, rec.Outcome)
+	assert.Equal(ss.T(), map[string]SourceInfo{"a": {Version: gi.Version, Repo: gi.Repository}}, rec.Sources)
+	files := []string{}
+	for _, f := range rec.Files {
+		assert.Equal(ss.T(), "a", f.Pkg)
+		assert.Equal(ss.T(), CmdInit, f.Op)
+		assert.Equal(ss.T(), fmt.Sprintf("%x", md5.Sum(content(ss.T(), mig, "a/"+f.File))), f.MD5)
+		assert.False(ss.T(), f.Started.IsZero())
+		files = append(files, f.File)
+	}
+	assert.Equal(ss.T(), []string{"00_init.sql", "01_ddl.sql", "02_ddl.test.sql", "03.once.sql", "04.new.sql"}, files)
+}
+
+func TestSaveHistorySetup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	rows := NewMockRows(ctrl)
+	rows.EXPECT().Next().Return(true)
+	rows.EXPECT().Scan(gomock.Any()).Return(nil)
+	rows.EXPECT().Close()
+	tx := NewMockTx(ctrl)
+	schema := quoteIdent(HistorySchema)
+	gomock.InOrder(
+		tx.EXPECT().Exec(ctx, fmt.Sprintf(SQLHistorySetup, schema)).Return(pgconn.CommandTag{}, nil),
+		tx.EXPECT().Query(gomock.Any(), fmt.Sprintf(SQLHistoryRun, schema), gomock.Any()).Return(rows, nil),
+		tx.EXPECT().Commit(ctx).Return(nil),
+		tx.EXPECT().Rollback(ctx).Return(nil),
+	)
+
+	mig := New(logr.Discard(), Config{}, nil, "")
+	mig.startHistory(CmdInit, []string{"a"})
+	db := txBeginner{tx}
+	assert.NoError(t, mig.SaveHistory(ctx, &db, nil))
+	assert.Nil(t, mig.history)
+}
+
+func TestParseTime(t *testing.T) {
+	got, err := parseTime("")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	got, err = parseTime("2020-01-02T03:04:05Z")
+	require.NoError(t, err)
+	assert.True(t, got.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	got, err = parseTime("2020-01-02")
+	require.NoError(t, err)
+	assert.True(t, got.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)))
+
+	_, err = parseTime("yesterday")
+	assert.Error(t, err)
+}
+
+func TestSetHistoryOutcome(t *testing.T) {
+	mig := &Migrator{Config: &Config{}}
+	mig.setHistoryOutcome(OutcomeError, fmt.Errorf("skipped"))
+	assert.Nil(t, mig.history)
+	mig.startHistory(CmdTest, []string{"a"})
+	mig.setHistoryOutcome(OutcomeError, fmt.Errorf("failed"))
+	assert.Equal(t, OutcomeError, mig.history.Outcome)
+	assert.Equal(t, "failed", mig.history.Error)
+}
@@ -0,0 +1,282 @@
+// This file holds SQL migration linter.
+// Linter checks init and test files of packages statement by statement, database is not used.
+// Test files are never committed, so only rules about breaking transaction are checked for them.
+
+package pgmig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// CmdLint holds name of lint command
+	CmdLint = "lint"
+
+	// LintError is the level of issues which break run
+	LintError = "error"
+	// LintWarning is the level of issues which may cause problems
+	LintWarning = "warning"
+)
+
+// LintIssue holds linter finding.
+type LintIssue struct {
+	Pkg     string
+	File    string
+	Path    string
+	Line    int
+	Rule    string
+	Level   string
+	Message string
+}
+
+// LintReport holds lint command result.
+type LintReport struct {
+	Issues []LintIssue
+}
+
+// LintRule describes linter check.
+type LintRule struct {
+	Name        string
+	Level       string
+	Description string
+	Tests       bool // rule is checked in test files too
+	check       func(lf *lintFile, st string) string
+}
+
+// lintFile holds linted file attributes
+type lintFile struct {
+	def     fileDef
+	created map[string]bool // tables created by previous statements
+}
+
+var (
+	reVolatileDefault = regexp.MustCompile(`(?i)^ALTER TABLE .*\bADD (COLUMN )?.*\bDEFAULT .*\b(random|clock_timestamp|timeofday|gen_random_uuid|uuid_generate_v\w*|nextval) ?\(`)
+	reCreateIndex     = regexp.MustCompile(`(?i)^CREATE (UNIQUE )?INDEX (CONCURRENTLY )?.*?\bON (ONLY )?` + reName)
+	reConcurrently    = regexp.MustCompile(`(?i)^(CREATE (UNIQUE )?INDEX|DROP INDEX|REINDEX (\(.*?\) )?\w+|ALTER TABLE .*\bDETACH PARTITION \S+) CONCURRENTLY\b`)
+	reCreateTable     = regexp.MustCompile(`(?i)^CREATE (UNLOGGED |TEMP |TEMPORARY )?TABLE (IF NOT EXISTS )?` + reName)
+	reDrop            = regexp.MustCompile(`(?i)^DROP \w+`)
+	reIfExists        = regexp.MustCompile(`(?i)^DROP (MATERIALIZED VIEW|FOREIGN TABLE|\w+) (CONCURRENTLY )?IF EXISTS\b`)
+	reCreateReplace   = regexp.MustCompile(`(?i)^CREATE (FUNCTION|PROCEDURE|VIEW|TRIGGER|RULE)\b`)
+	reCreateExists    = regexp.MustCompile(`(?i)^CREATE (UNLOGGED )?(TABLE|SCHEMA|SEQUENCE|EXTENSION|(UNIQUE )?INDEX( CONCURRENTLY)?)\b( IF NOT EXISTS)?`)
+	reSet             = regexp.MustCompile(`(?i)^SET (SESSION )?(\w+)`)
+	reTxControl       = regexp.MustCompile(`(?i)^(BEGIN|START TRANSACTION|COMMIT|END|ABORT|ROLLBACK|PREPARE TRANSACTION)\b`)
+	reRollbackTo      = regexp.MustCompile(`(?i)^ROLLBACK (WORK |TRANSACTION )?TO\b`)
+)
+
+// LintRules holds all linter rules.
+var LintRules = []LintRule{
+	{"volatile-default", LintWarning, "ADD COLUMN with volatile DEFAULT rewrites table", false,
+		func(lf *lintFile, st string) string {
+			if reVolatileDefault.MatchString(st) {
+				return "ADD COLUMN with volatile DEFAULT rewrites table under ACCESS EXCLUSIVE lock"
+			}
+			return ""
+		}},
+	{"concurrently", LintError, "CONCURRENTLY can not run inside transaction", true,
+		func(lf *lintFile, st string) string {
+			m := reConcurrently.FindStringSubmatch(st)
+			if m == nil {
+				return ""
+			}
+			op := strings.ToUpper(strings.Fields(m[1])[0])
+			switch op {
+			case "CREATE", "DROP":
+				op += " INDEX"
+			case "ALTER":
+				op = "DETACH PARTITION"
+			}
+			return op + " CONCURRENTLY can not run inside pgmig transaction"
+		}},
+	{"index-lock", LintWarning, "CREATE INDEX on existing table blocks writes until transaction end", false,
+		func(lf *lintFile, st string) string {
+			if m := reCreateTable.FindStringSubmatch(st); m != nil {
+				lf.created[strings.ToLower(m[reCreateTable.SubexpIndex("t")])] = true
+				return ""
+			}
+			m := reCreateIndex.FindStringSubmatch(st)
+			if m == nil || m[2] != "" || lf.def.IfNewPkg {
+				return ""
+			}
+			table := m[reCreateIndex.SubexpIndex("t")]
+			if lf.created[strings.ToLower(table)] {
+				return ""
+			}
+			return "CREATE INDEX blocks writes to " + table + " until pgmig transaction end"
+		}},
+	{"drop-in-once", LintWarning, "DROP in file which is run once", false,
+		func(lf *lintFile, st string) string {
+			if lf.def.IfNewFile && reDrop.MatchString(st) {
+				return "DROP in file which is run once can not be repeated"
+			}
+			return ""
+		}},
+	{"idempotent", LintWarning, "CREATE or DROP without IF [NOT] EXISTS or OR REPLACE in file run on every init", false,
+		func(lf *lintFile, st string) string {
+			if lf.def.IfNewPkg || lf.def.IfNewFile {
+				return ""
+			}
+			if reDrop.MatchString(st) && !reIfExists.MatchString(st) {
+				return "DROP without IF EXISTS fails on repeated run"
+			}
+			if m := reCreateReplace.FindStringSubmatch(st); m != nil {
+				return "CREATE " + strings.ToUpper(m[1]) + " without OR REPLACE fails on repeated run"
+			}
+			if m := reCreateExists.FindStringSubmatch(st); m != nil && m[5] == "" {
+				return "CREATE " + strings.ToUpper(m[2]) + " without IF NOT EXISTS fails on repeated run"
+			}
+			return ""
+		}},
+	{"set-local", LintWarning, "SET without LOCAL changes session after commit", false,
+		func(lf *lintFile, st string) string {
+			m := reSet.FindStringSubmatch(st)
+			if m == nil {
+				return ""
+			}
+			switch strings.ToUpper(m[2]) {
+			case "LOCAL", "CONSTRAINTS", "TRANSACTION":
+				return ""
+			}
+			return "SET without LOCAL keeps value after pgmig transaction"
+		}},
+	{"transaction-control", LintError, "Transaction control statement breaks pgmig transaction", true,
+		func(lf *lintFile, st string) string {
+			if reTxControl.MatchString(st) && !reRollbackTo.MatchString(st) {
+				return strings.ToUpper(reTxControl.FindString(st)) + " breaks pgmig transaction"
+			}
+			return ""
+		}},
+}
+
+// Lint checks init and test files of packages.
+func (mig *Migrator) Lint(packages []string) (*LintReport, error) {
+	pkgs, err := mig.commandFiles(CmdInit, packages)
+	if err != nil {
+		return nil, err
+	}
+	tests, err := mig.commandFiles(CmdTest, packages)
+	if err != nil {
+		return nil, err
+	}
+	disabled := map[string]bool{}
+	for _, r := range mig.Config.LintDisable {
+		disabled[r] = true
+	}
+	rv := &LintReport{}
+	created := map[string]bool{}
+	seen := map[string]bool{}
+	for i, pkg := range append(pkgs, tests...) {
+		isTest := i >= len(pkgs)
+		for _, file := range pkg.Files {
+			path := filepath.ToSlash(filepath.Join(pkg.Root, file.Name))
+			if seen[path] {
+				// test file matches init masks too
+				continue
+			}
+			seen[path] = true
+			s, err := mig.readFile(pkg, file)
+			if err != nil {
+				return nil, err
+			}
+			lf := &lintFile{def: file, created: created}
+			for _, st := range splitStatements(string(s)) {
+				text := strings.Join(strings.Fields(st.Text), " ")
+				for _, r := range LintRules {
+					if disabled[r.Name] || isTest && !r.Tests {
+						continue
+					}
+					if msg := r.check(lf, text); msg != "" {
+						rv.Issues = append(rv.Issues, LintIssue{Pkg: pkg.Name, File: file.Name, Path: path,
+							Line: st.Line, Rule: r.Name, Level: r.Level, Message: msg})
+					}
+				}
+			}
+		}
+	}
+	return rv, nil
+}
+
+// WriteText writes issues as file:line lines
+func (r LintReport) WriteText(w io.Writer) error {
+	for _, i := range r.Issues {
+		if _, err := fmt.Fprintf(w, "%s:%d: %s: %s (%s)\n", i.Path, i.Line, i.Level, i.Message, i.Rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes report as JSON
+func (r LintReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type sarifText struct {
+	Text string `json:"text"`
+}
+
+type sarifRule struct {
+	ID               string    `json:"id"`
+	ShortDescription sarifText `json:"shortDescription"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine int `json:"startLine"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifText       `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string      `json:"name"`
+			InformationURI string      `json:"informationUri"`
+			Rules          []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifReport struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+// WriteSARIF writes report in SARIF 2.1.0 format
+func (r LintReport) WriteSARIF(w io.Writer) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "pgmig"
+	run.Tool.Driver.InformationURI = "https://github.com/pgmig/pgmig"
+	for _, rule := range LintRules {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: rule.Name, ShortDescription: sarifText{rule.Description}})
+	}
+	for _, i := range r.Issues {
+		loc := sarifLocation{}
+		loc.PhysicalLocation.ArtifactLocation.URI = i.Path
+		loc.PhysicalLocation.Region.StartLine = i.Line
+		run.Results = append(run.Results, sarifResult{RuleID: i.Rule, Level: i.Level, Message: sarifText{i.Message},
+			Locations: []sarifLocation{loc}})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifReport{Schema: "https://json.schemastore.org/sarif-2.1.0.json", Version: "2.1.0", Runs: []sarifRun{run}})
+}
@@ -0,0 +1,54 @@
+package pgmig
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	cfg := Config{InitIncludes: []string{"0*.sql"}, OnceIncludes: []string{"*.once.sql"}, TestIncludes: []string{"*.test.sql"}}
+	mig := New(logr.Discard(), cfg, nil, "testdata")
+	rep, err := mig.Lint([]string{"lint"})
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.NoError(t, rep.WriteText(buf))
+	want := `testdata/lint/01_ddl.sql:5: warning: CREATE FUNCTION without OR REPLACE fails on repeated run (idempotent)
+testdata/lint/01_ddl.sql:8: warning: CREATE INDEX blocks writes to old until pgmig transaction end (index-lock)
+testdata/lint/01_ddl.sql:9: warning: DROP without IF EXISTS fails on repeated run (idempotent)
+testdata/lint/01_ddl.sql:10: warning: SET without LOCAL keeps value after pgmig transaction (set-local)
+testdata/lint/01_ddl.sql:12: error: COMMIT breaks pgmig transaction (transaction-control)
+testdata/lint/01_ddl.sql:13: error: DROP INDEX CONCURRENTLY can not run inside pgmig transaction (concurrently)
+testdata/lint/02.once.sql:1: warning: ADD COLUMN with volatile DEFAULT rewrites table under ACCESS EXCLUSIVE lock (volatile-default)
+testdata/lint/02.once.sql:2: warning: DROP in file which is run once can not be repeated (drop-in-once)
+testdata/lint/10_lint.test.sql:3: error: CREATE INDEX CONCURRENTLY can not run inside pgmig transaction (concurrently)
+testdata/lint/10_lint.test.sql:4: error: ROLLBACK breaks pgmig transaction (transaction-control)
+`
+	assert.Equal(t, want, buf.String())
+
+	mig.Config.LintDisable = []string{"idempotent", "drop-in-once"}
+	rep, err = mig.Lint([]string{"lint"})
+	require.NoError(t, err)
+	assert.Len(t, rep.Issues, 7)
+}
+
+func TestLintWriteSARIF(t *testing.T) {
+	rep := LintReport{Issues: []LintIssue{{Pkg: "a", File: "01.sql", Path: "a/01.sql", Line: 3,
+		Rule: "set-local", Level: LintWarning, Message: "msg"}}}
+	buf := &bytes.Buffer{}
+	require.NoError(t, rep.WriteSARIF(buf))
+	var got sarifReport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "2.1.0", got.Version)
+	require.Len(t, got.Runs, 1)
+	assert.Len(t, got.Runs[0].Tool.Driver.Rules, len(LintRules))
+	require.Len(t, got.Runs[0].Results, 1)
+	res := got.Runs[0].Results[0]
+	assert.Equal(t, "set-local", res.RuleID)
+	assert.Equal(t, "a/01.sql", res.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, 3, res.Locations[0].PhysicalLocation.Region.StartLine)
+}
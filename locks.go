@@ -0,0 +1,403 @@
+// This file holds plan command and DDL lock impact analysis.
+// Statements are classified by regexps, so only top level statements of common forms are recognized
+// (DDL inside DO blocks and functions is not analyzed).
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdPlan holds name of plan command
+	CmdPlan = "plan"
+
+	// LockAccessExclusive blocks all access to table
+	LockAccessExclusive = "ACCESS EXCLUSIVE"
+	// LockExclusive allows only reads
+	LockExclusive = "EXCLUSIVE"
+	// LockShareRowExclusive blocks writes and concurrent schema changes
+	LockShareRowExclusive = "SHARE ROW EXCLUSIVE"
+	// LockShare blocks writes
+	LockShare = "SHARE"
+	// LockShareUpdateExclusive blocks concurrent schema changes and vacuum only
+	LockShareUpdateExclusive = "SHARE UPDATE EXCLUSIVE"
+
+	// SQLTableStats fetches size and activity counter of relations.
+	// Counter holds scans and modified rows since stats reset, so activity is measured by two samples
+	SQLTableStats = `SELECT t.name, pg_total_relation_size(c.oid), coalesce(s.n_live_tup, 0)
+, coalesce(s.seq_scan + coalesce(s.idx_scan, 0) + s.n_tup_ins + s.n_tup_upd + s.n_tup_del, 0)
+FROM unnest($1::text[]) AS t(name)
+JOIN pg_class c ON c.oid = to_regclass(t.name)
+LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid`
+	// SQLStatClearSnapshot drops stats cached by transaction, so next sample gets fresh values
+	SQLStatClearSnapshot = "SELECT pg_stat_clear_snapshot()"
+)
+
+// lockLevels holds lock modes from weakest to strongest
+var lockLevels = []string{LockShareUpdateExclusive, LockShare, LockShareRowExclusive, LockExclusive, LockAccessExclusive}
+
+// Plan holds plan command result.
+type Plan struct {
+	Command string
+	Files   []PlanFile
+	// Warnings holds count of dangerous statements
+	Warnings int
+}
+
+// PlanFile holds file which will be run.
+type PlanFile struct {
+	Pkg       string
+	Op        string
+	File      string
+	IfNewPkg  bool            `json:",omitempty"`
+	IfNewFile bool            `json:",omitempty"`
+	Locks     []StatementLock `json:",omitempty"`
+	root      string
+}
+
+// StatementLock holds lock taken by file statement.
+type StatementLock struct {
+	Line      int
+	Statement string
+	Table     string
+	Lock      string
+	Rewrite   bool        `json:",omitempty"`
+	Note      string      `json:",omitempty"`
+	Stats     *TableStats `json:",omitempty"`
+	Warning   string      `json:",omitempty"`
+	// Assumed is true if statement action is not known and ACCESS EXCLUSIVE lock is assumed
+	Assumed bool `json:",omitempty"`
+}
+
+// TableStats holds table size and activity.
+type TableStats struct {
+	Size int64
+	Rows int64
+	// Rate holds scans and modified rows per second measured within Config.LockSample
+	Rate float64
+
+	activity int64 // scans and modified rows since stats reset
+}
+
+// Kind returns event kind
+func (*Plan) Kind() EventKind { return KindPlan }
+
+// Plan returns files which will be run by command and sends them as Plan event.
+// If tx is not nil, file statements locks are analyzed.
+func (mig *Migrator) Plan(tx Executor, command string, packages []string) (*Plan, error) {
+	pkgs, err := mig.commandFiles(command, packages)
+	if err != nil {
+		return nil, err
+	}
+	rv := &Plan{Command: command}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			rv.Files = append(rv.Files, PlanFile{Pkg: pkg.Name, Op: pkg.Op, File: f.Name,
+				IfNewPkg: f.IfNewPkg, IfNewFile: f.IfNewFile, root: pkg.Root})
+		}
+	}
+	if tx != nil {
+		if err = mig.analyzeLocks(tx, rv); err != nil {
+			return nil, err
+		}
+	}
+	mig.emit(rv)
+	return rv, nil
+}
+
+// analyzeLocks classifies DDL statements of plan files by lock taken
+// and warns about strong locks on big or hot tables
+func (mig *Migrator) analyzeLocks(tx Executor, plan *Plan) error {
+	var tables []string
+	seen := map[string]bool{}
+	for i := range plan.Files {
+		pf := &plan.Files[i]
+		s, err := mig.readFile(pkgDef{Name: pf.Pkg, Root: pf.root}, fileDef{Name: pf.File})
+		if err != nil {
+			return err
+		}
+		for _, st := range splitStatements(string(s)) {
+			lock := classifyStatement(st.Text)
+			if lock == nil {
+				continue
+			}
+			lock.Line = st.Line
+			pf.Locks = append(pf.Locks, *lock)
+			if !seen[lock.Table] {
+				seen[lock.Table] = true
+				tables = append(tables, lock.Table)
+			}
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	stats, err := mig.sampleTableStats(tx, tables)
+	if err != nil {
+		return err
+	}
+	plan.Warnings = mig.warnLocks(plan, stats)
+	return nil
+}
+
+// warnLocks sets stats and warnings of plan statements and returns warnings count
+func (mig *Migrator) warnLocks(plan *Plan, stats map[string]TableStats) (cnt int) {
+	for i := range plan.Files {
+		for j := range plan.Files[i].Locks {
+			lock := &plan.Files[i].Locks[j]
+			st, ok := stats[lock.Table]
+			if !ok {
+				// table is not created yet
+				continue
+			}
+			lock.Stats = &st
+			var why []string
+			if mig.Config.LockBigTable > 0 && st.Size >= mig.Config.LockBigTable {
+				why = append(why, "big")
+			}
+			rate := ""
+			if mig.Config.LockHotTable > 0 && st.Rate >= float64(mig.Config.LockHotTable) {
+				why = append(why, "hot")
+				rate = fmt.Sprintf(", %.0f ops/s", st.Rate)
+			}
+			if len(why) == 0 || lockLevel(lock.Lock) <= lockLevel(LockShareUpdateExclusive) {
+				continue
+			}
+			lock.Warning = fmt.Sprintf("%s lock on %s table (%s, %d rows%s)", lock.Lock, strings.Join(why, " and "),
+				humanSize(st.Size), st.Rows, rate)
+			if lock.Note != "" {
+				lock.Warning += ": " + lock.Note
+			}
+			cnt++
+		}
+	}
+	return
+}
+
+// sampleTableStats fetches stats of existing tables.
+// If hot tables are checked, activity counters are fetched again after Config.LockSample
+// and their difference gives recent activity rate
+func (mig *Migrator) sampleTableStats(tx Executor, tables []string) (map[string]TableStats, error) {
+	rv, err := queryTableStats(tx, tables)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLTableStats")
+	}
+	interval := mig.Config.LockSample
+	if mig.Config.LockHotTable <= 0 || interval <= 0 || len(rv) == 0 {
+		return rv, nil
+	}
+	mig.Log.V(1).Info("Sample table activity", "interval", interval)
+	time.Sleep(interval)
+	if err = tx.Exec(context.Background(), SQLStatClearSnapshot); err != nil {
+		return nil, errors.Wrap(err, "SQLStatClearSnapshot")
+	}
+	next, err := queryTableStats(tx, tables)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLTableStats")
+	}
+	setActivityRate(rv, next, interval)
+	return rv, nil
+}
+
+// setActivityRate sets rate of stats by activity counters of next sample taken after interval
+func setActivityRate(stats, next map[string]TableStats, interval time.Duration) {
+	for name, st := range stats {
+		if n, ok := next[name]; ok && n.activity > st.activity {
+			st.Rate = float64(n.activity-st.activity) / interval.Seconds()
+			stats[name] = st
+		}
+	}
+}
+
+// queryTableStats fetches stats of existing tables
+func queryTableStats(tx Executor, tables []string) (map[string]TableStats, error) {
+	rows, err := tx.Query(context.Background(), SQLTableStats, tables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rv := map[string]TableStats{}
+	for rows.Next() {
+		var name string
+		var st TableStats
+		if err = rows.Scan(&name, &st.Size, &st.Rows, &st.activity); err != nil {
+			return nil, err
+		}
+		rv[name] = st
+	}
+	return rv, rows.Err()
+}
+
+// lockRule holds statement pattern with lock taken.
+// Table name is matched by named group "t".
+type lockRule struct {
+	re      *regexp.Regexp
+	lock    string
+	rewrite bool
+	note    string
+}
+
+const reName = `(?P<t>(?:"[^"]+"|[\w$]+)(?:\.(?:"[^"]+"|[\w$]+))?)`
+
+func rule(re, lock string, rewrite bool, note string) lockRule {
+	return lockRule{re: regexp.MustCompile(`(?is)^` + strings.ReplaceAll(re, "NAME", reName)), lock: lock, rewrite: rewrite, note: note}
+}
+
+var statementRules = []lockRule{
+	rule(`CREATE (UNIQUE )?INDEX CONCURRENTLY .*?\bON (ONLY )?NAME`, LockShareUpdateExclusive, false, ""),
+	rule(`CREATE (UNIQUE )?INDEX .*?\bON (ONLY )?NAME`, LockShare, false, "writes are blocked while index is built"),
+	rule(`DROP INDEX CONCURRENTLY (IF EXISTS )?NAME`, LockShareUpdateExclusive, false, ""),
+	rule(`DROP INDEX (IF EXISTS )?NAME`, LockAccessExclusive, false, ""),
+	rule(`REINDEX (\(.*?\) )?(TABLE|INDEX) CONCURRENTLY NAME`, LockShareUpdateExclusive, false, ""),
+	rule(`REINDEX (\(.*?\) )?(TABLE|INDEX) NAME`, LockShare, false, "writes are blocked while index is rebuilt"),
+	rule(`VACUUM (FULL|\([^)]*FULL[^)]*\)) .*?NAME$`, LockAccessExclusive, true, "table is rewritten"),
+	rule(`CLUSTER (VERBOSE )?NAME`, LockAccessExclusive, true, "table is rewritten"),
+	rule(`TRUNCATE (TABLE )?(ONLY )?NAME`, LockAccessExclusive, false, ""),
+	rule(`DROP TABLE (IF EXISTS )?NAME`, LockAccessExclusive, false, ""),
+	rule(`REFRESH MATERIALIZED VIEW CONCURRENTLY NAME`, LockExclusive, false, ""),
+	rule(`REFRESH MATERIALIZED VIEW NAME`, LockAccessExclusive, false, "view is unreadable while refreshed"),
+	rule(`CREATE (OR REPLACE )?(CONSTRAINT )?TRIGGER .*?\bON NAME`, LockShareRowExclusive, false, ""),
+	rule(`LOCK (TABLE )?(ONLY )?NAME`, LockAccessExclusive, false, ""),
+}
+
+var (
+	reAlterTable = rule(`ALTER TABLE (IF EXISTS )?(ONLY )?NAME \*? ?(?P<a>.*)$`, "", false, "")
+	reLockMode   = regexp.MustCompile(`(?i) IN (.+) MODE`)
+)
+
+// alterRules holds ALTER TABLE action patterns, ACCESS EXCLUSIVE is assumed for others
+var alterRules = []lockRule{
+	rule(`ALTER (COLUMN )?\S+ (SET DATA )?TYPE\b`, LockAccessExclusive, true, "column type change rewrites table"),
+	rule(`SET (TABLESPACE|LOGGED|UNLOGGED)\b`, LockAccessExclusive, true, "table is rewritten"),
+	rule(`ADD (COLUMN )?.*\bDEFAULT .*\b(random|clock_timestamp|timeofday|gen_random_uuid|uuid_generate_v\w*|nextval) ?\(`,
+		LockAccessExclusive, true, "volatile default rewrites table"),
+	rule(`ALTER (COLUMN )?\S+ SET NOT NULL`, LockAccessExclusive, false, "table is scanned"),
+	rule(`ALTER (COLUMN )?\S+ SET STATISTICS`, LockShareUpdateExclusive, false, ""),
+	rule(`ADD (CONSTRAINT \S+ )?FOREIGN KEY .*NOT VALID$`, LockShareRowExclusive, false, ""),
+	rule(`ADD (CONSTRAINT \S+ )?FOREIGN KEY`, LockShareRowExclusive, false, "table is scanned"),
+	rule(`ADD .*NOT VALID$`, LockAccessExclusive, false, ""),
+	rule(`ADD (CONSTRAINT \S+ )?(UNIQUE|PRIMARY KEY) .*USING INDEX`, LockAccessExclusive, false, ""),
+	rule(`ADD (CONSTRAINT \S+ )?(CHECK|UNIQUE|PRIMARY KEY|EXCLUDE)\b`, LockAccessExclusive, false, "table is scanned"),
+	rule(`VALIDATE CONSTRAINT`, LockShareUpdateExclusive, false, "table is scanned"),
+	rule(`(ENABLE|DISABLE) (ALWAYS |REPLICA )?TRIGGER`, LockShareRowExclusive, false, ""),
+	rule(`(SET|RESET) \(`, LockShareUpdateExclusive, false, ""),
+	rule(`ALTER (COLUMN )?\S+ (SET|RESET) \(`, LockShareUpdateExclusive, false, ""),
+	rule(`(CLUSTER ON|SET WITHOUT CLUSTER)\b`, LockShareUpdateExclusive, false, ""),
+	rule(`ATTACH PARTITION`, LockShareUpdateExclusive, false, "attached partition is locked ACCESS EXCLUSIVE and scanned"),
+	rule(`DETACH PARTITION .*CONCURRENTLY$`, LockShareUpdateExclusive, false, ""),
+	rule(`SET ACCESS METHOD\b`, LockAccessExclusive, true, "table is rewritten"),
+	rule(`(ADD|DROP|RENAME|OWNER TO|SET SCHEMA|SET WITHOUT OIDS|INHERIT|NO INHERIT|OF|NOT OF|REPLICA IDENTITY|DETACH PARTITION|ALTER CONSTRAINT)\b`,
+		LockAccessExclusive, false, ""),
+	rule(`(ENABLE|DISABLE) (ALWAYS |REPLICA )?RULE|(ENABLE|DISABLE|FORCE|NO FORCE) ROW LEVEL SECURITY`, LockAccessExclusive, false, ""),
+	rule(`ALTER (COLUMN )?\S+ (SET DEFAULT|DROP DEFAULT|DROP NOT NULL|ADD GENERATED|SET GENERATED|SET INCREMENT|SET START|RESTART|DROP IDENTITY|DROP EXPRESSION|SET STORAGE|SET COMPRESSION|OPTIONS)\b`,
+		LockAccessExclusive, false, ""),
+}
+
+// classifyStatement returns lock taken by statement, nil if statement is not recognized
+func classifyStatement(text string) *StatementLock {
+	st := strings.Join(strings.Fields(text), " ")
+	short := st
+	if len(short) > 80 {
+		short = short[:77] + "..."
+	}
+	if m := reAlterTable.re.FindStringSubmatch(st); m != nil {
+		rv := classifyAlter(m[reAlterTable.re.SubexpIndex("a")])
+		rv.Table = m[reAlterTable.re.SubexpIndex("t")]
+		rv.Statement = short
+		return rv
+	}
+	for _, r := range statementRules {
+		m := r.re.FindStringSubmatch(st)
+		if m == nil {
+			continue
+		}
+		rv := &StatementLock{Statement: short, Table: m[r.re.SubexpIndex("t")], Lock: r.lock, Rewrite: r.rewrite, Note: r.note}
+		if mode := reLockMode.FindStringSubmatch(st); strings.HasPrefix(strings.ToUpper(st), "LOCK") && mode != nil {
+			rv.Lock = strings.ToUpper(mode[1])
+		}
+		return rv
+	}
+	return nil
+}
+
+// classifyAlter returns strongest lock of ALTER TABLE actions
+func classifyAlter(actions string) *StatementLock {
+	rv := &StatementLock{}
+	var notes []string
+	for _, action := range splitActions(actions) {
+		lock, rewrite, note := LockAccessExclusive, false, "unknown action, lock is assumed"
+		known := false
+		for _, r := range alterRules {
+			if r.re.MatchString(action) {
+				lock, rewrite, note, known = r.lock, r.rewrite, r.note, true
+				break
+			}
+		}
+		rv.Assumed = rv.Assumed || !known
+		if lockLevel(lock) > lockLevel(rv.Lock) {
+			rv.Lock = lock
+		}
+		rv.Rewrite = rv.Rewrite || rewrite
+		if note != "" && !strings.Contains(strings.Join(notes, ","), note) {
+			notes = append(notes, note)
+		}
+	}
+	rv.Note = strings.Join(notes, ", ")
+	return rv
+}
+
+// splitActions splits ALTER TABLE actions by commas outside of parens and quotes
+func splitActions(s string) (rv []string) {
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			rv = append(rv, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(rv, strings.TrimSpace(s[start:]))
+}
+
+// lockLevel returns lock strength, -1 for unknown lock
+func lockLevel(lock string) int {
+	for i, l := range lockLevels {
+		if l == lock {
+			return i
+		}
+	}
+	return -1
+}
+
+// humanSize formats size in bytes
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,143 @@
+package pgmig
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		sql     string
+		table   string
+		lock    string
+		rewrite bool
+	}{
+		{"CREATE INDEX CONCURRENTLY i ON a.t (id)", "a.t", LockShareUpdateExclusive, false},
+		{"create unique index i on t using btree (id)", "t", LockShare, false},
+		{"DROP INDEX IF EXISTS a.i", "a.i", LockAccessExclusive, false},
+		{"ALTER TABLE t ALTER COLUMN id TYPE bigint", "t", LockAccessExclusive, true},
+		{"ALTER TABLE ONLY \"T\" ADD COLUMN c int DEFAULT 0", `"T"`, LockAccessExclusive, false},
+		{"ALTER TABLE t ADD COLUMN c timestamptz DEFAULT clock_timestamp()", "t", LockAccessExclusive, true},
+		{"ALTER TABLE t ADD COLUMN c timestamptz DEFAULT now()", "t", LockAccessExclusive, false},
+		{"ALTER TABLE t ADD CONSTRAINT f FOREIGN KEY (a) REFERENCES b(id) NOT VALID", "t", LockShareRowExclusive, false},
+		{"ALTER TABLE t VALIDATE CONSTRAINT f, ALTER c SET STATISTICS 100", "t", LockShareUpdateExclusive, false},
+		{"ALTER TABLE t VALIDATE CONSTRAINT f, ALTER c SET NOT NULL", "t", LockAccessExclusive, false},
+		{"VACUUM FULL t", "t", LockAccessExclusive, true},
+		{"LOCK TABLE t IN SHARE MODE", "t", LockShare, false},
+		{"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW EXECUTE FUNCTION f()", "t", LockShareRowExclusive, false},
+		{"ALTER TABLE t ATTACH PARTITION t_2020 FOR VALUES FROM ('2020-01-01') TO ('2021-01-01')", "t", LockShareUpdateExclusive, false},
+		{"ALTER TABLE t DETACH PARTITION t_2020 CONCURRENTLY", "t", LockShareUpdateExclusive, false},
+		{"ALTER TABLE t DETACH PARTITION t_2020", "t", LockAccessExclusive, false},
+		{"ALTER TABLE t RENAME COLUMN a TO b", "t", LockAccessExclusive, false},
+	}
+	for _, tt := range tests {
+		got := classifyStatement(tt.sql)
+		require.NotNil(t, got, tt.sql)
+		assert.Equal(t, tt.table, got.Table, tt.sql)
+		assert.Equal(t, tt.lock, got.Lock, tt.sql)
+		assert.Equal(t, tt.rewrite, got.Rewrite, tt.sql)
+	}
+	assert.False(t, classifyStatement("ALTER TABLE t DROP COLUMN c, ALTER c DROP DEFAULT").Assumed)
+	got := classifyStatement("ALTER TABLE t SPLIT PARTITION p INTO (PARTITION p1, PARTITION p2)")
+	assert.Equal(t, LockAccessExclusive, got.Lock)
+	assert.True(t, got.Assumed)
+	assert.Equal(t, "unknown action, lock is assumed", got.Note)
+	assert.Nil(t, classifyStatement("CREATE TABLE t (id int)"))
+	assert.Nil(t, classifyStatement("SELECT 1"))
+}
+
+func TestWarnLocks(t *testing.T) {
+	mig := New(logr.Discard(), Config{LockBigTable: 1000, LockHotTable: 100}, nil, "testdata")
+	plan := &Plan{Command: CmdInit, Files: []PlanFile{{Pkg: "a", Op: CmdInit, File: "01.sql", Locks: []StatementLock{
+		{Line: 1, Statement: "ALTER TABLE big ...", Table: "big", Lock: LockAccessExclusive, Rewrite: true, Note: "table is rewritten"},
+		{Line: 2, Statement: "CREATE INDEX CONCURRENTLY ...", Table: "big", Lock: LockShareUpdateExclusive},
+		{Line: 3, Statement: "CREATE INDEX ...", Table: "small", Lock: LockShare},
+		{Line: 4, Statement: "CREATE INDEX ...", Table: "hot", Lock: LockShare},
+		{Line: 5, Statement: "CREATE INDEX ...", Table: "new", Lock: LockShare},
+		{Line: 6, Statement: "ALTER TABLE small ...", Table: "small", Lock: LockAccessExclusive, Assumed: true},
+	}}}}
+	stats := map[string]TableStats{
+		"big":   {Size: 2048, Rows: 10},
+		"small": {Size: 10, Rows: 1, Rate: 5},
+		"hot":   {Size: 10, Rows: 1, Rate: 500},
+	}
+	plan.Warnings = mig.warnLocks(plan, stats)
+	assert.Equal(t, 2, plan.Warnings)
+	locks := plan.Files[0].Locks
+	assert.Equal(t, "ACCESS EXCLUSIVE lock on big table (2.0 kB, 10 rows): table is rewritten", locks[0].Warning)
+	assert.Empty(t, locks[1].Warning)
+	assert.Empty(t, locks[2].Warning)
+	assert.Equal(t, "SHARE lock on hot table (10 B, 1 rows, 500 ops/s)", locks[3].Warning)
+	assert.Nil(t, locks[4].Stats)
+
+	buf := &bytes.Buffer{}
+	printPlan(buf, plan, "", "")
+	assert.Contains(t, buf.String(), "a.init 01.sql\n  1: ACCESS EXCLUSIVE: ALTER TABLE big ...\n  # WARNING: ")
+	assert.Contains(t, buf.String(), "  6: ACCESS EXCLUSIVE (assumed): ALTER TABLE small ...\n")
+	assert.Contains(t, buf.String(), "# 2 dangerous statement(s) found\n")
+}
+
+func TestSampleTableStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	tx := NewMockTx(ctrl)
+	tables := []string{"t"}
+	sample := func(activity int64) *gomock.Call {
+		rows := NewMockRows(ctrl)
+		gomock.InOrder(
+			rows.EXPECT().Next().Return(true),
+			rows.EXPECT().Scan(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+				*dest[0].(*string), *dest[1].(*int64), *dest[2].(*int64), *dest[3].(*int64) = "t", 10, 1, activity
+				return nil
+			}),
+			rows.EXPECT().Next().Return(false),
+			rows.EXPECT().Err().Return(nil),
+			rows.EXPECT().Close(),
+		)
+		return tx.EXPECT().Query(ctx, SQLTableStats, tables).Return(rows, nil)
+	}
+	gomock.InOrder(
+		sample(100),
+		tx.EXPECT().Exec(ctx, SQLStatClearSnapshot).Return(pgconn.CommandTag{}, nil),
+		sample(101),
+	)
+	mig := New(logr.Discard(), Config{LockHotTable: 1, LockSample: time.Millisecond}, nil, "")
+	stats, err := mig.sampleTableStats(wrapTx(tx), tables)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, stats["t"].Rate)
+	assert.Equal(t, int64(1), stats["t"].Rows)
+}
+
+func TestSetActivityRate(t *testing.T) {
+	stats := map[string]TableStats{
+		"busy":  {Size: 10, activity: 1000000},
+		"idle":  {Size: 10, activity: 1000000},
+		"reset": {Size: 10, activity: 1000000},
+	}
+	next := map[string]TableStats{
+		"busy":  {Size: 10, activity: 1001000},
+		"idle":  {Size: 10, activity: 1000000},
+		"reset": {Size: 10, activity: 10},
+	}
+	setActivityRate(stats, next, 2*time.Second)
+	assert.Equal(t, 500.0, stats["busy"].Rate)
+	assert.Zero(t, stats["idle"].Rate)
+	assert.Zero(t, stats["reset"].Rate)
+}
+
+func TestPlan(t *testing.T) {
+	mig := New(logr.Discard(), Config{InitIncludes: []string{"*.sql"}, OnceIncludes: []string{"*.once.sql"}}, nil, "testdata")
+	plan, err := mig.Plan(nil, CmdInit, []string{"a"})
+	require.NoError(t, err)
+	require.Len(t, plan.Files, 5)
+	assert.Equal(t, PlanFile{Pkg: "a", Op: CmdInit, File: "03.once.sql", IfNewFile: true, root: "testdata/a"}, plan.Files[3])
+}
@@ -2,9 +2,11 @@ package pgmig
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"sync"
-
-	"github.com/jackc/pgconn"
+	"time"
 )
 
 // Status holds Status message fields.
@@ -46,39 +48,107 @@ type TestFail struct {
 	Detail  string
 }
 
-// PrintMessages prints messages from SQL functions
+// PrintMessages prints messages from MessageChan until it is closed.
+// Deprecated: use AddSink(NewConsoleSink(os.Stdout, mig.IsTerminal)) instead.
 func (mig *Migrator) PrintMessages(wg *sync.WaitGroup) {
-	yellow, green, red, end := colors(mig.IsTerminal)
+	defer wg.Done()
+	if mig.MessageChan == nil {
+		return
+	}
+	sink := NewConsoleSink(os.Stdout, mig.IsTerminal)
 	for m := range mig.MessageChan {
-		switch v := m.(type) {
-		case *Status:
-			fmt.Printf("PgMig exists: %v\n", v.Exists)
-		case *Op:
-			fmt.Printf("%s# %s.%s%s\n", yellow, v.Pkg, v.Op, end)
-		case *Version:
-			fmt.Printf("Installed version: %s\n", v.Version)
-		case *NewVersion:
-			fmt.Printf("New version:       %s from %s\n", v.Version, v.Repo)
-		case *RunFile:
-			if mig.IsTerminal {
-				fmt.Printf("\r# %s ", v.Name)
-			} else {
-				fmt.Printf("\n# %s", v.Name)
-			}
-		case *TestCount:
-			fmt.Printf("\n%d..%d\n", 1, v.Count)
-		case *TestOk:
-			fmt.Printf("%sok %d - %s%s\n", green, v.Current, v.Message, end)
-		case *TestFail:
-			fmt.Printf("%snot ok %d - %s\n  ---\n%s%s\n  ---\n", red, v.Current, v.Message, v.Detail, end)
-		case *pgconn.PgError:
-			printPgError(v)
-		default:
-			fmt.Printf(">> %T\n", m)
-		}
+		sink.print(m)
 	}
 	mig.Log.V(1).Info("MessageChan closed")
-	wg.Done()
+}
+
+// ConsoleSink prints events in human readable form.
+type ConsoleSink struct {
+	w      io.Writer
+	isTerm bool
+}
+
+// NewConsoleSink returns sink which prints events to w.
+// Colors are used if isTerm is true.
+func NewConsoleSink(w io.Writer, isTerm bool) *ConsoleSink {
+	return &ConsoleSink{w: w, isTerm: isTerm}
+}
+
+// Emit prints event
+func (cs *ConsoleSink) Emit(e Envelope) { cs.print(e.Event) }
+
+// Close does nothing
+func (cs *ConsoleSink) Close() error { return nil }
+
+func (cs *ConsoleSink) print(m interface{}) {
+	w := cs.w
+	yellow, green, red, end := colors(cs.isTerm)
+	switch v := m.(type) {
+	case *Status:
+		fmt.Fprintf(w, "PgMig exists: %v\n", v.Exists)
+	case *Op:
+		fmt.Fprintf(w, "%s# %s.%s%s\n", yellow, v.Pkg, v.Op, end)
+	case *Version:
+		fmt.Fprintf(w, "Installed version: %s\n", v.Version)
+	case *NewVersion:
+		fmt.Fprintf(w, "New version:       %s from %s\n", v.Version, v.Repo)
+	case *RunFile:
+		if cs.isTerm {
+			fmt.Fprintf(w, "\r# %s ", v.Name)
+		} else {
+			fmt.Fprintf(w, "\n# %s", v.Name)
+		}
+	case *TestCount:
+		fmt.Fprintf(w, "\n%d..%d\n", 1, v.Count)
+	case *TestOk:
+		fmt.Fprintf(w, "%sok %d - %s%s\n", green, v.Current, v.Message, end)
+	case *TestFail:
+		fmt.Fprintf(w, "%snot ok %d - %s\n  ---\n%s%s\n  ---\n", red, v.Current, v.Message, v.Detail, end)
+	case *FileDone:
+		if cs.isTerm {
+			fmt.Fprintf(w, "\r# %s (%s) ", v.Name, roundDuration(v.Duration))
+		} else {
+			fmt.Fprintf(w, " (%s)", roundDuration(v.Duration))
+		}
+	case *SessionSettings:
+		fmt.Fprintf(w, "# Settings:")
+		for _, s := range v.Settings {
+			fmt.Fprintf(w, " %s=%s", s.Name, s.Value)
+		}
+		fmt.Fprintln(w)
+	case *Retry:
+		fmt.Fprintf(w, "%s# Retry %d after %s: %s %s%s\n", yellow, v.Attempt, roundDuration(v.Delay), v.Code, v.Message, end)
+	case *HookDone:
+		// hooks are fast usually, so their timing is not shown
+	case *Summary:
+		printSummary(w, v)
+	case *StatementDone:
+		// statement timing is written by JSON and trace sinks
+	case *RunDone:
+		// run result is shown by Summary and PgError
+	case *Coverage:
+		printCoverage(w, v)
+	case *Plan:
+		printPlan(w, v, yellow, end)
+	case *TargetStart:
+		fmt.Fprintf(w, "%s# Target %s%s\n", yellow, v.Target, end)
+	case *TargetDone:
+		printTargetDone(w, v, green, red, end)
+	case *MultiReport:
+		printMultiReport(w, v, green, red, end)
+	case *Drift:
+		printDrift(w, v, green, red, end)
+	case *Diff:
+		printDiff(w, v, yellow, end)
+	case *WatchChange:
+		fmt.Fprintf(w, "\n%s# Changed: %s, running %s%s\n", yellow, strings.Join(v.Files, ", "), strings.Join(v.Packages, " "), end)
+	case *PgError:
+		printPgError(w, v.DBError)
+	case *DBError:
+		printPgError(w, v)
+	default:
+		fmt.Fprintf(w, ">> %T\n", m)
+	}
 }
 
 func colors(isTerm bool) (string, string, string, string) {
@@ -89,18 +159,137 @@ func colors(isTerm bool) (string, string, string, string) {
 }
 
 // printPgError prints Pg error struct
-func printPgError(e *pgconn.PgError) {
-	fmt.Printf("#  %s:%d %s %s %s\n", e.File, e.Line, e.Severity, e.Code, e.Message)
+func printPgError(w io.Writer, e *DBError) {
+	fmt.Fprintf(w, "#  %s:%d %s %s %s\n", e.File, e.Line, e.Severity, e.Code, e.Message)
 	if e.Detail != "" {
-		fmt.Println("#  Detail: " + e.Detail)
+		fmt.Fprintln(w, "#  Detail: "+e.Detail)
 	}
 	if e.Hint != "" {
-		fmt.Println("#  Hint: " + e.Hint)
+		fmt.Fprintln(w, "#  Hint: "+e.Hint)
 	}
 	if e.Where != "" {
-		fmt.Println("#  Where: " + e.Where)
+		fmt.Fprintln(w, "#  Where: "+e.Where)
 	}
 	if e.InternalQuery != "" {
-		fmt.Println("#  Query: " + e.InternalQuery)
+		fmt.Fprintln(w, "#  Query: "+e.InternalQuery)
+	}
+}
+
+// printCoverage prints coverage summary and not called functions
+func printCoverage(w io.Writer, c *Coverage) {
+	if c.Unavailable != "" {
+		fmt.Fprintf(w, "# Coverage: unavailable, %s\n", c.Unavailable)
+		return
+	}
+	called := c.Called()
+	fmt.Fprintf(w, "# Coverage: %d of %d functions called (%.1f%%)\n", called, len(c.Funcs), percent(called, len(c.Funcs)))
+	if total, hit := c.LinesCount(); total > 0 {
+		fmt.Fprintf(w, "# Lines: %d of %d executed (%.1f%%)\n", hit, total, percent(hit, total))
+	}
+	for _, f := range c.Funcs {
+		if f.Calls == 0 {
+			fmt.Fprintf(w, "#  not called: %s\n", f.Signature())
+		}
+	}
+}
+
+// printPlan prints files to run and their locks
+func printPlan(w io.Writer, p *Plan, yellow, end string) {
+	fmt.Fprintf(w, "# Plan: %s\n", p.Command)
+	for _, f := range p.Files {
+		cond := ""
+		if f.IfNewPkg {
+			cond = " (if package is new)"
+		} else if f.IfNewFile {
+			cond = " (once)"
+		}
+		fmt.Fprintf(w, "%s.%s %s%s\n", f.Pkg, f.Op, f.File, cond)
+		for _, l := range f.Locks {
+			lock := l.Lock
+			if l.Assumed {
+				lock += " (assumed)"
+			}
+			fmt.Fprintf(w, "  %d: %s: %s\n", l.Line, lock, l.Statement)
+			if l.Warning != "" {
+				fmt.Fprintf(w, "  %s# WARNING: %s%s\n", yellow, l.Warning, end)
+			}
+		}
+	}
+	if p.Warnings > 0 {
+		fmt.Fprintf(w, "%s# %d dangerous statement(s) found%s\n", yellow, p.Warnings, end)
+	}
+}
+
+// printTargetDone prints target outcome
+func printTargetDone(w io.Writer, t *TargetDone, green, red, end string) {
+	color := green
+	if t.Outcome == TargetError || t.Outcome == TargetSkipped {
+		color = red
+	}
+	fmt.Fprintf(w, "%s# %s: %s (%s)%s\n", color, t.Target, t.Outcome, roundDuration(t.Duration), end)
+	if t.Outcome == TargetPrepared {
+		fmt.Fprintf(w, "#  Prepared transaction: %s\n", t.GID)
+	}
+	if t.Error != "" {
+		fmt.Fprintf(w, "#  %s\n", t.Error)
+	}
+}
+
+// printMultiReport prints outcome of all targets
+func printMultiReport(w io.Writer, r *MultiReport, green, red, end string) {
+	fmt.Fprintf(w, "\n# Targets: %d, failed: %d\n", len(r.Results), r.Failed)
+	for _, t := range r.Results {
+		printTargetDone(w, t, green, red, end)
+	}
+}
+
+// printDrift prints objects which differ from package snapshot
+func printDrift(w io.Writer, d *Drift, green, red, end string) {
+	if len(d.Items) == 0 {
+		fmt.Fprintf(w, "%s# %s: schema matches %s%s\n", green, d.Pkg, d.File, end)
+		return
+	}
+	fmt.Fprintf(w, "%s# %s: %d object(s) differ from %s%s\n", red, d.Pkg, len(d.Items), d.File, end)
+	for _, i := range d.Items {
+		fmt.Fprintf(w, "%s %s %s\n", i.Change, i.Kind, i.Name)
+		if i.Want != "" {
+			fmt.Fprintf(w, "  snapshot: %s\n", i.Want)
+		}
+		if i.Got != "" {
+			fmt.Fprintf(w, "  database: %s\n", i.Got)
+		}
+	}
+}
+
+// printDiff prints changes between diff sources
+func printDiff(w io.Writer, d *Diff, yellow, end string) {
+	fmt.Fprintf(w, "%s# %s: %s -> %s, %d difference(s)%s\n", yellow, d.Pkg, d.From, d.To, len(d.Items), end)
+	signs := map[string]string{DriftExtra: "+", DriftMissing: "-", DriftChanged: "~"}
+	for _, i := range d.Items {
+		fmt.Fprintf(w, "%s %s\n", signs[i.Change], i.SQL())
+	}
+}
+
+// printSummary prints run duration and slowest files
+func printSummary(w io.Writer, s *Summary) {
+	fmt.Fprintf(w, "\n# Done in %s\n", roundDuration(s.Duration))
+	if len(s.Slowest) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# Slowest files:")
+	for _, f := range s.Slowest {
+		failed := ""
+		if f.Failed {
+			failed = " (failed)"
+		}
+		fmt.Fprintf(w, "#  %10s %s/%s%s\n", roundDuration(f.Duration), f.Pkg, f.File, failed)
+	}
+}
+
+// roundDuration rounds duration for printing
+func roundDuration(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
 	}
+	return d.Round(time.Microsecond)
 }
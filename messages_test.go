@@ -10,8 +10,6 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/wojas/genericr"
 	"github.com/go-logr/logr"
-
-	"github.com/jackc/pgconn"
 )
 
 func ExampleMigrator_PrintMessages() {
@@ -37,7 +35,7 @@ func ExampleMigrator_PrintMessages() {
 		&TestCount{Count: 1},
 		&TestOk{Current: 1, Message: "message"},
 		&TestFail{Current: 1, Message: "message", Detail: "detail"},
-		&pgconn.PgError{
+		&DBError{
 			File:          "file",
 			Line:          1,
 			Severity:      "NOTICE",
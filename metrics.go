@@ -0,0 +1,346 @@
+// This file holds Prometheus metrics sink.
+// Metrics are collected from events and written in Prometheus text format,
+// as node_exporter textfile on close or via HTTP handler while running.
+// PostgreSQL does not report lock wait time, so it is measured as duration of statement failed by lock_timeout
+// (run time of its file since previous statement or file start if statements are not timed).
+// Last success time is kept in textfile between runs, so failed run does not reset it.
+
+package pgmig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricLastSuccess holds name of last success gauge
+const metricLastSuccess = "pgmig_last_success_timestamp_seconds"
+
+// metricsBuckets holds duration histogram buckets in seconds
+var metricsBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// metricDef holds metric metadata
+type metricDef struct {
+	name string
+	typ  string
+	help string
+}
+
+// metricDefs holds exported metrics in output order
+var metricDefs = []metricDef{
+	{"pgmig_runs_total", "counter", "Runs by command and outcome."},
+	{"pgmig_targets_total", "counter", "Target database runs by outcome."},
+	{"pgmig_package_duration_seconds", "histogram", "Package files run duration."},
+	{"pgmig_file_duration_seconds", "histogram", "File run duration."},
+	{"pgmig_tests_total", "counter", "Tests by package and result."},
+	{"pgmig_lock_timeouts_total", "counter", "Statements failed by lock_timeout."},
+	{"pgmig_lock_wait_seconds_total", "counter", "Run time of statements failed by lock_timeout."},
+	{"pgmig_retry_wait_seconds_total", "counter", "Time waited before run retries."},
+	{metricLastSuccess, "gauge", "Time of last committed run by command and package."},
+}
+
+// histogram holds histogram series values
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// MetricsSink collects run metrics from events.
+type MetricsSink struct {
+	file   string
+	lock   sync.Mutex
+	values map[string]map[string]float64 // counters and gauges by name and labels
+	hists  map[string]map[string]*histogram
+	target string                   // current target of multi database run
+	pkgDur map[string]time.Duration // package durations of current run
+	stmtAt time.Time                // start of current statement or file
+	now    func() time.Time
+	// prepared holds prepared runs of two-phase multi database run by target
+	prepared map[string]*RunDone
+}
+
+// NewMetricsSink returns metrics sink. If file is not empty, metrics are written to it on Close.
+func NewMetricsSink(file string) *MetricsSink {
+	return &MetricsSink{
+		file:   file,
+		values: map[string]map[string]float64{},
+		hists:  map[string]map[string]*histogram{},
+		pkgDur: map[string]time.Duration{},
+		now:    time.Now,
+
+		prepared: map[string]*RunDone{},
+	}
+}
+
+// Emit updates metrics by event
+func (ms *MetricsSink) Emit(e Envelope) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	switch v := e.Event.(type) {
+	case *TargetStart:
+		ms.target = v.Target
+	case *TargetDone:
+		ms.target = "" // target label is set explicitly
+		ms.add("pgmig_targets_total", 1, "target", v.Target, "outcome", v.Outcome)
+		if r := ms.prepared[v.Target]; r != nil && v.Outcome == TargetCommit {
+			ms.setLastSuccess(r.Command, r.Packages, "target", v.Target)
+		}
+		delete(ms.prepared, v.Target)
+	case *MultiReport:
+		ms.target = ""
+	case *RunFile:
+		ms.stmtAt = e.Time
+	case *StatementDone:
+		ms.stmtAt = e.Time
+	case *FileDone:
+		ms.observe("pgmig_file_duration_seconds", v.Duration, "pkg", e.Package, "file", v.Name)
+		ms.pkgDur[e.Package] += v.Duration
+	case *TestOk:
+		ms.add("pgmig_tests_total", 1, "pkg", e.Package, "result", "passed")
+	case *TestFail:
+		ms.add("pgmig_tests_total", 1, "pkg", e.Package, "result", "failed")
+	case *PgError:
+		if v.Code == pgLockNotAvailable {
+			ms.add("pgmig_lock_timeouts_total", 1, "pkg", e.Package)
+			if !ms.stmtAt.IsZero() {
+				ms.add("pgmig_lock_wait_seconds_total", e.Time.Sub(ms.stmtAt).Seconds(), "pkg", e.Package)
+			}
+		}
+	case *Retry:
+		ms.add("pgmig_retry_wait_seconds_total", v.Delay.Seconds())
+	case *Summary:
+		for pkg, d := range ms.pkgDur {
+			ms.observe("pgmig_package_duration_seconds", d, "pkg", pkg)
+		}
+		ms.pkgDur = map[string]time.Duration{}
+	case *RunDone:
+		ms.add("pgmig_runs_total", 1, "command", v.Command, "outcome", v.Outcome)
+		switch {
+		case v.Outcome == OutcomeCommit && v.Prepared != "":
+			ms.setLastSuccess(v.Prepared, v.Packages)
+		case v.Outcome == OutcomeCommit:
+			ms.setLastSuccess(v.Command, v.Packages)
+		case v.Outcome == OutcomePrepared && ms.target != "":
+			// target of two-phase run is committed later
+			ms.prepared[ms.target] = v
+		}
+	}
+}
+
+// setLastSuccess sets last success time of command packages
+func (ms *MetricsSink) setLastSuccess(command string, packages []string, kv ...string) {
+	ts := float64(ms.now().Unix())
+	for _, pkg := range packages {
+		ms.set(metricLastSuccess, ts, append(kv, "command", command, "pkg", pkg)...)
+	}
+}
+
+// labels returns series labels with current target
+func (ms *MetricsSink) labels(kv []string) string {
+	if ms.target != "" {
+		kv = append([]string{"target", ms.target}, kv...)
+	}
+	if len(kv) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, kv[i]+`="`+escapeLabel(kv[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// escapeLabel escapes label value for text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// series returns counter or gauge series by name
+func (ms *MetricsSink) series(name string) map[string]float64 {
+	series := ms.values[name]
+	if series == nil {
+		series = map[string]float64{}
+		ms.values[name] = series
+	}
+	return series
+}
+
+// add increments counter
+func (ms *MetricsSink) add(name string, v float64, kv ...string) {
+	ms.series(name)[ms.labels(kv)] += v
+}
+
+// set sets gauge value
+func (ms *MetricsSink) set(name string, v float64, kv ...string) {
+	ms.series(name)[ms.labels(kv)] = v
+}
+
+// observe adds duration to histogram
+func (ms *MetricsSink) observe(name string, d time.Duration, kv ...string) {
+	series := ms.hists[name]
+	if series == nil {
+		series = map[string]*histogram{}
+		ms.hists[name] = series
+	}
+	l := ms.labels(kv)
+	h := series[l]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		series[l] = h
+	}
+	v := d.Seconds()
+	for i, b := range metricsBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Write writes metrics in Prometheus text format
+func (ms *MetricsSink) Write(w io.Writer) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var b strings.Builder
+	for _, def := range metricDefs {
+		if def.typ == "histogram" {
+			ms.writeHistogram(&b, def)
+			continue
+		}
+		series := ms.values[def.name]
+		if len(series) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", def.name, def.help, def.name, def.typ)
+		labels := make([]string, 0, len(series))
+		for l := range series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(&b, "%s%s %s\n", def.name, wrapLabels(l), formatFloat(series[l]))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeHistogram writes histogram series
+func (ms *MetricsSink) writeHistogram(b *strings.Builder, def metricDef) {
+	series := ms.hists[def.name]
+	if len(series) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", def.name, def.help, def.name, def.typ)
+	labels := make([]string, 0, len(series))
+	for l := range series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		h := series[l]
+		sep := ""
+		if l != "" {
+			sep = ","
+		}
+		for i, bound := range metricsBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", def.name, l, sep, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", def.name, l, sep, h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", def.name, wrapLabels(l), formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", def.name, wrapLabels(l), h.count)
+	}
+}
+
+// ServeHTTP serves metrics for Prometheus scraping
+func (ms *MetricsSink) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := ms.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Close writes metrics file if set.
+// File is written via temporary file and rename, so textfile collector never reads partial file
+func (ms *MetricsSink) Close() error {
+	if ms.file == "" {
+		return nil
+	}
+	if err := ms.loadLastSuccess(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ms.file), filepath.Base(ms.file)+".*")
+	if err != nil {
+		return err
+	}
+	if err = ms.Write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ms.file)
+}
+
+// loadLastSuccess loads last success series of previous run from metrics file.
+// Series which are not updated by this run are kept
+func (ms *MetricsSink) loadLastSuccess() error {
+	f, err := os.Open(ms.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	series := ms.series(metricLastSuccess)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, metricLastSuccess+"{") {
+			continue
+		}
+		i := strings.LastIndex(line, "} ")
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+2:], 64)
+		if err != nil {
+			continue
+		}
+		if l := line[len(metricLastSuccess)+1 : i]; v > series[l] {
+			series[l] = v
+		}
+	}
+	return scanner.Err()
+}
+
+// wrapLabels returns labels in braces, empty string if there are no labels
+func wrapLabels(l string) string {
+	if l == "" {
+		return ""
+	}
+	return "{" + l + "}"
+}
+
+// formatFloat formats metric value
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
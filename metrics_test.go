@@ -0,0 +1,112 @@
+package pgmig
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pgmig.prom")
+	ms := NewMetricsSink(file)
+	ms.now = func() time.Time { return time.Unix(1700000000, 0) }
+	start := time.Unix(1700000000, 0)
+	for _, e := range []Envelope{
+		{Event: &TargetStart{Target: "shard_1"}},
+		{Package: "a", Event: &FileDone{Name: "01.sql", Duration: 20 * time.Millisecond}},
+		{Package: "a", Event: &FileDone{Name: "02.sql", Duration: 2 * time.Second}},
+		{Package: "a", Event: &TestOk{Current: 1}},
+		{Package: "a", Event: &TestFail{Current: 2}},
+		{Package: "a", Time: start, Event: &RunFile{Name: "03.sql"}},
+		{Package: "a", Time: start.Add(time.Second), Event: &StatementDone{Line: 1}},
+		{Package: "a", Time: start.Add(1250 * time.Millisecond), Event: &PgError{&DBError{Code: pgLockNotAvailable}}},
+		{Event: &Retry{Attempt: 1, Delay: 500 * time.Millisecond}},
+		{Event: &Summary{}},
+		{Event: &RunDone{Command: CmdInit, Packages: []string{"a"}, Outcome: OutcomeCommit}},
+		{Event: &TargetDone{Target: "shard_1", Outcome: TargetCommit}},
+		{Event: &MultiReport{}},
+	} {
+		ms.Emit(e)
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, ms.Write(buf))
+	got := buf.String()
+	for _, line := range []string{
+		"# TYPE pgmig_runs_total counter",
+		`pgmig_runs_total{target="shard_1",command="init",outcome="commit"} 1`,
+		`pgmig_targets_total{target="shard_1",outcome="commit"} 1`,
+		`pgmig_package_duration_seconds_bucket{target="shard_1",pkg="a",le="1"} 0`,
+		`pgmig_package_duration_seconds_bucket{target="shard_1",pkg="a",le="5"} 1`,
+		`pgmig_package_duration_seconds_sum{target="shard_1",pkg="a"} 2.02`,
+		`pgmig_file_duration_seconds_bucket{target="shard_1",pkg="a",file="01.sql",le="0.05"} 1`,
+		`pgmig_file_duration_seconds_bucket{target="shard_1",pkg="a",file="02.sql",le="+Inf"} 1`,
+		`pgmig_file_duration_seconds_count{target="shard_1",pkg="a",file="02.sql"} 1`,
+		`pgmig_tests_total{target="shard_1",pkg="a",result="failed"} 1`,
+		`pgmig_tests_total{target="shard_1",pkg="a",result="passed"} 1`,
+		`pgmig_lock_timeouts_total{target="shard_1",pkg="a"} 1`,
+		`pgmig_lock_wait_seconds_total{target="shard_1",pkg="a"} 0.25`,
+		`pgmig_retry_wait_seconds_total{target="shard_1"} 0.5`,
+		`pgmig_last_success_timestamp_seconds{target="shard_1",command="init",pkg="a"} 1.7e+09`,
+	} {
+		assert.Contains(t, got, line+"\n")
+	}
+
+	rec := httptest.NewRecorder()
+	ms.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, got, rec.Body.String())
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+
+	require.NoError(t, ms.Close())
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, got, string(data))
+}
+
+func TestEscapeLabel(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabel("a\"b\\c\nd"))
+}
+
+func TestMetricsLastSuccess(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pgmig.prom")
+	prev := `# TYPE pgmig_last_success_timestamp_seconds gauge
+pgmig_last_success_timestamp_seconds{command="init",pkg="a"} 1.6e+09
+pgmig_last_success_timestamp_seconds{command="init",pkg="b"} 1.6e+09
+pgmig_runs_total{command="init",outcome="commit"} 1
+`
+	require.NoError(t, os.WriteFile(file, []byte(prev), 0o644))
+	ms := NewMetricsSink(file)
+	ms.now = func() time.Time { return time.Unix(1700000000, 0) }
+	for _, e := range []Envelope{
+		{Event: &RunDone{Command: CmdInit, Packages: []string{"b"}, Outcome: OutcomeError}},
+		{Event: &RunDone{Command: CmdCommitPrepared, Packages: []string{"a"}, Prepared: CmdInit, Outcome: OutcomeCommit}},
+		{Event: &TargetStart{Target: "shard_1"}},
+		{Event: &RunDone{Command: CmdTest, Packages: []string{"c"}, Outcome: OutcomePrepared}},
+		{Event: &TargetStart{Target: "shard_2"}},
+		{Event: &RunDone{Command: CmdTest, Packages: []string{"c"}, Outcome: OutcomePrepared}},
+		{Event: &TargetDone{Target: "shard_1", GID: "g_shard_1", Outcome: TargetCommit}},
+		{Event: &TargetDone{Target: "shard_2", GID: "g_shard_2", Outcome: TargetRollback}},
+	} {
+		ms.Emit(e)
+	}
+	require.NoError(t, ms.Close())
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	got := string(data)
+	for _, line := range []string{
+		`pgmig_last_success_timestamp_seconds{command="init",pkg="a"} 1.7e+09`,
+		`pgmig_last_success_timestamp_seconds{command="init",pkg="b"} 1.6e+09`,
+		`pgmig_last_success_timestamp_seconds{target="shard_1",command="test",pkg="c"} 1.7e+09`,
+		`pgmig_runs_total{command="init",outcome="error"} 1`,
+	} {
+		assert.Contains(t, got, line+"\n")
+	}
+	assert.NotContains(t, got, `pgmig_last_success_timestamp_seconds{target="shard_2"`)
+	assert.NotContains(t, got, `pgmig_runs_total{command="init",outcome="commit"}`)
+}
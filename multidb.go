@@ -0,0 +1,359 @@
+// This file holds multi database runner.
+// Command runs in every target database with separate connection and Migrator copy.
+// Target events are buffered and emitted in target order.
+// In two-phase mode transactions are prepared in all targets and committed only if all of them succeeded.
+
+package pgmig
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgservicefile"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TargetCommit means target changes were committed
+	TargetCommit = "commit"
+	// TargetRollback means target changes were rolled back without errors
+	TargetRollback = "rollback"
+	// TargetPrepared means target transaction is prepared and waits for commit
+	TargetPrepared = "prepared"
+	// TargetError means target run was finished with error
+	TargetError = "error"
+	// TargetSkipped means target was not run because of previous failure
+	TargetSkipped = "skipped"
+
+	// maxGIDLen holds max length of prepared transaction id
+	maxGIDLen = 199
+)
+
+// Target holds database to run command in.
+type Target struct {
+	Name string
+	DSN  string
+}
+
+// MultiOptions holds multi database run options.
+type MultiOptions struct {
+	// Jobs holds count of targets processed in parallel
+	Jobs int
+	// FailFast stops starting targets after first failure
+	FailFast bool
+	// TwoPhase enables PREPARE TRANSACTION before commit
+	TwoPhase bool
+	// GID holds prepared transaction id prefix, generated if empty.
+	// GIDs are cluster-wide, so target transaction id is GID_<target name>, see TargetGID
+	GID string
+	// Hold keeps transactions prepared if all targets succeeded, see FinishPrepared
+	Hold bool
+}
+
+// TargetStart holds fields of target run start event.
+type TargetStart struct {
+	Target string
+}
+
+// TargetDone holds fields of target run finish event.
+type TargetDone struct {
+	Target   string
+	Outcome  string
+	GID      string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// MultiReport holds results of all targets.
+type MultiReport struct {
+	Command string
+	GID     string `json:",omitempty"`
+	Results []*TargetDone
+	Failed  int
+}
+
+// Kind returns event kind
+func (*TargetStart) Kind() EventKind { return KindTargetStart }
+
+// Kind returns event kind
+func (*TargetDone) Kind() EventKind { return KindTargetDone }
+
+// Kind returns event kind
+func (*MultiReport) Kind() EventKind { return KindMultiReport }
+
+// targetJob holds single target run data
+type targetJob struct {
+	target Target
+	mig    *Migrator
+	conn   Conn
+	events []Event
+	result *TargetDone
+	err    error
+	failed bool // transaction was rolled back instead of prepare
+	done   chan struct{}
+}
+
+// RunTargetsIn runs command in all targets and returns aggregated report.
+// Connections are made by connect, see pgxv4.RunTargets.
+// Returned error is not nil only if run could not be finished, target errors are in report.
+func (mig *Migrator) RunTargetsIn(ctx context.Context, connect Connector, targets []Target, command string, packages []string, opts MultiOptions) (*MultiReport, error) {
+	rep := &MultiReport{Command: command, GID: opts.GID}
+	if opts.TwoPhase && rep.GID == "" {
+		rep.GID = fmt.Sprintf("pgmig_%d", time.Now().UnixNano())
+	}
+	gid := ""
+	if opts.TwoPhase || command == CmdCommitPrepared || command == CmdRollbackPrepared {
+		gid = rep.GID
+	}
+	jobs := make([]*targetJob, len(targets))
+	queue := make(chan *targetJob, len(targets))
+	for i, t := range targets {
+		jobs[i] = &targetJob{target: t, done: make(chan struct{})}
+		queue <- jobs[i]
+	}
+	close(queue)
+	workers := opts.Jobs
+	if workers > len(jobs) {
+		workers = len(jobs)
+	} else if workers < 1 {
+		workers = 1
+	}
+	var stopped int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if atomic.LoadInt32(&stopped) == 0 {
+					mig.runTarget(ctx, connect, job, command, packages, gid)
+					if (job.result.Outcome == TargetError || job.failed) && opts.FailFast {
+						atomic.StoreInt32(&stopped, 1)
+					}
+				} else {
+					job.result = &TargetDone{Target: job.target.Name, Outcome: TargetSkipped}
+				}
+				close(job.done)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		<-job.done
+		if job.result.Outcome == TargetSkipped {
+			continue
+		}
+		mig.emit(&TargetStart{Target: job.target.Name})
+		for _, ev := range job.events {
+			mig.emit(ev)
+		}
+		if !opts.TwoPhase {
+			mig.emit(job.result)
+		}
+	}
+	wg.Wait()
+	if opts.TwoPhase {
+		if failed := countFailed(jobs); failed > 0 || !opts.Hold {
+			mig.finishPrepared(ctx, jobs, failed == 0)
+		} else {
+			mig.holdPrepared(ctx, jobs)
+		}
+	}
+	for _, job := range jobs {
+		rep.Results = append(rep.Results, job.result)
+	}
+	rep.Failed = countFailed(jobs)
+	mig.emit(rep)
+	return rep, nil
+}
+
+// countFailed returns count of failed and skipped targets.
+// Target which was rolled back instead of prepare is failed too.
+func countFailed(jobs []*targetJob) (rv int) {
+	for _, job := range jobs {
+		if job.result.Outcome == TargetError || job.result.Outcome == TargetSkipped || job.failed {
+			rv++
+		}
+	}
+	return
+}
+
+// runTarget runs command in target database
+func (mig *Migrator) runTarget(ctx context.Context, connect Connector, job *targetJob, command string, packages []string, gid string) {
+	started := time.Now()
+	w := mig.worker()
+	// confirmation prompts are not possible for several databases
+	w.IsTerminal = false
+	w.sinks = []EventSink{SinkFunc(func(e Envelope) {
+		job.events = append(job.events, e.Event)
+	})}
+	job.mig = w
+	job.result = &TargetDone{Target: job.target.Name}
+	if gid != "" {
+		gid = TargetGID(gid, job.target.Name)
+		job.result.GID = gid
+	}
+	defer func() {
+		job.result.Duration = time.Since(started)
+		if job.err != nil {
+			job.result.Outcome = TargetError
+			job.result.Error = job.err.Error()
+		}
+		if gid == "" || job.result.Outcome != TargetPrepared {
+			w.closeTarget(ctx, job)
+		}
+	}()
+	conn, err := connect(ctx, w, job.target.DSN)
+	if err != nil {
+		job.err = errors.Wrap(err, "Connect")
+		return
+	}
+	job.conn = conn
+	if command == CmdCommitPrepared || command == CmdRollbackPrepared {
+		commit := command == CmdCommitPrepared
+		if job.err = w.FinishPrepared(ctx, conn, gid, commit); job.err == nil {
+			job.result.Outcome = TargetRollback
+			if commit {
+				job.result.Outcome = TargetCommit
+			}
+		}
+		return
+	}
+	commit, err := w.runTx(ctx, conn, command, packages, gid)
+	switch {
+	case err != nil:
+		job.err = err
+	case w.runErr != nil:
+		job.err = w.runErr
+	case commit && gid != "":
+		job.result.Outcome = TargetPrepared
+	case commit:
+		job.result.Outcome = TargetCommit
+	default:
+		job.result.Outcome = TargetRollback
+		// other targets must not be committed without this one
+		job.failed = gid != ""
+	}
+}
+
+// finishPrepared commits or rolls back prepared transactions of all targets
+func (mig *Migrator) finishPrepared(ctx context.Context, jobs []*targetJob, commit bool) {
+	outcome := TargetRollback
+	if commit {
+		outcome = TargetCommit
+	}
+	for _, job := range jobs {
+		if job.result.Outcome != TargetPrepared {
+			if job.result.Outcome != TargetSkipped {
+				mig.emit(job.result)
+			}
+			continue
+		}
+		if err := job.mig.FinishPrepared(ctx, job.conn, job.result.GID, commit); err != nil {
+			job.err = err
+			job.result.Outcome = TargetError
+			job.result.Error = job.err.Error()
+		} else {
+			job.result.Outcome = outcome
+		}
+		job.mig.closeTarget(ctx, job)
+		mig.emit(job.result)
+	}
+}
+
+// holdPrepared closes targets keeping their transactions prepared
+func (mig *Migrator) holdPrepared(ctx context.Context, jobs []*targetJob) {
+	for _, job := range jobs {
+		if job.result.Outcome == TargetPrepared {
+			job.mig.closeTarget(ctx, job)
+		}
+		mig.emit(job.result)
+	}
+}
+
+// closeTarget saves target history and closes its connection
+func (mig *Migrator) closeTarget(ctx context.Context, job *targetJob) {
+	if job.conn == nil {
+		return
+	}
+	if err := mig.SaveHistory(ctx, job.conn, job.err); err != nil {
+		mig.Log.Error(err, "Save history error", "target", job.target.Name)
+	}
+	if err := job.conn.Close(ctx); err != nil {
+		mig.Log.Error(err, "Close error", "target", job.target.Name)
+	}
+	job.conn = nil
+}
+
+// TargetGID returns prepared transaction id of target.
+// Target name is replaced by its hash if id gets too long
+func TargetGID(gid, target string) string {
+	rv := gid + "_" + target
+	if len(rv) > maxGIDLen {
+		rv = fmt.Sprintf("%s_%x", gid, sha256.Sum256([]byte(target)))
+	}
+	return rv
+}
+
+// ReadTargets reads DSNs from r, one per line, and makes targets by newTarget, see pgxv4.NewTarget.
+// Empty lines and lines started with # are skipped.
+func ReadTargets(r io.Reader, newTarget func(dsn string) (Target, error)) ([]Target, error) {
+	var rv []Target
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := newTarget(line)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, t)
+	}
+	return rv, scanner.Err()
+}
+
+// ServiceTargets returns targets for pg_service.conf services which names match mask.
+// If file is empty, PGSERVICEFILE or ~/.pg_service.conf is used.
+func ServiceTargets(file, mask string) ([]Target, error) {
+	if file == "" {
+		file = os.Getenv("PGSERVICEFILE")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".pg_service.conf")
+	}
+	sf, err := pgservicefile.ReadServicefile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read "+file)
+	}
+	var rv []Target
+	for _, s := range sf.Services {
+		ok, err := filepath.Match(mask, s.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rv = append(rv, Target{Name: s.Name,
+				DSN: fmt.Sprintf("service=%s servicefile=%s", quoteDSNValue(s.Name), quoteDSNValue(file))})
+		}
+	}
+	return rv, nil
+}
+
+// quoteDSNValue quotes value for keyword/value connection string
+func quoteDSNValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
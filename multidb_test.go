@@ -0,0 +1,132 @@
+package pgmig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTargets(t *testing.T) {
+	src := `# shards
+postgres://u@db1:5433/shard1
+
+host=db2 dbname=shard2 port=5432
+`
+	newTarget := func(dsn string) (Target, error) {
+		if dsn == "bad" {
+			return Target{}, errors.New("bad dsn")
+		}
+		return Target{Name: "t", DSN: dsn}, nil
+	}
+	got, err := ReadTargets(strings.NewReader(src), newTarget)
+	require.NoError(t, err)
+	assert.Equal(t, []Target{
+		{Name: "t", DSN: "postgres://u@db1:5433/shard1"},
+		{Name: "t", DSN: "host=db2 dbname=shard2 port=5432"},
+	}, got)
+
+	_, err = ReadTargets(strings.NewReader(src+"bad\n"), newTarget)
+	assert.EqualError(t, err, "bad dsn")
+}
+
+func TestServiceTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pg_service.conf")
+	src := "[shard_1]\nhost=db1\ndbname=s1\n\n[shard_2]\nhost=db2\n\n[other]\nhost=db3\n"
+	require.NoError(t, os.WriteFile(file, []byte(src), 0o600))
+	got, err := ServiceTargets(file, "shard_*")
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, "shard_1", got[0].Name)
+	assert.Equal(t, "service='shard_1' servicefile='"+file+"'", got[0].DSN)
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	assert.Equal(t, `'a''b'`, quoteLiteral("a'b"))
+	assert.Equal(t, `'a\'b\\'`, quoteDSNValue(`a'b\`))
+}
+
+func TestTargetGID(t *testing.T) {
+	assert.Equal(t, "pgmig_1_db1:5432/s1", TargetGID("pgmig_1", "db1:5432/s1"))
+	long := TargetGID("pgmig_1", strings.Repeat("x", 300))
+	assert.LessOrEqual(t, len(long), maxGIDLen)
+	assert.True(t, strings.HasPrefix(long, "pgmig_1_"))
+	assert.NotEqual(t, long, TargetGID("pgmig_1", strings.Repeat("y", 300)))
+}
+
+func TestRunTargetsFailFast(t *testing.T) {
+	mig := New(logr.Discard(), Config{}, nil, "testdata")
+	got := []EventKind{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Kind)
+	}))
+	connect := func(context.Context, *Migrator, string) (Conn, error) { return nil, errors.New("refused") }
+	targets := []Target{{Name: "t1", DSN: "db1"}, {Name: "t2", DSN: "db2"}}
+	rep, err := mig.RunTargetsIn(context.Background(), connect, targets, CmdInit, []string{"b"},
+		MultiOptions{Jobs: 1, FailFast: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, rep.Failed)
+	assert.Equal(t, TargetError, rep.Results[0].Outcome)
+	assert.Contains(t, rep.Results[0].Error, "Connect")
+	assert.Equal(t, TargetSkipped, rep.Results[1].Outcome)
+	assert.Equal(t, []EventKind{KindTargetStart, KindTargetDone, KindMultiReport}, got)
+}
+
+// fakeRows is an empty query result
+type fakeRows struct{}
+
+func (fakeRows) Next() bool                     { return false }
+func (fakeRows) Scan(dest ...interface{}) error { return nil }
+func (fakeRows) Err() error                     { return nil }
+func (fakeRows) Close()                         {}
+
+// fakeConn is a Conn which logs statements and fails tests of target on file exec if fail is set
+type fakeConn struct {
+	mig  *Migrator
+	fail bool
+	sql  *[]string
+}
+
+func (c fakeConn) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	*c.sql = append(*c.sql, sql)
+	if c.fail && strings.HasPrefix(sql, "SELECT '") {
+		c.mig.ProcessNotice(pgStatusTestFail, "failed", "")
+	}
+	return nil
+}
+
+func (c fakeConn) Query(ctx context.Context, sql string, args ...interface{}) (Rows, error) {
+	return fakeRows{}, nil
+}
+
+func (c fakeConn) BeginTx(ctx context.Context) (TxExecutor, error) { return c, nil }
+func (c fakeConn) Commit(ctx context.Context) error                { return nil }
+func (c fakeConn) Rollback(ctx context.Context) error              { return nil }
+func (c fakeConn) Close(ctx context.Context) error                 { return nil }
+
+func TestRunTargetsTwoPhaseRollback(t *testing.T) {
+	cfg := Config{NoHooks: true, InitIncludes: []string{"*.sql"}}
+	mig := New(logr.Discard(), cfg, nil, "testdata")
+	sql := map[string]*[]string{}
+	connect := func(_ context.Context, w *Migrator, dsn string) (Conn, error) {
+		sql[dsn] = &[]string{}
+		return fakeConn{mig: w, fail: dsn == "db2", sql: sql[dsn]}, nil
+	}
+	targets := []Target{{Name: "t1", DSN: "db1"}, {Name: "t2", DSN: "db2"}, {Name: "t3", DSN: "db3"}}
+	rep, err := mig.RunTargetsIn(context.Background(), connect, targets, CmdInit, []string{"b"},
+		MultiOptions{Jobs: 1, TwoPhase: true, GID: "g"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, rep.Failed)
+	for _, r := range rep.Results {
+		assert.Equal(t, TargetRollback, r.Outcome, r.Target)
+	}
+	assert.Contains(t, *sql["db1"], "ROLLBACK PREPARED 'g_t1'")
+	assert.Contains(t, *sql["db3"], "ROLLBACK PREPARED 'g_t3'")
+	assert.NotContains(t, *sql["db2"], "PREPARE TRANSACTION 'g_t2'")
+}
@@ -0,0 +1,340 @@
+// This file holds parallel test runner.
+// Test files are distributed among workers, each of them uses its own database
+// created from the tested one via CREATE DATABASE .. TEMPLATE.
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaintenanceDB is the database used for creating and dropping test clones
+	MaintenanceDB = "postgres"
+
+	// SQLCurrentDB fetches name of connected database
+	SQLCurrentDB = "SELECT current_database()"
+	// SQLCreateClone creates test database from template
+	SQLCreateClone = "CREATE DATABASE %s TEMPLATE %s"
+	// SQLDropClone drops test database
+	SQLDropClone = "DROP DATABASE IF EXISTS %s"
+
+	// dropClonesTimeout limits test databases drop which runs after run context is done
+	dropClonesTimeout = 30 * time.Second
+)
+
+// testJob holds single test file run data
+type testJob struct {
+	pkg     pkgDef
+	file    fileDef
+	version string
+	events  []Envelope
+	files   []FileRecord
+	cov     *Coverage
+	err     error
+	done    chan struct{}
+}
+
+// RunParallelIn runs test command for packages in given number of databases cloned from dsn database.
+// Connections are made by connect, see pgxv4.RunParallel.
+// Events are emitted in the same order as in sequential run.
+// Run history is saved in dsn database.
+func (mig *Migrator) RunParallelIn(ctx context.Context, connect Connector, dsn string, packages []string, workers int) (err error) {
+	cfg := mig.Config
+	empty := []string{}
+	pkgs, err := mig.lookupFiles(CmdTest, cfg.TestIncludes, empty, empty, false, packages)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		mig.Log.Info("No files found")
+		return nil
+	}
+	if cfg.ListOnly {
+		fmt.Printf("Files:\n%#v\n", pkgs)
+		return nil
+	}
+	var jobs []*testJob
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			jobs = append(jobs, &testJob{pkg: pkg, file: file, done: make(chan struct{})})
+		}
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	} else if workers < 1 {
+		workers = 1
+	}
+
+	started := time.Now()
+	template, err := mig.prepareTemplate(ctx, connect, dsn)
+	if err != nil {
+		return err
+	}
+	mig.startHistory(CmdTest, packages)
+	defer func() {
+		if er := mig.saveParallelHistory(ctx, connect, dsn, err); er != nil {
+			mig.Log.Error(er, "Save history error")
+		}
+	}()
+
+	clones := make([]string, workers)
+	for i := range clones {
+		clones[i] = cloneName(template, os.Getpid(), i)
+	}
+	admin, err := connect(ctx, mig, ReplaceDatabase(dsn, MaintenanceDB))
+	if err != nil {
+		return errors.Wrap(err, "Connect to "+MaintenanceDB)
+	}
+	defer admin.Close(ctx)
+	defer mig.dropClones(admin, clones)
+	for _, name := range clones {
+		mig.Log.V(1).Info("Create test database", "name", name)
+		err = admin.Exec(ctx, fmt.Sprintf(SQLCreateClone, quoteIdent(name), quoteIdent(template)))
+		if err != nil {
+			return errors.Wrap(err, "Create test database")
+		}
+	}
+
+	var conns []Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close(ctx)
+		}
+	}()
+	var workerMigs []*Migrator
+	for _, name := range clones {
+		w := mig.worker()
+		conn, err := connect(ctx, w, ReplaceDatabase(dsn, name))
+		if err != nil {
+			return errors.Wrap(err, "Connect to "+name)
+		}
+		conns = append(conns, conn)
+		workerMigs = append(workerMigs, w)
+	}
+
+	queue := make(chan *testJob, len(jobs))
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	var stopped int32
+	var wg sync.WaitGroup
+	withHistory := mig.history != nil
+	for i := range workerMigs {
+		wg.Add(1)
+		go func(w *Migrator, conn Conn) {
+			defer wg.Done()
+			for job := range queue {
+				if atomic.LoadInt32(&stopped) == 0 {
+					w.runJob(ctx, conn, job, withHistory)
+				}
+				close(job.done)
+			}
+		}(workerMigs[i], conns[i])
+	}
+	cov, err := mig.mergeResults(jobs, &stopped)
+	wg.Wait()
+	for _, w := range workerMigs {
+		if w.noCommit() {
+			mig.setNoCommit(true)
+		}
+		mig.timings = append(mig.timings, w.timings...)
+	}
+	mig.emitSummary(started)
+	if err != nil || atomic.LoadInt32(&stopped) != 0 || !cfg.Coverage {
+		return err
+	}
+	return errors.Wrap(mig.reportCoverage(cov), "Save coverage")
+}
+
+// prepareTemplate checks pgmig presence and returns tested database name.
+// Connection is closed afterwards because template database must not be accessed while cloning.
+func (mig *Migrator) prepareTemplate(ctx context.Context, connect Connector, dsn string) (string, error) {
+	dbh, err := connect(ctx, mig, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer dbh.Close(ctx)
+	var name string
+	if err = queryValue(dbh, &name, SQLCurrentDB); err != nil {
+		return "", errors.Wrap(err, "Fetch database name")
+	}
+	if err = mig.checkDestructive(dbh, CmdTest); err != nil {
+		return "", err
+	}
+	if err = queryValue(dbh, &mig.installed, SQLPgMigExists, CorePackage, CoreTable); err != nil {
+		return "", errors.Wrap(err, "Check pgmig")
+	}
+	mig.emit(&Status{Exists: mig.installed})
+	return name, nil
+}
+
+// saveParallelHistory saves run history via new connection to tested database
+func (mig *Migrator) saveParallelHistory(ctx context.Context, connect Connector, dsn string, runErr error) error {
+	dbh, err := connect(ctx, mig, dsn)
+	if err != nil {
+		return err
+	}
+	defer dbh.Close(ctx)
+	return mig.SaveHistory(ctx, dbh, runErr)
+}
+
+// mergeResults emits job events in job order keeping their time, adds job files to run history
+// and sums jobs coverage.
+// Job processing is stopped after first error.
+func (mig *Migrator) mergeResults(jobs []*testJob, stopped *int32) (*Coverage, error) {
+	var pkg string
+	cov := &Coverage{}
+	for _, job := range jobs {
+		<-job.done
+		if atomic.LoadInt32(stopped) != 0 {
+			continue
+		}
+		if job.pkg.Name != pkg {
+			pkg = job.pkg.Name
+			mig.emit(&Op{Pkg: pkg, Op: CmdTest})
+			if job.version != "" {
+				mig.emit(&Version{Version: job.version})
+			}
+		}
+		for _, env := range job.events {
+			mig.emitAt(env.Event, env.Time)
+		}
+		for _, f := range job.files {
+			mig.addHistoryFile(f)
+		}
+		if job.err == nil {
+			cov.merge(job.cov)
+			continue
+		}
+		atomic.StoreInt32(stopped, 1)
+		pgErr, ok := job.err.(*DBError)
+		if !ok {
+			return nil, errors.Wrap(job.err, "System error")
+		}
+		mig.emit(&PgError{pgErr})
+		mig.runErr = pgErr
+		mig.setHistoryOutcome(OutcomeError, pgErr)
+	}
+	return cov, nil
+}
+
+// runJob runs test file in separate transaction which is rolled back afterwards.
+// History files are collected if parent run records history
+func (mig *Migrator) runJob(ctx context.Context, conn Conn, job *testJob, withHistory bool) {
+	mig.sinks = []EventSink{SinkFunc(func(e Envelope) {
+		job.events = append(job.events, e)
+	})}
+	if withHistory {
+		mig.history = &RunRecord{}
+	}
+	job.err = mig.runTestFile(ctx, conn, job)
+	if mig.history != nil {
+		job.files = mig.history.Files
+		mig.history = nil
+	}
+}
+
+func (mig *Migrator) runTestFile(ctx context.Context, conn Conn, job *testJob) error {
+	tx, err := conn.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if er := tx.Rollback(ctx); er != nil {
+			mig.Log.Error(er, "Rollback error")
+		}
+	}()
+	if len(mig.Config.Vars) != 0 || mig.varsErr != nil {
+		if err = mig.setVars(tx); err != nil {
+			return err
+		}
+	}
+	if mig.installed {
+		err = queryValue(tx, &job.version, fmt.Sprintf(SQLPkgVersion, CorePackage, mig.Config.PkgVersion), job.pkg.Name)
+		if err != nil {
+			return err
+		}
+	}
+	var covMode coverageMode
+	schemas := pkgSchemas(job.pkg)
+	if mig.Config.Coverage {
+		if covMode, err = mig.startCoverage(tx, schemas); err != nil {
+			return err
+		}
+	}
+	restore, err := mig.applySettings(tx, job.pkg)
+	if err != nil {
+		return err
+	}
+	if err = mig.execFile(tx, job.pkg, job.file); err != nil {
+		return err
+	}
+	if err = restore(); err != nil || !mig.Config.Coverage {
+		return err
+	}
+	job.cov, err = mig.collectCoverage(tx, schemas, covMode)
+	return err
+}
+
+// worker creates Migrator copy with separate notice state.
+// Resolved vars state is shared, so worker sets and hides vars as its parent does
+func (mig *Migrator) worker() *Migrator {
+	return &Migrator{
+		Config:     mig.Config,
+		Root:       mig.Root,
+		Log:        mig.Log,
+		FS:         mig.FS,
+		IsTerminal: mig.IsTerminal,
+		Version:    mig.Version,
+		installed:  mig.installed,
+		varsErr:    mig.varsErr,
+		secrets:    mig.secrets,
+	}
+}
+
+func (mig *Migrator) dropClones(admin Executor, clones []string) {
+	// run context may be canceled already, but clones must be dropped anyway
+	ctx, cancel := context.WithTimeout(context.Background(), dropClonesTimeout)
+	defer cancel()
+	for _, name := range clones {
+		mig.Log.V(1).Info("Drop test database", "name", name)
+		err := admin.Exec(ctx, fmt.Sprintf(SQLDropClone, quoteIdent(name)))
+		if err != nil {
+			mig.Log.Error(err, "Drop test database", "name", name)
+		}
+	}
+}
+
+// cloneName returns name of worker database which fits in PG identifier length
+func cloneName(template string, pid, worker int) string {
+	suffix := fmt.Sprintf("_pgmig_%d_%d", pid, worker)
+	const maxLen = 63
+	if len(template)+len(suffix) > maxLen {
+		template = template[:maxLen-len(suffix)]
+	}
+	return template + suffix
+}
+
+// ReplaceDatabase returns dsn with database name changed.
+// Keyword/value dsn gets dbname appended because last value of keyword is used.
+func ReplaceDatabase(dsn, name string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if u, err := url.Parse(dsn); err == nil {
+			u.Path = "/" + name
+			u.RawPath = ""
+			return u.String()
+		}
+	}
+	return strings.TrimSpace(dsn + " dbname=" + quoteDSNValue(name))
+}
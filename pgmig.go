@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,10 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/jackc/pgconn"
-	"github.com/jackc/pgx/v4"
 	"github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
 
@@ -25,17 +25,20 @@ import (
 
 // Config holds all config vars
 type Config struct {
-	Vars       map[string]string `long:"var" description:"Transaction variable(s)"`
+	Vars       map[string]string `long:"var" description:"Transaction variable(s), value may be @file or env:NAME, use @@ for value started with @"`
 	VarsPrefix string            `long:"var_prefix" default:"pgmig.var." description:"Transaction variable(s) prefix"`
+	VarsFile   string            `long:"vars_file" description:"File with secret transaction variables, name=value per line"`
+	SecretVars []string          `long:"secret_var" description:"Transaction variable(s) whose values are hidden in logs"`
 	//Command string default check
 	NoCommit bool `long:"nocommit" description:"Do not commit work"`
 	ListOnly bool `long:"listonly" description:"Show file list and exit"` // TODO: --dry-run
-	Debug    bool `long:"debug" description:"Print debug info"`           // TODO: process
+	Debug    bool `long:"debug" description:"Print debug info"`
 	Quiet    bool `short:"q" long:"quiet" description:"Do not show messages from DB"`
 
-	// TODO: SearchPath?
+	Settings Settings `group:"Session Options"`
+	Manifest string   `long:"manifest" default:"pgmig.json" description:"Package manifest filename"`
 
-	// TODO: Force    bool   `long:"force" description:"Allow erase command"`
+	Force      bool   `long:"force" description:"Run destructive commands (drop, erase, reinit) without confirmation"`
 	NoHooks    bool   `long:"nohooks" description:"Do not call before/after hooks"`
 	HookBefore string `long:"hook_before" default:"pkg_op_before" description:"Func called before command for every pkg"`
 	HookAfter  string `long:"hook_after" default:"pkg_op_after" description:"Func called after command for every pkg"`
@@ -50,21 +53,62 @@ type Config struct {
 	NewIncludes  []string `long:"new" default:"*.new.sql" description:"File masks loaded on init if package is new"`
 	OnceIncludes []string `long:"once" default:"*.once.sql" description:"File masks loaded once on init"`
 
+	Coverage       bool   `long:"coverage" description:"Collect SQL functions coverage on test (needs track_functions=all or superuser, inlined SQL functions are not counted)"`
+	CoverageFile   string `long:"coverage_file" description:"Save coverage report to file"`
+	CoverageFormat string `long:"coverage_format" default:"text" choice:"text" choice:"lcov" choice:"cobertura" description:"Coverage report file format"`
+
+	SlowFiles   int           `long:"slow_files" default:"5" description:"Show N slowest files after run"`
+	FileTimeout time.Duration `long:"file_timeout" description:"Cancel file run if it takes longer than this (e.g. 30s), statement_timeout is used"`
+	Statements  bool          `long:"statements" description:"Run files statement by statement with statement timing"`
+
+	RetryAttempts int           `long:"retry" default:"0" description:"Retry run N times on lock timeout, serialization failure or deadlock"`
+	RetryDelay    time.Duration `long:"retry_delay" default:"1s" description:"First retry delay, doubled on every retry"`
+	RetryMaxDelay time.Duration `long:"retry_max_delay" default:"30s" description:"Max retry delay"`
+
+	LockBigTable int64         `long:"lock_big_table" default:"104857600" description:"Warn about strong locks on tables larger than N bytes"`
+	LockHotTable int64         `long:"lock_hot_table" default:"100" description:"Warn about strong locks on tables with N scans and modified rows per second"`
+	LockSample   time.Duration `long:"lock_sample" default:"5s" description:"Interval between table activity samples for lock_hot_table"`
+
+	LintDisable []string `long:"lint_disable" description:"Lint rule(s) to skip"`
+	LintFormat  string   `long:"lint_format" default:"text" choice:"text" choice:"json" choice:"sarif" description:"Lint report format"`
+
+	SnapshotFile   string `long:"snapshot_file" default:"pgmig.snapshot" description:"Package schema snapshot filename"`
+	VerifySnapshot bool   `long:"verify_snapshot" description:"Fail init if package schema differs from its snapshot"`
+
 	GitInfo gitinfo.Config `group:"GitInfo Options" namespace:"gi"`
+
+	varsResolved bool
 }
 
 // Migrator holds service data
 type Migrator struct {
-	Config      *Config
-	Root        string
-	Log         logr.Logger
-	FS          FileSystem
-	IsTerminal  bool
-	doRollback  bool
-	installed   bool
-	commitLock  sync.RWMutex
-	cur         int
-	cnt         int
+	Config     *Config
+	Root       string
+	Version    string // app version, saved in run history
+	Log        logr.Logger
+	FS         FileSystem
+	IsTerminal bool
+	Stdin      io.Reader // destructive command confirmation source
+	Stderr     io.Writer // destructive command confirmation prompt
+	doRollback bool
+	installed  bool
+	commitLock sync.RWMutex
+	cur        int
+	cnt        int
+	sinks      []EventSink
+	sinkLock   sync.Mutex
+	seq        int64
+	curPkg     string
+	curFile    string
+	history    *RunRecord
+	timings    []FileTiming
+	runErr     *DBError
+	varsErr    error             // vars resolve error
+	secrets    *strings.Replacer // hides secret var values in events
+	confirmed  string            // destructive command and database confirmed by user
+	// MessageChan receives messages known before event API if set.
+	// It is nil by default, set it before run and read it until run ends, e.g. by PrintMessages.
+	// Deprecated: use AddSink instead.
 	MessageChan chan interface{}
 }
 
@@ -116,18 +160,24 @@ const (
 // New creates an Migrator object
 func New(log logr.Logger, cfg Config, fs FileSystem, root string) *Migrator {
 	mig := Migrator{
-		Config:      &cfg,
-		Log:         log,
-		Root:        root,
-		IsTerminal:  isatty.IsTerminal(os.Stdout.Fd()),
-		MessageChan: make(chan interface{}),
+		Config:     &cfg,
+		Log:        log,
+		Root:       root,
+		IsTerminal: isatty.IsTerminal(os.Stdout.Fd()),
+		Stdin:      os.Stdin,
+		Stderr:     os.Stderr,
 	}
 	if fs == nil {
 		mig.FS = defaultFS{}
 	} else {
 		mig.FS = fs
 	}
-	mig.Log.V(1).Info("CFG", "cfg", cfg)
+	if err := mig.Config.ResolveVars(); err != nil {
+		// returned by setVars
+		mig.varsErr = err
+	}
+	mig.secrets = secretsReplacer(mig.Config.SecretValues())
+	mig.Log.V(1).Info("CFG", "cfg", mig.Config.Redacted())
 	return &mig
 }
 
@@ -138,45 +188,20 @@ type fileDef struct {
 }
 
 type pkgDef struct {
-	Name  string
-	Op    string
-	Root  string
-	Files []fileDef
+	Name     string
+	Op       string
+	Root     string
+	Files    []fileDef
+	Manifest *Manifest
 }
 
-// Run does all work
-func (mig *Migrator) Run(tx pgx.Tx, command string, packages []string) (*bool, error) {
+// RunExec does all work in transaction of given executor.
+// It returns true if transaction should be committed.
+func (mig *Migrator) RunExec(tx Executor, command string, packages []string) (*bool, error) {
 
-	var files []pkgDef
 	cfg := mig.Config
-	empty := []string{}
-	var err error
 	var rv bool
-
-	switch command {
-	case CmdInit:
-		files, err = mig.lookupFiles(command, cfg.InitIncludes, cfg.NewIncludes, cfg.OnceIncludes, false, packages)
-	case CmdTest:
-		files, err = mig.lookupFiles(command, cfg.TestIncludes, empty, empty, false, packages)
-	case CmdDrop:
-		files, err = mig.lookupFiles(command, empty, empty, empty, true, packages)
-	case CmdErase:
-		files, err = mig.lookupFiles(command, empty, empty, empty, true, packages)
-	case CmdReInit:
-		// drop, init
-		files, err = mig.lookupFiles(CmdDrop, empty, empty, empty, true, packages)
-		if err != nil {
-			return &rv, nil
-		}
-		files1, err1 := mig.lookupFiles(CmdInit, cfg.InitIncludes, cfg.NewIncludes, cfg.OnceIncludes, false, packages)
-		if err1 != nil {
-			err = err1
-		} else {
-			files = append(files, files1...)
-		}
-	default:
-		return &rv, errors.New("Unknown command " + command)
-	}
+	files, err := mig.commandFiles(command, packages)
 	if err != nil {
 		return &rv, err
 	}
@@ -190,25 +215,57 @@ func (mig *Migrator) Run(tx pgx.Tx, command string, packages []string) (*bool, e
 		return &rv, nil
 	}
 
+	if err = mig.checkDestructive(tx, command); err != nil {
+		return &rv, err
+	}
 	err = queryValue(tx, &mig.installed, SQLPgMigExists, CorePackage, CoreTable)
 	if err != nil {
 		return &rv, errors.Wrap(err, "Check pgmig")
 	}
-
-	mig.MessageChan <- &Status{Exists: mig.installed}
+	mig.startHistory(command, packages)
+
+	mig.emit(&Status{Exists: mig.installed})
+	defer mig.emitSummary(time.Now())
+	withCoverage := command == CmdTest && cfg.Coverage
+	var covMode coverageMode
+	covSchemas := coverageSchemas(files)
+	if withCoverage {
+		covMode, err = mig.startCoverage(tx, covSchemas)
+		if err != nil {
+			return &rv, err
+		}
+	}
 	err = mig.execFiles(tx, files)
 	if err != nil {
-		pgErr, ok := err.(*pgconn.PgError)
+		pgErr, ok := err.(*DBError)
 		if !ok {
 			return &rv, errors.Wrap(err, "System error")
 		}
-		mig.MessageChan <- pgErr
+		mig.emit(&PgError{pgErr})
+		mig.runErr = pgErr
+		mig.setHistoryOutcome(OutcomeError, pgErr)
 		return &rv, nil
 	}
+	if cfg.VerifySnapshot && (command == CmdInit || command == CmdReInit) {
+		if err = mig.verifySnapshots(tx, files); err != nil {
+			return &rv, err
+		}
+	}
+	if withCoverage {
+		cov, err := mig.collectCoverage(tx, covSchemas, covMode)
+		if err != nil {
+			return &rv, err
+		}
+		if err = mig.reportCoverage(cov); err != nil {
+			return &rv, errors.Wrap(err, "Save coverage")
+		}
+	}
 	if mig.noCommit() || mig.Config.NoCommit || command == CmdTest {
 		rv = false
+		mig.setHistoryOutcome(OutcomeRollback, nil)
 	} else {
 		rv = true
+		mig.setHistoryOutcome(OutcomeCommit, nil)
 	}
 	if err != nil {
 		return &rv, errors.Wrap(err, "End work error")
@@ -216,6 +273,34 @@ func (mig *Migrator) Run(tx pgx.Tx, command string, packages []string) (*bool, e
 	return &rv, nil
 }
 
+// commandFiles returns packages with files to run for command
+func (mig *Migrator) commandFiles(command string, packages []string) (files []pkgDef, err error) {
+	cfg := mig.Config
+	empty := []string{}
+	switch command {
+	case CmdInit:
+		files, err = mig.lookupFiles(command, cfg.InitIncludes, cfg.NewIncludes, cfg.OnceIncludes, false, packages)
+	case CmdTest:
+		files, err = mig.lookupFiles(command, cfg.TestIncludes, empty, empty, false, packages)
+	case CmdDrop:
+		files, err = mig.lookupFiles(command, empty, empty, empty, true, packages)
+	case CmdErase:
+		files, err = mig.lookupFiles(command, empty, empty, empty, true, packages)
+	case CmdReInit:
+		// drop, init
+		files, err = mig.lookupFiles(CmdDrop, empty, empty, empty, true, packages)
+		if err != nil {
+			return
+		}
+		var files1 []pkgDef
+		files1, err = mig.lookupFiles(CmdInit, cfg.InitIncludes, cfg.NewIncludes, cfg.OnceIncludes, false, packages)
+		files = append(files, files1...)
+	default:
+		err = errors.New("Unknown command " + command)
+	}
+	return
+}
+
 // gitinfoFileSystem used for conversion from pgmig.FileSystem to gitinfo.FileSystem
 type gitinfoFileSystem struct {
 	FileSystem
@@ -224,15 +309,23 @@ type gitinfoFileSystem struct {
 // Open like http.FileSystem's Open
 func (fs gitinfoFileSystem) Open(name string) (gitinfo.File, error) { return fs.FileSystem.Open(name) }
 
-func (mig *Migrator) execFiles(tx pgx.Tx, pkgs []pkgDef) (err error) {
-	if len(mig.Config.Vars) != 0 {
+// gitInfo returns git info of package in root
+func (mig *Migrator) gitInfo(root string) (*gitinfo.GitInfo, error) {
+	if gfs, ok := mig.FS.(GitInfoFS); ok {
+		return gfs.GitInfo(root, mig.Config.GitInfo.File)
+	}
+	return gitinfo.New(mig.Log, mig.Config.GitInfo).ReadOrMake(gitinfoFileSystem{mig.FS}, root)
+}
+
+func (mig *Migrator) execFiles(tx Executor, pkgs []pkgDef) (err error) {
+	if len(mig.Config.Vars) != 0 || mig.varsErr != nil {
 		err = mig.setVars(tx)
 		if err != nil {
 			return
 		}
 	}
 	for _, pkg := range pkgs {
-		mig.MessageChan <- &Op{Pkg: pkg.Name, Op: pkg.Op}
+		mig.emit(&Op{Pkg: pkg.Name, Op: pkg.Op})
 		var installedVersion string
 		if mig.installed {
 			err = queryValue(tx, &installedVersion, fmt.Sprintf(SQLPkgVersion, CorePackage, mig.Config.PkgVersion), pkg.Name)
@@ -240,32 +333,35 @@ func (mig *Migrator) execFiles(tx pgx.Tx, pkgs []pkgDef) (err error) {
 				return
 			}
 			if installedVersion != "" {
-				mig.MessageChan <- &Version{Version: installedVersion}
+				mig.emit(&Version{Version: installedVersion})
 			}
 		}
 		pkgExists := (installedVersion != "")
 
-		ctx := context.Background()
 		info := &gitinfo.GitInfo{}
 		if !mig.Config.NoHooks && pkg.Op == CmdInit {
 			// hooks enabled
 			if pkg.Op == CmdInit {
-				info, err = gitinfo.New(mig.Log, mig.Config.GitInfo).ReadOrMake(gitinfoFileSystem{mig.FS}, pkg.Root)
+				info, err = mig.gitInfo(pkg.Root)
 				if err != nil {
 					return
 				}
 				mig.Log.V(1).Info("source git info", "pkg", pkg.Root, "info", info)
-				mig.MessageChan <- &NewVersion{Version: info.Version, Repo: info.Repository}
+				mig.emit(&NewVersion{Version: info.Version, Repo: info.Repository})
+				mig.addHistorySource(pkg.Name, info.Version, info.Repository)
 
 			}
 			if !(pkg.Name == CorePackage && pkg.Op == CmdInit && !pkgExists) {
 				// this is not "init" for new CorePackage
-				if _, err = tx.Exec(ctx, fmt.Sprintf(SQLPkgOp, CorePackage, mig.Config.HookBefore),
-					pkg.Op, pkg.Name, info.Version, info.Repository); err != nil {
+				if err = mig.execHook(tx, mig.Config.HookBefore, pkg, info.Version, info.Repository); err != nil {
 					return
 				}
 			}
 		}
+		var restore func() error
+		if restore, err = mig.applySettings(tx, pkg); err != nil {
+			return
+		}
 		for _, file := range pkg.Files {
 			if file.IfNewPkg {
 				if pkgExists {
@@ -273,14 +369,19 @@ func (mig *Migrator) execFiles(tx pgx.Tx, pkgs []pkgDef) (err error) {
 					continue
 				}
 			}
-			err = mig.execFile(tx, pkg.Root, pkg.Name, file)
+			if err = mig.execFile(tx, pkg, file); err != nil {
+				// transaction is aborted, so next files will not run
+				return
+			}
 			// TODO: if cur != cnt -> warn
 		}
+		if err = restore(); err != nil {
+			return
+		}
 
 		if !mig.Config.NoHooks && pkg.Op != CmdTest {
 			// hooks enabled and this is not drop/erase for CorePackage
-			if _, err := tx.Exec(ctx, fmt.Sprintf(SQLPkgOp, CorePackage, mig.Config.HookAfter),
-				pkg.Op, pkg.Name, info.Version, info.Repository); err != nil {
+			if err := mig.execHook(tx, mig.Config.HookAfter, pkg, info.Version, info.Repository); err != nil {
 				return errors.Wrap(err, "SQLPkgOpAfter")
 			}
 			if pkg.Name == CorePackage && (pkg.Op == CmdDrop || pkg.Op == CmdErase) {
@@ -292,20 +393,15 @@ func (mig *Migrator) execFiles(tx pgx.Tx, pkgs []pkgDef) (err error) {
 	return nil
 }
 
-func (mig *Migrator) execFile(tx pgx.Tx, pkgRoot, pkgName string, file fileDef) error {
-	f := filepath.Join(pkgRoot, file.Name)
-	fh, err := mig.FS.Open(f)
-	if err != nil {
-		return errors.Wrap(err, "Open "+f)
-	}
-	defer fh.Close()
-
-	s, err := ioutil.ReadAll(fh)
+func (mig *Migrator) execFile(tx Executor, pkg pkgDef, file fileDef) error {
+	pkgName := pkg.Name
+	s, err := mig.readFile(pkg, file)
 	if err != nil {
-		return errors.Wrap(err, "Reading "+f)
+		return err
 	}
 
 	ctx := context.Background()
+	md5New := fmt.Sprintf("%x", md5.Sum(s))
 	if file.IfNewFile {
 		var md5Old *string
 		err := queryValue(tx, &md5Old, fmt.Sprintf(SQLScriptProtected, CorePackage, mig.Config.ScriptProtected),
@@ -313,7 +409,6 @@ func (mig *Migrator) execFile(tx pgx.Tx, pkgRoot, pkgName string, file fileDef)
 		if err != nil {
 			return errors.Wrap(err, "SQLScriptProtected")
 		}
-		md5New := fmt.Sprintf("%x", md5.Sum(s))
 		if md5Old != nil {
 			mig.Log.V(1).Info("Skip file because it is loaded already", "file", pkgName+"/"+file.Name)
 			if *md5Old != md5New {
@@ -321,7 +416,7 @@ func (mig *Migrator) execFile(tx pgx.Tx, pkgRoot, pkgName string, file fileDef)
 			}
 			return nil
 		}
-		_, err = tx.Exec(ctx, fmt.Sprintf(SQLScriptProtect, CorePackage, mig.Config.ScriptProtect),
+		err = tx.Exec(ctx, fmt.Sprintf(SQLScriptProtect, CorePackage, mig.Config.ScriptProtect),
 			pkgName, file.Name, md5New)
 		if err != nil {
 			return errors.Wrap(err, "SQLScriptProtect")
@@ -331,22 +426,52 @@ func (mig *Migrator) execFile(tx pgx.Tx, pkgRoot, pkgName string, file fileDef)
 	// TODO: if isTest
 	//  - вызвать test_before/*set-role; set search_path*/ и test_after /*reset role; set search_path*/
 	//  - cur=cnt=0
-	mig.MessageChan <- &RunFile{Name: file.Name}
+	mig.emit(&RunFile{Name: file.Name})
 	query := string(s)
-	_, err = tx.Exec(ctx, query)
+	started := time.Now()
+	err = mig.withFileTimeout(tx, func(limit func() error) error {
+		if mig.Config.Statements {
+			return mig.execStatements(ctx, tx, query, limit)
+		}
+		if err := limit(); err != nil {
+			return err
+		}
+		return tx.Exec(ctx, query)
+	})
+	duration := time.Since(started)
+	mig.addHistoryFile(FileRecord{Pkg: pkgName, Op: pkg.Op, File: file.Name, MD5: md5New,
+		Started: started, Duration: duration})
+	mig.addTiming(pkgName, file.Name, duration, err != nil)
 	if err != nil {
-		pgErr, ok := err.(*pgconn.PgError)
+		pgErr, ok := err.(*DBError)
 		if !ok {
 			return errors.Wrap(err, "System error")
 		}
 		// PG does not know about file. Set it and calc lime no
 		pgErr.File = file.Name
-		pgErr.Line = int32(strings.Count(string([]rune(query)[:pgErr.Position]), "\n") + 1)
+		if !mig.Config.Statements {
+			pgErr.Line = int32(positionLine(query, pgErr.Position))
+		}
 		return pgErr
 	}
 	return nil
 }
 
+// readFile returns package file content
+func (mig *Migrator) readFile(pkg pkgDef, file fileDef) ([]byte, error) {
+	f := filepath.Join(pkg.Root, file.Name)
+	fh, err := mig.FS.Open(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open "+f)
+	}
+	defer fh.Close()
+	s, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading "+f)
+	}
+	return s, nil
+}
+
 // lookup files in mig.FS
 func (mig *Migrator) lookupFiles(op string, masks []string, initMasks []string, onceMasks []string, isReverse bool, packages []string) (rv []pkgDef, err error) {
 	pkgs := append(packages[:0:0], packages...) // Copy slice. See https://github.com/go101/go101/wiki
@@ -357,8 +482,12 @@ func (mig *Migrator) lookupFiles(op string, masks []string, initMasks []string,
 	for _, pkg := range pkgs {
 		root := filepath.Join(mig.Root, pkg)
 		var files []fileDef
+		var manifest *Manifest
+		if manifest, err = mig.readManifest(root); err != nil {
+			return
+		}
 		if len(masks) == 0 {
-			rv = append(rv, pkgDef{Name: pkg, Op: op, Root: root, Files: files})
+			rv = append(rv, pkgDef{Name: pkg, Op: op, Root: root, Files: files, Manifest: manifest})
 			continue
 		}
 		mig.Log.V(1).Info("Looking in pkg for masks", "pkg", pkg, "masks", masks)
@@ -371,7 +500,7 @@ func (mig *Migrator) lookupFiles(op string, masks []string, initMasks []string,
 			sort.Slice(files, func(i, j int) bool {
 				return files[i].Name < files[j].Name
 			})
-			rv = append(rv, pkgDef{Name: pkg, Op: op, Root: root, Files: files})
+			rv = append(rv, pkgDef{Name: pkg, Op: op, Root: root, Files: files, Manifest: manifest})
 		} else {
 			mig.Log.Info("Package pkg does not contain", "pkg", pkg, "masks", masks)
 		}
@@ -379,26 +508,23 @@ func (mig *Migrator) lookupFiles(op string, masks []string, initMasks []string,
 	return
 }
 
-// ProcessNotice receives PG notices with test metadata and plain
-// TODO: add multiprocess support?
+// ProcessNotice receives PG notices with test metadata and plain.
+// Parallel runs use separate Migrator per connection, see RunParallelIn
 func (mig *Migrator) ProcessNotice(code, message, detail string) {
-	if mig.MessageChan == nil {
-		return
-	}
 	switch code {
 	case pgStatusTestCount:
 		mig.cnt, _ = strconv.Atoi(message)
 		mig.cur = 0
-		mig.MessageChan <- &TestCount{Count: mig.cnt}
+		mig.emit(&TestCount{Count: mig.cnt})
 		//			notices = []pgx.Notice{}
 	case pgStatusTestOk:
 		mig.cur++
-		mig.MessageChan <- &TestOk{Current: mig.cur, Message: message}
+		mig.emit(&TestOk{Current: mig.cur, Message: message})
 		//			notices = []pgx.Notice{}
 	case pgStatusTestFail:
 		mig.cur++
 		// TODO: send to channel {Type:.., Message: []string}
-		mig.MessageChan <- &TestFail{Current: mig.cur, Message: message, Detail: detail}
+		mig.emit(&TestFail{Current: mig.cur, Message: message, Detail: detail})
 		//			if len(notices) > 0 {
 		//				fmt.Println(notices)
 		//			}
@@ -483,9 +609,12 @@ func (mig *Migrator) noCommit() bool {
 	return mig.doRollback
 }
 
-func (mig *Migrator) setVars(tx pgx.Tx) error {
+func (mig *Migrator) setVars(tx Executor) error {
+	if mig.varsErr != nil {
+		return mig.varsErr
+	}
 	ctx := context.Background()
-	mig.Log.V(1).Info("Setting vars", "vars", mig.Config.Vars)
+	mig.Log.V(1).Info("Setting vars", "vars", mig.Config.redactedVars())
 	var varPrefix *string // pgx.NullString
 	err := queryValue(tx, &varPrefix, SQLPgMigVar, CorePrefix)
 	if err != nil {
@@ -493,7 +622,7 @@ func (mig *Migrator) setVars(tx pgx.Tx) error {
 	}
 	if varPrefix == nil {
 		varPrefix = &mig.Config.VarsPrefix
-		_, err := tx.Exec(ctx, SQLSetVar, CorePrefix, "", *varPrefix)
+		err := tx.Exec(ctx, SQLSetVar, CorePrefix, "", *varPrefix)
 		if err != nil {
 			return errors.Wrap(err, "Set_config error")
 		}
@@ -502,8 +631,12 @@ func (mig *Migrator) setVars(tx pgx.Tx) error {
 		if v == "" {
 			continue
 		}
-		mig.Log.V(1).Info("Set var", "name", k, "value", v)
-		_, err := tx.Exec(ctx, SQLSetVar, varPrefix, k, v)
+		if mig.Config.IsSecretVar(k) {
+			mig.Log.V(1).Info("Set var", "name", k, "value", RedactedValue)
+		} else {
+			mig.Log.V(1).Info("Set var", "name", k, "value", v)
+		}
+		err := tx.Exec(ctx, SQLSetVar, varPrefix, k, v)
 		if err != nil {
 			return errors.Wrap(err, "Set_config error")
 		}
@@ -512,12 +645,12 @@ func (mig *Migrator) setVars(tx pgx.Tx) error {
 }
 
 // queryValue fills rv with single valued SQL result if present
-func queryValue(tx pgx.Tx, rv interface{}, sql string, arguments ...interface{}) error {
+func queryValue(tx Executor, rv interface{}, sql string, arguments ...interface{}) error {
 	rows, err := tx.Query(context.Background(), sql, arguments...)
-	defer func() { rows.Close() }()
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 	if rows.Next() {
 		err = rows.Scan(rv)
 		if err != nil {
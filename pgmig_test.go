@@ -92,7 +92,7 @@ func (ss *ServerSuite) TestRun() {
 		ex.Exec(ctx, fmt.Sprintf(SQLPkgOp, CorePackage, mig.Config.HookAfter), "init", "a", gi.Version, gi.Repository),
 	)
 	mig.MessageChan = make(chan interface{}, 8)
-	commit, err := mig.Run(tx, "init", []string{"a"}) // []string{"a", "b"})
+	commit, err := mig.RunExec(wrapTx(tx), "init", []string{"a"}) // []string{"a", "b"})
 	close(mig.MessageChan)
 	//	ss.printLogs()
 	assert.Nil(ss.T(), err)
@@ -0,0 +1,194 @@
+// Package pgmigotel holds pgmig event sink which makes OpenTelemetry spans.
+// Span tree is run > package op > (hook | file > statement), statement spans are made in statement mode only.
+// Span times are taken from event times, so buffered events of multi database runs have approximate times.
+package pgmigotel
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pgmig/pgmig"
+)
+
+// Attribute keys
+const (
+	AttrCommand    = attribute.Key("pgmig.command")
+	AttrPackages   = attribute.Key("pgmig.packages")
+	AttrOutcome    = attribute.Key("pgmig.outcome")
+	AttrTarget     = attribute.Key("pgmig.target")
+	AttrInstalled  = attribute.Key("pgmig.installed")
+	AttrPackage    = attribute.Key("pgmig.package")
+	AttrOp         = attribute.Key("pgmig.op")
+	AttrVersion    = attribute.Key("pgmig.version")
+	AttrNewVersion = attribute.Key("pgmig.new_version")
+	AttrRepo       = attribute.Key("pgmig.repo")
+	AttrHook       = attribute.Key("pgmig.hook")
+	AttrFile       = attribute.Key("pgmig.file")
+	AttrLine       = attribute.Key("pgmig.line")
+	AttrStatement  = attribute.Key("db.query.text")
+	AttrSQLState   = attribute.Key("db.response.status_code")
+)
+
+// Sink makes spans from Migrator events.
+type Sink struct {
+	parent  context.Context
+	tracer  trace.Tracer
+	target  string
+	run     trace.Span
+	runCtx  context.Context
+	pkg     trace.Span
+	pkgCtx  context.Context
+	file    trace.Span
+	fileCtx context.Context
+}
+
+// NewSink returns sink which makes spans via tracer as children of ctx span if any.
+func NewSink(ctx context.Context, tracer trace.Tracer) *Sink {
+	return &Sink{parent: ctx, tracer: tracer}
+}
+
+// Emit updates spans by event
+func (s *Sink) Emit(e pgmig.Envelope) {
+	switch v := e.Event.(type) {
+	case *pgmig.TargetStart:
+		s.endRun(e.Time)
+		s.target = v.Target
+	case *pgmig.TargetDone:
+		s.endRun(e.Time)
+		s.target = ""
+	case *pgmig.Status:
+		s.startRun(e.Time)
+		s.run.SetAttributes(AttrInstalled.Bool(v.Exists))
+	case *pgmig.Op:
+		s.startRun(e.Time)
+		s.endPkg(e.Time)
+		s.pkgCtx, s.pkg = s.tracer.Start(s.runCtx, "pgmig "+v.Op+" "+v.Pkg, trace.WithTimestamp(e.Time),
+			trace.WithAttributes(AttrPackage.String(v.Pkg), AttrOp.String(v.Op)))
+	case *pgmig.Version:
+		if s.pkg != nil {
+			s.pkg.SetAttributes(AttrVersion.String(v.Version))
+		}
+	case *pgmig.NewVersion:
+		if s.pkg != nil {
+			s.pkg.SetAttributes(AttrNewVersion.String(v.Version), AttrRepo.String(v.Repo))
+		}
+	case *pgmig.HookDone:
+		if s.pkg != nil {
+			_, span := s.tracer.Start(s.pkgCtx, "pgmig hook "+v.Hook, trace.WithTimestamp(e.Time.Add(-v.Duration)),
+				trace.WithAttributes(AttrHook.String(v.Hook), AttrPackage.String(v.Pkg)))
+			span.End(trace.WithTimestamp(e.Time))
+		}
+	case *pgmig.RunFile:
+		if s.pkg != nil {
+			s.endFile(e.Time)
+			s.fileCtx, s.file = s.tracer.Start(s.pkgCtx, "pgmig file "+v.Name, trace.WithTimestamp(e.Time),
+				trace.WithAttributes(AttrPackage.String(e.Package), AttrFile.String(v.Name)))
+		}
+	case *pgmig.StatementDone:
+		if s.file != nil {
+			_, span := s.tracer.Start(s.fileCtx, "pgmig statement "+statementName(v.Statement),
+				trace.WithTimestamp(e.Time.Add(-v.Duration)),
+				trace.WithAttributes(AttrLine.Int(v.Line), AttrStatement.String(v.Statement)))
+			span.End(trace.WithTimestamp(e.Time))
+		}
+	case *pgmig.FileDone:
+		s.endFile(e.Time)
+	case *pgmig.TestOk:
+		if s.file != nil {
+			s.file.AddEvent("test ok", trace.WithTimestamp(e.Time),
+				trace.WithAttributes(attribute.String("message", v.Message)))
+		}
+	case *pgmig.TestFail:
+		if s.file != nil {
+			s.file.AddEvent("test fail", trace.WithTimestamp(e.Time),
+				trace.WithAttributes(attribute.String("message", v.Message), attribute.String("detail", v.Detail)))
+			s.file.SetStatus(codes.Error, "test failed")
+		}
+	case *pgmig.Retry:
+		if s.run != nil {
+			s.run.AddEvent("retry", trace.WithTimestamp(e.Time), trace.WithAttributes(
+				attribute.Int("attempt", v.Attempt), AttrSQLState.String(v.Code), attribute.String("delay", v.Delay.String())))
+		}
+	case *pgmig.PgError:
+		for _, span := range []trace.Span{s.file, s.pkg, s.run} {
+			if span != nil {
+				span.SetAttributes(AttrSQLState.String(v.Code))
+				span.SetStatus(codes.Error, v.Message)
+			}
+		}
+		if s.file != nil {
+			s.file.RecordError(v.DBError, trace.WithTimestamp(e.Time))
+		}
+		s.endFile(e.Time)
+	case *pgmig.Summary:
+		s.endFile(e.Time)
+		s.endPkg(e.Time)
+	case *pgmig.RunDone:
+		s.startRun(e.Time)
+		s.run.SetName("pgmig " + v.Command)
+		s.run.SetAttributes(AttrCommand.String(v.Command), AttrPackages.StringSlice(v.Packages),
+			AttrOutcome.String(v.Outcome))
+		if v.Outcome == pgmig.OutcomeError {
+			s.run.SetStatus(codes.Error, v.Error)
+		}
+		s.endRun(e.Time)
+	}
+}
+
+// Close ends all open spans
+func (s *Sink) Close() error {
+	s.endRun(time.Now())
+	return nil
+}
+
+// startRun starts run span if it is not started
+func (s *Sink) startRun(t time.Time) {
+	if s.run != nil {
+		return
+	}
+	opts := []trace.SpanStartOption{trace.WithTimestamp(t)}
+	if s.target != "" {
+		opts = append(opts, trace.WithAttributes(AttrTarget.String(s.target)))
+	}
+	s.runCtx, s.run = s.tracer.Start(s.parent, "pgmig run", opts...)
+}
+
+// endFile ends file span if any
+func (s *Sink) endFile(t time.Time) {
+	if s.file != nil {
+		s.file.End(trace.WithTimestamp(t))
+		s.file, s.fileCtx = nil, nil
+	}
+}
+
+// endPkg ends package op span and its file span if any
+func (s *Sink) endPkg(t time.Time) {
+	s.endFile(t)
+	if s.pkg != nil {
+		s.pkg.End(trace.WithTimestamp(t))
+		s.pkg, s.pkgCtx = nil, nil
+	}
+}
+
+// endRun ends run span and its children if any
+func (s *Sink) endRun(t time.Time) {
+	s.endPkg(t)
+	if s.run != nil {
+		s.run.End(trace.WithTimestamp(t))
+		s.run, s.runCtx = nil, nil
+	}
+}
+
+// statementName returns statement kind for span name, e.g. "CREATE TABLE"
+func statementName(st string) string {
+	f := strings.Fields(st)
+	if len(f) > 2 {
+		f = f[:2]
+	}
+	return strings.ToUpper(strings.Join(f, " "))
+}
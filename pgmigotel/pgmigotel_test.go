@@ -0,0 +1,88 @@
+package pgmigotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pgmig/pgmig"
+)
+
+func TestSink(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	sink := NewSink(trace.ContextWithRemoteSpanContext(context.Background(), parent), tp.Tracer("test"))
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []pgmig.Event{
+		&pgmig.Status{Exists: true},
+		&pgmig.Op{Pkg: "a", Op: "init"},
+		&pgmig.Version{Version: "v1"},
+		&pgmig.HookDone{Hook: "pkg_op_before", Pkg: "a", Duration: time.Second},
+		&pgmig.RunFile{Name: "01_a.sql"},
+		&pgmig.StatementDone{Line: 3, Statement: "create table a.t (id int)", Duration: time.Second},
+		&pgmig.FileDone{Name: "01_a.sql", Duration: 2 * time.Second},
+		&pgmig.RunFile{Name: "02_a.sql"},
+		&pgmig.PgError{DBError: &pgmig.DBError{Code: "42P01", Message: "relation does not exist"}},
+		&pgmig.Summary{},
+		&pgmig.RunDone{Command: "init", Packages: []string{"a"}, Outcome: pgmig.OutcomeError, Error: "failed"},
+	}
+	for i, ev := range events {
+		sink.Emit(pgmig.Envelope{Time: start.Add(time.Duration(i) * time.Second), Package: "a", Event: ev})
+	}
+	require.NoError(t, sink.Close())
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	names := []string{"pgmig init", "pgmig init a", "pgmig hook pkg_op_before", "pgmig file 01_a.sql",
+		"pgmig statement CREATE TABLE", "pgmig file 02_a.sql"}
+	require.Len(t, spans, len(names))
+	for _, name := range names {
+		require.Contains(t, spans, name)
+	}
+	run, pkg := spans["pgmig init"], spans["pgmig init a"]
+	assert.Equal(t, parent.TraceID(), run.SpanContext().TraceID())
+	assert.Equal(t, parent.SpanID(), run.Parent().SpanID())
+	assert.Equal(t, run.SpanContext().SpanID(), pkg.Parent().SpanID())
+	assert.Equal(t, pkg.SpanContext().SpanID(), spans["pgmig hook pkg_op_before"].Parent().SpanID())
+	assert.Equal(t, spans["pgmig file 01_a.sql"].SpanContext().SpanID(),
+		spans["pgmig statement CREATE TABLE"].Parent().SpanID())
+
+	assert.Equal(t, start, run.StartTime())
+	assert.Equal(t, start.Add(10*time.Second), run.EndTime())
+	assert.Equal(t, start.Add(2*time.Second), spans["pgmig hook pkg_op_before"].StartTime())
+	assert.Contains(t, pkg.Attributes(), AttrVersion.String("v1"))
+	assert.Contains(t, run.Attributes(), AttrOutcome.String(pgmig.OutcomeError))
+
+	failed := spans["pgmig file 02_a.sql"]
+	assert.Equal(t, codes.Error, failed.Status().Code)
+	assert.Contains(t, failed.Attributes(), AttrSQLState.String("42P01"))
+	assert.Equal(t, start.Add(8*time.Second), failed.EndTime())
+	assert.Equal(t, codes.Unset, spans["pgmig file 01_a.sql"].Status().Code)
+}
+
+func TestSinkClose(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	sink := NewSink(context.Background(), tp.Tracer("test"))
+	sink.Emit(pgmig.Envelope{Time: time.Now(), Event: &pgmig.Op{Pkg: "a", Op: "test"}})
+	sink.Emit(pgmig.Envelope{Time: time.Now(), Event: &pgmig.RunFile{Name: "01_a.test.sql"}})
+	assert.Empty(t, rec.Ended())
+	require.NoError(t, sink.Close())
+	assert.Len(t, rec.Ended(), 3)
+}
@@ -0,0 +1,256 @@
+// Package pgmigtest holds helpers for running pgmig packages inside go test.
+//
+// Typical usage:
+//
+//	func TestDB(t *testing.T) {
+//		dsn := os.Getenv("TEST_DSN_PG")
+//		if dsn == "" {
+//			t.Skip("Skipping testing when DSN is empty")
+//		}
+//		fs := pgmigtest.Dir("sql")
+//		db := pgmigtest.Migrate(t, dsn, fs, "pgmig", "app")
+//		pgmigtest.RunSQLTests(t, db, fs, "app")
+//	}
+package pgmigtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jackc/pgx/v4"
+	"github.com/jessevdk/go-flags"
+	"github.com/wojas/genericr"
+
+	"github.com/pgmig/pgmig"
+	"github.com/pgmig/pgmig/pgxv4"
+)
+
+const (
+	// DBPrefix is the prefix of created database names
+	DBPrefix = "pgmigtest_"
+
+	// SQLCreateDB creates test database
+	SQLCreateDB = "CREATE DATABASE %s"
+	// SQLDropDB drops test database
+	SQLDropDB = "DROP DATABASE IF EXISTS %s"
+)
+
+// Dir is a pgmig.FileSystem which holds packages in OS directory.
+type Dir string
+
+// Walk walks through package directory
+func (d Dir) Walk(root string, wf filepath.WalkFunc) error {
+	fh, err := d.Open(root)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	files, err := fh.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			if err := wf(root, file, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open opens file inside directory
+func (d Dir) Open(name string) (pgmig.File, error) { return os.Open(filepath.Join(string(d), name)) }
+
+// Config returns pgmig.Config filled with default values.
+func Config() pgmig.Config {
+	cfg := pgmig.Config{}
+	p := flags.NewParser(&cfg, flags.IgnoreUnknown)
+	if _, err := p.ParseArgs([]string{}); err != nil {
+		panic(err) // defaults are hardcoded so this should not happen
+	}
+	return cfg
+}
+
+// Migrate creates database via dsn connection, runs init command for packages there
+// and returns DSN of created database. Database is dropped when test and all its subtests complete.
+func Migrate(t testing.TB, dsn string, fs pgmig.FileSystem, packages ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	name := dbName(t.Name(), time.Now())
+
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer admin.Close(ctx)
+	if _, err = admin.Exec(ctx, fmt.Sprintf(SQLCreateDB, pgx.Identifier{name}.Sanitize())); err != nil {
+		t.Fatalf("Create database: %v", err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			t.Errorf("Connect: %v", err)
+			return
+		}
+		defer conn.Close(ctx)
+		if _, err = conn.Exec(ctx, fmt.Sprintf(SQLDropDB, pgx.Identifier{name}.Sanitize())); err != nil {
+			t.Errorf("Drop database %s: %v", name, err)
+		}
+	})
+	dbDSN := pgmig.ReplaceDatabase(dsn, name)
+
+	events, commit, err := run(t, dbDSN, fs, pgmig.CmdInit, packages)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if !commit {
+		for _, ev := range events {
+			if e, ok := ev.(*pgmig.PgError); ok {
+				t.Fatalf("Init: %s:%d %s %s", e.File, e.Line, e.Code, e.Message)
+			}
+		}
+		t.Fatal("Init: not committed")
+	}
+	return dbDSN
+}
+
+// RunSQLTests runs test command for packages and maps every test file to go subtest
+// and every SQL test assertion to subtest of file subtest.
+// Test transaction is rolled back afterwards.
+func RunSQLTests(t *testing.T, dsn string, fs pgmig.FileSystem, packages ...string) {
+	t.Helper()
+	events, _, err := run(t, dsn, fs, pgmig.CmdTest, packages)
+	if err != nil {
+		t.Fatalf("Test: %v", err)
+	}
+	for _, f := range groupResults(events) {
+		f := f
+		t.Run(f.Name, func(t *testing.T) {
+			for _, a := range f.Asserts {
+				a := a
+				t.Run(a.Message, func(t *testing.T) {
+					if a.Fail {
+						t.Error(a.Detail)
+					}
+				})
+			}
+			if f.Count != len(f.Asserts) {
+				t.Errorf("Wrong tests count: got %d, want %d", len(f.Asserts), f.Count)
+			}
+			if e := f.Err; e != nil {
+				t.Errorf("%s:%d %s %s %s", e.File, e.Line, e.Severity, e.Code, e.Message)
+			}
+		})
+	}
+}
+
+// run runs command in transaction and returns Migrator events
+func run(t testing.TB, dsn string, fs pgmig.FileSystem, command string, packages []string) ([]pgmig.Event, bool, error) {
+	ctx := context.Background()
+	cfg := Config()
+	if d, ok := fs.(Dir); ok {
+		cfg.GitInfo.Root = string(d)
+	}
+	mig := pgmig.New(logger(t), cfg, fs, "")
+	dbh, err := pgxv4.Connect(ctx, mig, dsn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer dbh.Close(ctx)
+	tx, err := dbh.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		if er := tx.Rollback(ctx); er != nil && er != pgx.ErrTxClosed {
+			t.Errorf("Rollback: %v", er)
+		}
+	}()
+
+	var events []pgmig.Event
+	mig.AddSink(pgmig.SinkFunc(func(e pgmig.Envelope) {
+		events = append(events, e.Event)
+	}))
+	commit, err := pgxv4.Run(mig, tx, command, packages)
+	if err == nil && *commit {
+		err = tx.Commit(ctx)
+	}
+	return events, commit != nil && *commit && err == nil, err
+}
+
+// logger returns logr.Logger which writes to test log
+func logger(t testing.TB) logr.Logger {
+	return logr.New(genericr.New(func(e genericr.Entry) {
+		t.Log(e.String())
+	}))
+}
+
+// assertResult holds single SQL test assertion result
+type assertResult struct {
+	Message string
+	Detail  string
+	Fail    bool
+}
+
+// fileResult holds SQL test file results
+type fileResult struct {
+	Name    string
+	Count   int
+	Asserts []assertResult
+	Err     *pgmig.DBError
+}
+
+// groupResults groups Migrator events by test files
+func groupResults(events []pgmig.Event) (rv []*fileResult) {
+	var pkg string
+	var cur *fileResult
+	for _, ev := range events {
+		switch v := ev.(type) {
+		case *pgmig.Op:
+			pkg = v.Pkg
+		case *pgmig.RunFile:
+			cur = &fileResult{Name: pkg + "/" + v.Name}
+			rv = append(rv, cur)
+		case *pgmig.TestCount:
+			if cur != nil {
+				cur.Count = v.Count
+			}
+		case *pgmig.TestOk:
+			if cur != nil {
+				cur.Asserts = append(cur.Asserts, assertResult{Message: v.Message})
+			}
+		case *pgmig.TestFail:
+			if cur != nil {
+				cur.Asserts = append(cur.Asserts, assertResult{Message: v.Message, Detail: v.Detail, Fail: true})
+			}
+		case *pgmig.PgError:
+			if cur == nil {
+				cur = &fileResult{Name: pkg}
+				rv = append(rv, cur)
+			}
+			cur.Err = v.DBError
+		}
+	}
+	return
+}
+
+var reNonIdent = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// dbName returns database name made from test name which fits in PG identifier length
+func dbName(testName string, ts time.Time) string {
+	suffix := fmt.Sprintf("_%d", ts.UnixNano()%1e9)
+	name := DBPrefix + reNonIdent.ReplaceAllString(strings.ToLower(testName), "_")
+	const maxLen = 63
+	if len(name)+len(suffix) > maxLen {
+		name = name[:maxLen-len(suffix)]
+	}
+	return name + suffix
+}
@@ -0,0 +1,70 @@
+package pgmigtest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pgmig/pgmig"
+)
+
+func TestConfig(t *testing.T) {
+	cfg := Config()
+	assert.Equal(t, []string{"*.test.sql"}, cfg.TestIncludes)
+	assert.Equal(t, "pkg_op_before", cfg.HookBefore)
+}
+
+func TestDir(t *testing.T) {
+	fs := Dir("../testdata")
+	names := []string{}
+	err := fs.Walk("b", func(path string, f os.FileInfo, err error) error {
+		names = append(names, f.Name())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"pgmig.json", "00.init.sql", "01_ddl.sql"}, names)
+
+	fh, err := fs.Open("b/01_ddl.sql")
+	require.NoError(t, err)
+	defer fh.Close()
+	got, err := ioutil.ReadAll(fh)
+	require.NoError(t, err)
+	want, err := ioutil.ReadFile("../testdata/b/01_ddl.sql")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestDBName(t *testing.T) {
+	ts := time.Unix(0, 1234)
+	assert.Equal(t, "pgmigtest_testdbname_sub_test_1234", dbName("TestDBName/sub-test", ts))
+	got := dbName(strings.Repeat("x", 70), ts)
+	assert.Equal(t, 63, len(got))
+	assert.True(t, strings.HasSuffix(got, "_1234"))
+}
+
+func TestGroupResults(t *testing.T) {
+	pgErr := &pgmig.DBError{Message: "error"}
+	events := []pgmig.Event{
+		&pgmig.Status{Exists: true},
+		&pgmig.Op{Pkg: "a", Op: pgmig.CmdTest},
+		&pgmig.RunFile{Name: "01.test.sql"},
+		&pgmig.TestCount{Count: 2},
+		&pgmig.TestOk{Current: 1, Message: "ok"},
+		&pgmig.TestFail{Current: 2, Message: "fail", Detail: "detail"},
+		&pgmig.RunFile{Name: "02.test.sql"},
+		&pgmig.PgError{DBError: pgErr},
+	}
+	want := []*fileResult{
+		{Name: "a/01.test.sql", Count: 2, Asserts: []assertResult{
+			{Message: "ok"},
+			{Message: "fail", Detail: "detail", Fail: true},
+		}},
+		{Name: "a/02.test.sql", Err: pgErr},
+	}
+	assert.Equal(t, want, groupResults(events))
+}
@@ -0,0 +1,194 @@
+// Package pgxv4 holds pgmig executor adapters and runners for pgx v4 transactions and connections.
+// PG errors are converted to pgmig errors, notices are passed to Migrator via OnNotice handler.
+package pgxv4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/pgmig/pgmig"
+)
+
+// querier is implemented by pgx v4 Tx and Conn
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// Beginner starts transactions, e.g. *pgx.Conn.
+type Beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+type executor struct {
+	q querier
+}
+
+func (e executor) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	_, err := e.q.Exec(ctx, sql, args...)
+	return Error(err)
+}
+
+func (e executor) Query(ctx context.Context, sql string, args ...interface{}) (pgmig.Rows, error) {
+	r, err := e.q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, Error(err)
+	}
+	return rows{r}, nil
+}
+
+type rows struct {
+	pgx.Rows
+}
+
+func (r rows) Err() error { return Error(r.Rows.Err()) }
+
+type tx struct {
+	executor
+	tx pgx.Tx
+}
+
+func (t tx) Commit(ctx context.Context) error { return Error(t.tx.Commit(ctx)) }
+
+func (t tx) Rollback(ctx context.Context) error {
+	if err := t.tx.Rollback(ctx); !errors.Is(err, pgx.ErrTxClosed) {
+		return Error(err)
+	}
+	return nil
+}
+
+type beginner struct {
+	b Beginner
+}
+
+func (b beginner) BeginTx(ctx context.Context) (pgmig.TxExecutor, error) {
+	t, err := b.b.Begin(ctx)
+	if err != nil {
+		return nil, Error(err)
+	}
+	return WrapTx(t), nil
+}
+
+type conn struct {
+	executor
+	beginner
+	conn *pgx.Conn
+}
+
+func (c conn) Close(ctx context.Context) error { return c.conn.Close(ctx) }
+
+// WrapTx returns executor for pgx v4 transaction
+func WrapTx(t pgx.Tx) pgmig.TxExecutor {
+	return tx{executor{t}, t}
+}
+
+// WrapBeginner returns transaction starter for pgx v4 Beginner
+func WrapBeginner(b Beginner) pgmig.TxStarter {
+	return beginner{b}
+}
+
+// WrapConn returns pgmig.Conn for pgx v4 connection.
+// Notices are processed if connection was made by Connect.
+func WrapConn(c *pgx.Conn) pgmig.Conn {
+	return conn{executor{c}, beginner{c}, c}
+}
+
+// OnNotice returns notice handler which passes notices to mig.
+// Use it as pgx.ConnConfig.OnNotice.
+func OnNotice(mig *pgmig.Migrator) pgconn.NoticeHandler {
+	return func(_ *pgconn.PgConn, n *pgconn.Notice) {
+		mig.ProcessNotice(n.Code, n.Message, n.Detail)
+	}
+}
+
+// Connect makes connection which passes notices to mig
+func Connect(ctx context.Context, mig *pgmig.Migrator, dsn string) (*pgx.Conn, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.OnNotice = OnNotice(mig)
+	config.BuildStatementCache = nil // disable stmt cache for `reinit pgmig`
+	return pgx.ConnectConfig(ctx, config)
+}
+
+// Connector is the pgmig.Connector for pgx v4
+func Connector(ctx context.Context, mig *pgmig.Migrator, dsn string) (pgmig.Conn, error) {
+	c, err := Connect(ctx, mig, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return WrapConn(c), nil
+}
+
+// Run does all work in pgx v4 transaction, see Migrator.RunExec
+func Run(mig *pgmig.Migrator, t pgx.Tx, command string, packages []string) (*bool, error) {
+	return mig.RunExec(WrapTx(t), command, packages)
+}
+
+// RunTx runs command in transaction started via db, see Migrator.RunIn
+func RunTx(ctx context.Context, mig *pgmig.Migrator, db Beginner, command string, packages []string) (bool, error) {
+	return mig.RunIn(ctx, WrapBeginner(db), command, packages)
+}
+
+// RunParallel runs tests in databases cloned from dsn database, see Migrator.RunParallelIn
+func RunParallel(ctx context.Context, mig *pgmig.Migrator, dsn string, packages []string, workers int) error {
+	return mig.RunParallelIn(ctx, Connector, dsn, packages, workers)
+}
+
+// RunTargets runs command in all targets, see Migrator.RunTargetsIn
+func RunTargets(ctx context.Context, mig *pgmig.Migrator, targets []pgmig.Target, command string, packages []string,
+	opts pgmig.MultiOptions) (*pgmig.MultiReport, error) {
+	return mig.RunTargetsIn(ctx, Connector, targets, command, packages, opts)
+}
+
+// Diff compares package schemas of from and to sources, see Migrator.DiffIn
+func Diff(ctx context.Context, mig *pgmig.Migrator, from, to string, packages []string) ([]*pgmig.Diff, error) {
+	return mig.DiffIn(ctx, Connector, from, to, packages)
+}
+
+// NewTarget returns target named as host/database of dsn
+func NewTarget(dsn string) (pgmig.Target, error) {
+	config, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return pgmig.Target{}, err
+	}
+	return pgmig.Target{Name: fmt.Sprintf("%s:%d/%s", config.Host, config.Port, config.Database), DSN: dsn}, nil
+}
+
+// ReadTargets reads DSNs from r, one per line, see pgmig.ReadTargets
+func ReadTargets(r io.Reader) ([]pgmig.Target, error) {
+	return pgmig.ReadTargets(r, NewTarget)
+}
+
+// Error converts pgx v4 PG error to the type used by pgmig, other errors are returned as is
+func Error(err error) error {
+	var e *pgconn.PgError
+	if !errors.As(err, &e) {
+		return err
+	}
+	return &pgmig.DBError{
+		Severity:         e.Severity,
+		Code:             e.Code,
+		Message:          e.Message,
+		Detail:           e.Detail,
+		Hint:             e.Hint,
+		Position:         e.Position,
+		InternalPosition: e.InternalPosition,
+		InternalQuery:    e.InternalQuery,
+		Where:            e.Where,
+		SchemaName:       e.SchemaName,
+		TableName:        e.TableName,
+		ColumnName:       e.ColumnName,
+		DataTypeName:     e.DataTypeName,
+		ConstraintName:   e.ConstraintName,
+		File:             e.File,
+		Line:             e.Line,
+		Routine:          e.Routine,
+	}
+}
@@ -0,0 +1,148 @@
+// Package pgxv5 holds pgmig executor adapters for pgx v5 transactions, connections and pools.
+// PG errors are converted to pgmig errors, notices are passed to Migrator via OnNotice handler.
+package pgxv5
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/pgmig/pgmig"
+)
+
+// querier is implemented by pgx v5 Tx, Conn and Pool
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// beginner is implemented by pgx v5 Conn and Pool
+type beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+type executor struct {
+	q querier
+}
+
+func (e executor) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	_, err := e.q.Exec(ctx, sql, args...)
+	return Error(err)
+}
+
+func (e executor) Query(ctx context.Context, sql string, args ...interface{}) (pgmig.Rows, error) {
+	r, err := e.q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, Error(err)
+	}
+	return rows{r}, nil
+}
+
+type rows struct {
+	pgx.Rows
+}
+
+func (r rows) Err() error { return Error(r.Rows.Err()) }
+
+type tx struct {
+	executor
+	tx pgx.Tx
+}
+
+func (t tx) Commit(ctx context.Context) error { return Error(t.tx.Commit(ctx)) }
+
+func (t tx) Rollback(ctx context.Context) error {
+	if err := t.tx.Rollback(ctx); !errors.Is(err, pgx.ErrTxClosed) {
+		return Error(err)
+	}
+	return nil
+}
+
+type db struct {
+	executor
+	b beginner
+}
+
+func (d db) BeginTx(ctx context.Context) (pgmig.TxExecutor, error) {
+	t, err := d.b.Begin(ctx)
+	if err != nil {
+		return nil, Error(err)
+	}
+	return WrapTx(t), nil
+}
+
+// WrapTx returns executor for pgx v5 transaction
+func WrapTx(t pgx.Tx) pgmig.TxExecutor {
+	return tx{executor{t}, t}
+}
+
+// WrapConn returns pgmig.DB for pgx v5 connection
+func WrapConn(conn *pgx.Conn) pgmig.DB {
+	return db{executor{conn}, conn}
+}
+
+// WrapPool returns pgmig.DB for pgx v5 pool.
+// Every transaction uses single connection, so notices of a run come from one connection.
+func WrapPool(pool *pgxpool.Pool) pgmig.DB {
+	return db{executor{pool}, pool}
+}
+
+// OnNotice returns notice handler which passes notices to mig.
+// Use it as pgx.ConnConfig.OnNotice.
+func OnNotice(mig *pgmig.Migrator) pgconn.NoticeHandler {
+	return func(_ *pgconn.PgConn, n *pgconn.Notice) {
+		mig.ProcessNotice(n.Code, n.Message, n.Detail)
+	}
+}
+
+// Connect makes connection which passes notices to mig
+func Connect(ctx context.Context, mig *pgmig.Migrator, dsn string) (*pgx.Conn, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.OnNotice = OnNotice(mig)
+	config.StatementCacheCapacity = 0 // disable stmt cache for `reinit pgmig`
+	return pgx.ConnectConfig(ctx, config)
+}
+
+// NewPool makes pool which connections pass notices to mig
+func NewPool(ctx context.Context, mig *pgmig.Migrator, dsn string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.ConnConfig.OnNotice = OnNotice(mig)
+	config.ConnConfig.StatementCacheCapacity = 0
+	return pgxpool.NewWithConfig(ctx, config)
+}
+
+// Error converts pgx v5 PG error to the type used by pgmig, other errors are returned as is
+func Error(err error) error {
+	var e *pgconn.PgError
+	if !errors.As(err, &e) {
+		return err
+	}
+	return &pgmig.DBError{
+		Severity:         e.Severity,
+		Code:             e.Code,
+		Message:          e.Message,
+		Detail:           e.Detail,
+		Hint:             e.Hint,
+		Position:         e.Position,
+		InternalPosition: e.InternalPosition,
+		InternalQuery:    e.InternalQuery,
+		Where:            e.Where,
+		SchemaName:       e.SchemaName,
+		TableName:        e.TableName,
+		ColumnName:       e.ColumnName,
+		DataTypeName:     e.DataTypeName,
+		ConstraintName:   e.ConstraintName,
+		File:             e.File,
+		Line:             e.Line,
+		Routine:          e.Routine,
+	}
+}
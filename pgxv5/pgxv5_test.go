@@ -0,0 +1,23 @@
+package pgxv5
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pgmig/pgmig"
+)
+
+func TestError(t *testing.T) {
+	err := Error(&pgconn.PgError{Severity: "ERROR", Code: "42P01", Message: "relation does not exist", Position: 15})
+	pgErr, ok := err.(*pgmig.DBError)
+	require.True(t, ok)
+	assert.Equal(t, &pgmig.DBError{Severity: "ERROR", Code: "42P01", Message: "relation does not exist", Position: 15}, pgErr)
+
+	other := errors.New("other")
+	assert.Equal(t, other, Error(other))
+	assert.NoError(t, Error(nil))
+}
@@ -0,0 +1,108 @@
+// This file holds two-phase commit support.
+// Prepared transaction survives disconnect and waits for COMMIT PREPARED or ROLLBACK PREPARED,
+// so deploy orchestrator may finish it after application rollout.
+// PG server must have max_prepared_transactions > 0.
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdCommitPrepared holds name of commit-prepared command
+	CmdCommitPrepared = "commit-prepared"
+	// CmdRollbackPrepared holds name of rollback-prepared command
+	CmdRollbackPrepared = "rollback-prepared"
+
+	// SQLPrepareTx prepares current transaction for two-phase commit
+	SQLPrepareTx = "PREPARE TRANSACTION %s"
+	// SQLCommitPrepared commits prepared transaction
+	SQLCommitPrepared = "COMMIT PREPARED %s"
+	// SQLRollbackPrepared rolls back prepared transaction
+	SQLRollbackPrepared = "ROLLBACK PREPARED %s"
+	// SQLHistoryPrepared fetches command and packages of prepared run
+	SQLHistoryPrepared = `SELECT command, packages FROM %s.run WHERE gid = $1 AND outcome = 'prepared' ORDER BY id DESC LIMIT 1`
+)
+
+// PrepareTx runs command like RunIn but ends transaction with PREPARE TRANSACTION gid instead of commit.
+// It returns true if transaction was prepared.
+func (mig *Migrator) PrepareTx(ctx context.Context, db TxStarter, command string, packages []string, gid string) (bool, error) {
+	if gid == "" {
+		return false, errors.New("Prepared transaction id required")
+	}
+	return mig.runTx(ctx, db, command, packages, gid)
+}
+
+// FinishPrepared commits or rolls back prepared transaction gid.
+// Outcome is saved in run record of PrepareTx if it was called by this Migrator,
+// new run record is started otherwise. Call SaveHistory afterwards.
+// Command and packages of prepared run are taken from history and sent in RunDone event.
+func (mig *Migrator) FinishPrepared(ctx context.Context, db Executor, gid string, commit bool) (err error) {
+	if gid == "" {
+		return errors.New("Prepared transaction id required")
+	}
+	command, sql, outcome := CmdRollbackPrepared, SQLRollbackPrepared, OutcomeRollback
+	if commit {
+		command, sql, outcome = CmdCommitPrepared, SQLCommitPrepared, OutcomeCommit
+	}
+	var prepared string
+	var packages []string
+	if mig.history == nil {
+		prepared, packages = mig.preparedRun(ctx, db, gid)
+		mig.startHistory(command, packages)
+	} else {
+		prepared, packages = mig.history.Command, mig.history.Packages
+	}
+	done := &RunDone{Command: command, Packages: packages, Prepared: prepared, Outcome: outcome}
+	defer func(started time.Time) {
+		done.Duration = time.Since(started)
+		if err != nil {
+			done.Outcome, done.Error = OutcomeError, err.Error()
+		}
+		mig.emit(done)
+	}(time.Now())
+	mig.setHistoryGID(gid)
+	if err = db.Exec(ctx, fmt.Sprintf(sql, quoteLiteral(gid))); err != nil {
+		err = errors.Wrap(err, "Finish prepared transaction")
+		mig.setHistoryOutcome(OutcomeError, err)
+		return err
+	}
+	mig.setHistoryOutcome(outcome, nil)
+	return nil
+}
+
+// preparedRun returns command and packages of prepared run gid from history if they are saved there
+func (mig *Migrator) preparedRun(ctx context.Context, db Executor, gid string) (command string, packages []string) {
+	var exists bool
+	if err := queryValue(db, &exists, SQLPgMigExists, HistorySchema, HistoryTable); err != nil || !exists {
+		return
+	}
+	rows, err := db.Query(ctx, fmt.Sprintf(SQLHistoryPrepared, quoteIdent(HistorySchema)), gid)
+	if err != nil {
+		mig.Log.Error(err, "Prepared run lookup error", "gid", gid)
+		return
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err = rows.Scan(&command, &packages); err != nil {
+			mig.Log.Error(err, "Prepared run lookup error", "gid", gid)
+		}
+	}
+	return
+}
+
+// quoteLiteral quotes string as SQL literal
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quoteIdent quotes string as SQL identifier
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
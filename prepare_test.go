@@ -0,0 +1,102 @@
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareTx(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	rows := NewMockRows(ctrl)
+	rows.EXPECT().Next().Return(false).AnyTimes()
+	rows.EXPECT().Close().AnyTimes()
+	ct := pgconn.CommandTag{}
+
+	tx := NewMockTx(ctrl)
+	gomock.InOrder(
+		tx.EXPECT().Query(ctx, SQLPgMigExists, CorePackage, CoreTable).Return(rows, nil),
+		tx.EXPECT().Exec(gomock.Any(), gomock.Any()).Return(ct, nil).Times(2),
+		tx.EXPECT().Exec(ctx, "PREPARE TRANSACTION 'deploy''1'").Return(ct, nil),
+		tx.EXPECT().Rollback(ctx).Return(nil),
+	)
+
+	cfg := Config{NoHooks: true, InitIncludes: []string{"*.sql"}}
+	mig := New(logr.Discard(), cfg, nil, "testdata")
+	db := txBeginner{tx}
+	prepared, err := mig.PrepareTx(ctx, &db, CmdInit, []string{"b"}, "deploy'1")
+	require.NoError(t, err)
+	assert.True(t, prepared)
+	assert.Equal(t, OutcomePrepared, mig.history.Outcome)
+	assert.Equal(t, "deploy'1", mig.history.GID)
+
+	_, err = mig.PrepareTx(ctx, &db, CmdInit, []string{"b"}, "")
+	assert.Error(t, err)
+	assert.Error(t, mig.FinishPrepared(ctx, nil, "", true))
+}
+
+func TestFinishPreparedHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	exists := NewMockRows(ctrl)
+	exists.EXPECT().Next().Return(true)
+	exists.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+		*dest[0].(*bool) = true
+		return nil
+	})
+	exists.EXPECT().Close()
+	run := NewMockRows(ctrl)
+	run.EXPECT().Next().Return(true)
+	run.EXPECT().Scan(gomock.Any(), gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+		*dest[0].(*string) = CmdInit
+		*dest[1].(*[]string) = []string{"a"}
+		return nil
+	})
+	run.EXPECT().Close()
+	noTables := NewMockRows(ctrl)
+	noTables.EXPECT().Next().Return(false)
+	noTables.EXPECT().Close()
+	tx := NewMockTx(ctrl)
+	gomock.InOrder(
+		tx.EXPECT().Query(ctx, SQLPgMigExists, HistorySchema, HistoryTable).Return(exists, nil),
+		tx.EXPECT().Query(ctx, fmt.Sprintf(SQLHistoryPrepared, quoteIdent(HistorySchema)), "deploy").Return(run, nil),
+		tx.EXPECT().Exec(ctx, "COMMIT PREPARED 'deploy'").Return(pgconn.CommandTag{}, nil),
+		tx.EXPECT().Query(ctx, SQLPgMigExists, HistorySchema, HistoryTable).Return(noTables, nil),
+		tx.EXPECT().Exec(ctx, "ROLLBACK PREPARED 'gone'").Return(pgconn.CommandTag{}, &pgconn.PgError{Code: "42704"}),
+	)
+
+	mig := New(logr.Discard(), Config{}, nil, "")
+	var done []*RunDone
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		if v, ok := e.Event.(*RunDone); ok {
+			done = append(done, v)
+		}
+	}))
+	require.NoError(t, mig.FinishPrepared(ctx, wrapTx(tx), "deploy", true))
+	rec := mig.history
+	require.NotNil(t, rec)
+	assert.Equal(t, CmdCommitPrepared, rec.Command)
+	assert.Equal(t, []string{"a"}, rec.Packages)
+	assert.Equal(t, "deploy", rec.GID)
+	assert.Equal(t, OutcomeCommit, rec.Outcome)
+
+	mig.history = nil
+	assert.Error(t, mig.FinishPrepared(ctx, wrapTx(tx), "gone", false))
+	assert.Equal(t, CmdRollbackPrepared, mig.history.Command)
+	assert.Equal(t, OutcomeError, mig.history.Outcome)
+
+	require.Len(t, done, 2)
+	assert.Equal(t, RunDone{Command: CmdCommitPrepared, Packages: []string{"a"}, Prepared: CmdInit, Outcome: OutcomeCommit},
+		RunDone{Command: done[0].Command, Packages: done[0].Packages, Prepared: done[0].Prepared, Outcome: done[0].Outcome})
+	assert.Equal(t, OutcomeError, done[1].Outcome)
+}
@@ -0,0 +1,98 @@
+// This file holds destructive commands protection.
+// Destructive commands require Config.Force or typed database name confirmation on terminal.
+// Confirmation is asked before transaction start.
+// Database with pgmig.protected setting enabled (ALTER DATABASE .. SET pgmig.protected = on)
+// refuses them entirely.
+
+package pgmig
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProtectedVar holds name of PG setting which forbids destructive commands
+const ProtectedVar = "pgmig.protected"
+
+// IsDestructive returns true if command drops database objects
+func IsDestructive(command string) bool {
+	switch command {
+	case CmdDrop, CmdErase, CmdReInit:
+		return true
+	}
+	return false
+}
+
+// confirmDestructive asks for destructive command confirmation by typing database name.
+// It is called before transaction start, so no transaction is open while waiting for answer
+func (mig *Migrator) confirmDestructive(ctx context.Context, db TxStarter, command string) error {
+	if !IsDestructive(command) || mig.Config.Force || !mig.IsTerminal {
+		// checkDestructive refuses command without confirmation
+		return nil
+	}
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	name, err := mig.checkProtected(tx, command)
+	if er := tx.Rollback(ctx); er != nil && err == nil {
+		err = er
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(mig.Stderr, "Command %s is destructive. Type database name (%s) to confirm: ", command, name)
+	answer, err := bufio.NewReader(mig.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return errors.Wrap(err, "Read confirmation")
+	}
+	if strings.TrimSpace(answer) != name {
+		return fmt.Errorf("%s is not confirmed", command)
+	}
+	mig.confirmed = command + " " + name
+	return nil
+}
+
+// checkDestructive returns error if destructive command is not allowed for connected database
+func (mig *Migrator) checkDestructive(tx Executor, command string) error {
+	if !IsDestructive(command) {
+		return nil
+	}
+	name, err := mig.checkProtected(tx, command)
+	if err != nil {
+		return err
+	}
+	if mig.Config.Force || mig.confirmed == command+" "+name {
+		return nil
+	}
+	return fmt.Errorf("%s is destructive, use --force to run it without confirmation", command)
+}
+
+// checkProtected returns name of connected database or error if it is protected
+func (mig *Migrator) checkProtected(tx Executor, command string) (string, error) {
+	var protected *string
+	if err := queryValue(tx, &protected, SQLPgMigVar, ProtectedVar); err != nil {
+		return "", errors.Wrap(err, "Check "+ProtectedVar)
+	}
+	var db string
+	if err := queryValue(tx, &db, SQLCurrentDB); err != nil {
+		return "", errors.Wrap(err, "SQLCurrentDB")
+	}
+	if protected != nil && isOn(*protected) {
+		return "", fmt.Errorf("database %s is protected by %s setting, %s is not allowed", db, ProtectedVar, command)
+	}
+	return db, nil
+}
+
+// isOn returns true if PG boolean setting value is true
+func isOn(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package pgmig
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDestructive(t *testing.T) {
+	assert.True(t, IsDestructive(CmdReInit))
+	assert.False(t, IsDestructive(CmdInit))
+}
+
+func TestCheckDestructive(t *testing.T) {
+	strp := func(s string) *string { return &s }
+	tests := []struct {
+		name      string
+		protected *string
+		force     bool
+		term      bool
+		err       string
+	}{
+		{name: "force", force: true},
+		{name: "protected", protected: strp("on"), force: true, err: "database db is protected"},
+		{name: "not protected", protected: strp("off"), force: true},
+		{name: "no terminal", err: "use --force"},
+		{name: "terminal", term: true, err: "use --force"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			ctx := context.Background()
+			tx := NewMockTx(ctrl)
+			rows := NewMockRows(ctrl)
+			gomock.InOrder(
+				tx.EXPECT().Query(ctx, SQLPgMigVar, ProtectedVar).Return(rows, nil),
+				rows.EXPECT().Next().Return(tt.protected != nil),
+			)
+			if tt.protected != nil {
+				rows.EXPECT().Scan(gomock.Any()).SetArg(0, tt.protected)
+			}
+			gomock.InOrder(
+				tx.EXPECT().Query(ctx, SQLCurrentDB).Return(rows, nil),
+				rows.EXPECT().Next().Return(true),
+				rows.EXPECT().Scan(gomock.Any()).SetArg(0, "db"),
+			)
+			rows.EXPECT().Close().Times(2)
+
+			mig := New(logr.Discard(), Config{Force: tt.force}, nil, "")
+			mig.IsTerminal = tt.term
+			err := mig.checkDestructive(wrapTx(tx), CmdErase)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+// txStarterFunc is a TxStarter which returns transaction made by func
+type txStarterFunc func(ctx context.Context) (TxExecutor, error)
+
+func (f txStarterFunc) BeginTx(ctx context.Context) (TxExecutor, error) { return f(ctx) }
+
+func TestConfirmDestructive(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{name: "confirmed", input: "db\n"},
+		{name: "not confirmed", input: "other\n", err: "not confirmed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			ctx := context.Background()
+			tx := NewMockTx(ctrl)
+			rows := NewMockRows(ctrl)
+			prompt := &strings.Builder{}
+			mig := New(logr.Discard(), Config{}, nil, "")
+			mig.IsTerminal = true
+			mig.Stdin = strings.NewReader(tt.input)
+			mig.Stderr = prompt
+			gomock.InOrder(
+				tx.EXPECT().Query(ctx, SQLPgMigVar, ProtectedVar).Return(rows, nil),
+				rows.EXPECT().Next().Return(false),
+				tx.EXPECT().Query(ctx, SQLCurrentDB).Return(rows, nil),
+				rows.EXPECT().Next().Return(true),
+				rows.EXPECT().Scan(gomock.Any()).SetArg(0, "db"),
+				// transaction is finished before prompt
+				tx.EXPECT().Rollback(ctx).DoAndReturn(func(context.Context) error {
+					assert.Empty(t, prompt.String())
+					return nil
+				}),
+			)
+			rows.EXPECT().Close().Times(2)
+			db := txStarterFunc(func(context.Context) (TxExecutor, error) { return wrapTx(tx), nil })
+			err := mig.confirmDestructive(ctx, db, CmdErase)
+			assert.Contains(t, prompt.String(), "Type database name (db)")
+			if tt.err != "" {
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, CmdErase+" db", mig.confirmed)
+		})
+	}
+}
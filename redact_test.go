@@ -0,0 +1,34 @@
+package pgmig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"postgres://op:secret@db:5432/app?sslmode=disable", "postgres://op:*****@db:5432/app?sslmode=disable"},
+		{"postgres://op@db/app", "postgres://op@db/app"},
+		{"postgres://db/app?password=secret&sslmode=disable", "postgres://db/app?password=*****&sslmode=disable"},
+		{"host=db password=secret user=op", "host=db password=***** user=op"},
+		{"host=db password = 'sec ret' user=op", "host=db password = ***** user=op"},
+		{"connect to postgres://op:secret@db/app: refused", "connect to postgres://op:*****@db/app: refused"},
+		{"no secrets here", "no secrets here"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, RedactDSN(tt.in), tt.in)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := Config{Vars: map[string]string{"token": "secret", "name": "app"}, SecretVars: []string{"token"}}
+	got := cfg.Redacted()
+	assert.Equal(t, map[string]string{"token": RedactedValue, "name": "app"}, got.Vars)
+	assert.Equal(t, "secret", cfg.Vars["token"], "source config must not be changed")
+	assert.Equal(t, []string{"secret"}, cfg.SecretValues())
+	assert.Nil(t, Config{}.Redacted().Vars)
+}
@@ -0,0 +1,162 @@
+// This file holds transaction retry support.
+// Partial retry inside one transaction is impossible, so whole run is repeated in new transaction.
+// Only the last attempt is saved in run history and timing summary, failed attempts are reported by Retry events.
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PG error codes which allow run retry
+const (
+	pgLockNotAvailable     = "55P03"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// Retry holds fields of run retry event.
+type Retry struct {
+	Attempt int
+	Code    string
+	Message string
+	Delay   time.Duration
+}
+
+// RunDone holds fields of run transaction finish event.
+type RunDone struct {
+	Command  string
+	Packages []string
+	Prepared string `json:",omitempty"` // command of prepared run finished by commit-prepared or rollback-prepared
+	Outcome  string
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// Kind returns event kind
+func (*Retry) Kind() EventKind { return KindRetry }
+
+// Kind returns event kind
+func (*RunDone) Kind() EventKind { return KindRunDone }
+
+// RunIn runs command in transaction started via db and commits it if RunExec allows.
+// If run fails with lock timeout, serialization failure or deadlock, transaction is rolled back
+// and run is repeated from scratch up to Config.RetryAttempts times.
+func (mig *Migrator) RunIn(ctx context.Context, db TxStarter, command string, packages []string) (bool, error) {
+	return mig.runTx(ctx, db, command, packages, "")
+}
+
+// runTx runs command with retries. If gid is set, transaction is prepared for two-phase commit instead of commit.
+func (mig *Migrator) runTx(ctx context.Context, db TxStarter, command string, packages []string, gid string) (commit bool, err error) {
+	defer func(started time.Time) {
+		done := &RunDone{Command: command, Packages: packages, Outcome: OutcomeRollback, Duration: time.Since(started)}
+		switch {
+		case err != nil:
+			done.Outcome, done.Error = OutcomeError, err.Error()
+		case mig.runErr != nil:
+			done.Outcome, done.Error = OutcomeError, mig.runErr.Error()
+		case commit && gid != "":
+			done.Outcome = OutcomePrepared
+		case commit:
+			done.Outcome = OutcomeCommit
+		}
+		mig.emit(done)
+	}(time.Now())
+	if err = mig.confirmDestructive(ctx, db, command); err != nil {
+		return false, err
+	}
+	for attempt := 1; ; attempt++ {
+		var pgErr *DBError
+		commit, pgErr, err = mig.runTxOnce(ctx, db, command, packages, gid)
+		if pgErr == nil || !isRetryable(pgErr) || attempt > mig.Config.RetryAttempts {
+			return commit, err
+		}
+		delay := backoff(mig.Config.RetryDelay, mig.Config.RetryMaxDelay, attempt, rand.Int63n)
+		mig.emit(&Retry{Attempt: attempt, Code: pgErr.Code, Message: pgErr.Message, Delay: delay})
+		mig.Log.Info("Retry run", "attempt", attempt, "code", pgErr.Code, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runTxOnce runs command in new transaction and returns PG error which caused rollback if any.
+// Commit error is returned as error too.
+func (mig *Migrator) runTxOnce(ctx context.Context, db TxStarter, command string, packages []string, gid string) (bool, *DBError, error) {
+	mig.setNoCommit(false)
+	mig.runErr = nil
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	defer func() {
+		if er := tx.Rollback(ctx); er != nil {
+			mig.Log.Error(er, "Rollback error")
+		}
+	}()
+	commit, err := mig.RunExec(tx, command, packages)
+	if err != nil {
+		// PG error may be wrapped by hook or query context
+		var pgErr *DBError
+		if errors.As(err, &pgErr) {
+			return false, pgErr, err
+		}
+		return false, nil, err
+	}
+	// RunExec returns PG error via event and mig.runErr
+	if !*commit {
+		return false, mig.runErr, nil
+	}
+	if gid != "" {
+		// after PREPARE TRANSACTION session has no transaction, so deferred rollback just warns
+		err = tx.Exec(ctx, fmt.Sprintf(SQLPrepareTx, quoteLiteral(gid)))
+	} else {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		mig.setHistoryOutcome(OutcomeError, err)
+		var pgErr *DBError
+		if errors.As(err, &pgErr) {
+			mig.emit(&PgError{pgErr})
+			return false, pgErr, err
+		}
+		return false, nil, err
+	}
+	if gid != "" {
+		mig.setHistoryOutcome(OutcomePrepared, nil)
+		mig.setHistoryGID(gid)
+	}
+	return true, nil, nil
+}
+
+// isRetryable returns true if transaction may succeed being repeated
+func isRetryable(e *DBError) bool {
+	switch e.Code {
+	case pgLockNotAvailable, pgSerializationFailure, pgDeadlockDetected:
+		return true
+	}
+	return false
+}
+
+// backoff returns exponential delay for attempt with jitter in [delay/2, delay]
+func backoff(base, max time.Duration, attempt int, rnd func(int64) int64) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < attempt && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rnd(half+1))
+}
@@ -0,0 +1,109 @@
+package pgmig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	full := func(n int64) int64 { return n - 1 }
+	zero := func(n int64) int64 { return 0 }
+	assert.Equal(t, time.Second, backoff(time.Second, 0, 1, full))
+	assert.Equal(t, 4*time.Second, backoff(time.Second, 0, 3, full))
+	assert.Equal(t, 2*time.Second, backoff(time.Second, 0, 3, zero))
+	assert.Equal(t, 5*time.Second, backoff(time.Second, 5*time.Second, 10, full))
+	assert.Equal(t, time.Duration(0), backoff(0, 0, 2, full))
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(&DBError{Code: "55P03"}))
+	assert.True(t, isRetryable(&DBError{Code: "40001"}))
+	assert.True(t, isRetryable(&DBError{Code: "40P01"}))
+	assert.False(t, isRetryable(&DBError{Code: "42P01"}))
+}
+
+// txBeginner is a TxStarter which returns given transactions
+type txBeginner []pgx.Tx
+
+func (b *txBeginner) BeginTx(ctx context.Context) (TxExecutor, error) {
+	tx := (*b)[0]
+	*b = (*b)[1:]
+	return wrapTx(tx), nil
+}
+
+func TestRunTx(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	rows := NewMockRows(ctrl)
+	rows.EXPECT().Next().Return(false).AnyTimes()
+	rows.EXPECT().Close().AnyTimes()
+	ct := pgconn.CommandTag{}
+
+	lockErr := &pgconn.PgError{Code: pgLockNotAvailable, Message: "lock timeout"}
+	tx1 := NewMockTx(ctrl)
+	tx1.EXPECT().Query(ctx, SQLPgMigExists, CorePackage, CoreTable).Return(rows, nil)
+	tx1.EXPECT().Exec(gomock.Any(), gomock.Any()).Return(ct, lockErr)
+	tx1.EXPECT().Rollback(ctx).Return(nil)
+
+	tx2 := NewMockTx(ctrl)
+	tx2.EXPECT().Query(ctx, SQLPgMigExists, CorePackage, CoreTable).Return(rows, nil)
+	tx2.EXPECT().Exec(gomock.Any(), gomock.Any()).Return(ct, nil).Times(2)
+	tx2.EXPECT().Commit(ctx).Return(nil)
+	tx2.EXPECT().Rollback(ctx).Return(pgx.ErrTxClosed)
+
+	cfg := Config{NoHooks: true, InitIncludes: []string{"*.sql"}, RetryAttempts: 1, RetryDelay: time.Millisecond}
+	mig := New(logr.Discard(), cfg, nil, "testdata")
+	got := []*Retry{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		if r, ok := e.Event.(*Retry); ok {
+			got = append(got, r)
+		}
+	}))
+	db := txBeginner{tx1, tx2}
+	commit, err := mig.RunIn(ctx, &db, CmdInit, []string{"b"})
+	require.NoError(t, err)
+	assert.True(t, commit)
+	require.Len(t, got, 1)
+	assert.Equal(t, 1, got[0].Attempt)
+	assert.Equal(t, pgLockNotAvailable, got[0].Code)
+}
+
+func TestRunTxWrappedError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	rows := NewMockRows(ctrl)
+	rows.EXPECT().Next().Return(false).AnyTimes()
+	rows.EXPECT().Close().AnyTimes()
+	ct := pgconn.CommandTag{}
+
+	// error of pgmig check is wrapped
+	lockErr := &pgconn.PgError{Code: pgLockNotAvailable, Message: "lock timeout"}
+	tx1 := NewMockTx(ctrl)
+	tx1.EXPECT().Query(ctx, SQLPgMigExists, CorePackage, CoreTable).Return(nil, lockErr)
+	tx1.EXPECT().Rollback(ctx).Return(nil)
+
+	tx2 := NewMockTx(ctrl)
+	tx2.EXPECT().Query(ctx, SQLPgMigExists, CorePackage, CoreTable).Return(rows, nil)
+	tx2.EXPECT().Exec(gomock.Any(), gomock.Any()).Return(ct, nil).Times(2)
+	tx2.EXPECT().Commit(ctx).Return(nil)
+	tx2.EXPECT().Rollback(ctx).Return(pgx.ErrTxClosed)
+
+	cfg := Config{NoHooks: true, InitIncludes: []string{"*.sql"}, RetryAttempts: 1, RetryDelay: time.Millisecond}
+	mig := New(logr.Discard(), cfg, nil, "testdata")
+	db := txBeginner{tx1, tx2}
+	commit, err := mig.RunIn(ctx, &db, CmdInit, []string{"b"})
+	require.NoError(t, err)
+	assert.True(t, commit)
+}
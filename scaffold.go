@@ -0,0 +1,230 @@
+// This file holds package and file scaffolding.
+// File names are built from Config file masks, so new files are run by the command they are made for.
+
+package pgmig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdNew holds name of new command
+	CmdNew = "new"
+
+	// FileInit is the kind of file run on every init
+	FileInit = "init"
+	// FileOnce is the kind of file run once on init
+	FileOnce = "once"
+	// FileNew is the kind of file run on init if package is new
+	FileNew = "new"
+	// FileTest is the kind of test file
+	FileTest = "test"
+)
+
+var (
+	reFileNumber = regexp.MustCompile(`^(\d+)[_.]`)
+	reNotSlug    = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// initTemplate holds content of package schema file
+const initTemplate = `/*
+  Package %[1]s schema.
+  This file runs on every init, so it must be idempotent.
+*/
+
+CREATE SCHEMA IF NOT EXISTS %[1]s;
+`
+
+// testTemplate holds content of test file.
+// Test results are sent as notices which are processed by Migrator.ProcessNotice.
+const testTemplate = `/*
+  %[1]s
+  Test results are sent as notices:
+    01998 - tests count (message), must be sent first
+    01999 - test passed (message: test name)
+    02999 - test failed (message: test name, detail: got and want values)
+  Test file changes are rolled back.
+*/
+
+DO $_$
+DECLARE
+  v_got  TEXT;
+  v_want TEXT := '1';
+BEGIN
+  RAISE NOTICE USING ERRCODE = '01998', MESSAGE = '1';
+
+  v_got := (SELECT 1)::TEXT;
+  IF v_got IS NOT DISTINCT FROM v_want THEN
+    RAISE NOTICE USING ERRCODE = '01999', MESSAGE = 'select one';
+  ELSE
+    RAISE NOTICE USING ERRCODE = '02999', MESSAGE = 'select one'
+    , DETAIL = format('got: %%s, want: %%s', v_got, v_want);
+  END IF;
+END
+$_$;
+`
+
+// fileTemplates holds header of new file by kind
+var fileTemplates = map[string]string{
+	FileInit: "/*\n  %s\n  This file runs on every init, so it must be idempotent.\n*/\n",
+	FileOnce: "/*\n  %s\n  This file runs once, its md5 is registered after run.\n*/\n",
+	FileNew:  "/*\n  %s\n  This file runs on init if package is new.\n*/\n",
+	FileTest: testTemplate,
+}
+
+// NewPackage creates package directory under root with schema, new, test and manifest files.
+// It returns names of created files.
+func (mig *Migrator) NewPackage(root, name string) ([]string, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, errors.New("Package name must be directory name")
+	}
+	dir := filepath.Join(root, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	var rv []string
+	file, err := mig.newFile(dir, 0, FileInit, "init", fmt.Sprintf(initTemplate, name))
+	if err != nil {
+		return nil, err
+	}
+	rv = append(rv, file)
+	for i, kind := range []string{FileNew, FileTest} {
+		title := fmt.Sprintf("Package %s %s file", name, kind)
+		if file, err = mig.newFile(dir, i+1, kind, name, fmt.Sprintf(fileTemplates[kind], title)); err != nil {
+			return nil, err
+		}
+		rv = append(rv, file)
+	}
+	if mig.Config.Manifest != "" {
+		data, err := json.MarshalIndent(Manifest{Settings: Settings{SearchPath: name + ", public"}, Schemas: []string{name}}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(dir, mig.Config.Manifest)
+		if err = writeNewFile(file, append(data, '\n')); err != nil {
+			return nil, err
+		}
+		rv = append(rv, file)
+	}
+	return rv, nil
+}
+
+// NewFile creates file of given kind in package directory under root.
+// File number is next to the greatest one in package.
+func (mig *Migrator) NewFile(root, pkg, kind, title string) (string, error) {
+	dir := filepath.Join(root, pkg)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	num := 0
+	for _, e := range entries {
+		if m := reFileNumber.FindStringSubmatch(e.Name()); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n >= num {
+				num = n + 1
+			}
+		}
+	}
+	tpl, ok := fileTemplates[kind]
+	if !ok {
+		return "", errors.New("Unknown file kind " + kind)
+	}
+	return mig.newFile(dir, num, kind, title, fmt.Sprintf(tpl, title))
+}
+
+// newFile creates file of kind named by number and title
+func (mig *Migrator) newFile(dir string, num int, kind, title, content string) (string, error) {
+	suffix, err := mig.kindSuffix(kind)
+	if err != nil {
+		return "", err
+	}
+	slug := strings.Trim(reNotSlug.ReplaceAllString(strings.ToLower(title), "_"), "_")
+	if slug == "" {
+		return "", errors.New("Title must contain letters or digits")
+	}
+	name := fmt.Sprintf("%02d_%s%s", num, slug, suffix)
+	if got := mig.fileKind(name); got != kind {
+		return "", fmt.Errorf("file %s would be run as %q, check file masks", name, got)
+	}
+	file := filepath.Join(dir, name)
+	return file, writeNewFile(file, []byte(content))
+}
+
+// kindMasks returns file masks of kind
+func (mig *Migrator) kindMasks(kind string) []string {
+	cfg := mig.Config
+	switch kind {
+	case FileInit:
+		return cfg.InitIncludes
+	case FileOnce:
+		return cfg.OnceIncludes
+	case FileNew:
+		return cfg.NewIncludes
+	case FileTest:
+		return cfg.TestIncludes
+	}
+	return nil
+}
+
+// kindSuffix returns file name suffix from first kind mask like "*.once.sql"
+func (mig *Migrator) kindSuffix(kind string) (string, error) {
+	for _, m := range mig.kindMasks(kind) {
+		if strings.HasPrefix(m, "*") && !strings.ContainsAny(m[1:], `*?[\`) {
+			return m[1:], nil
+		}
+	}
+	return "", fmt.Errorf("no mask like *.suffix for %s files", kind)
+}
+
+// fileKind returns kind of file as walkerFunc sees it, empty string if file is not run
+func (mig *Migrator) fileKind(name string) string {
+	if matchMasks(mig.Config.TestIncludes, name) {
+		return FileTest
+	}
+	if !matchMasks(mig.Config.InitIncludes, name) {
+		return ""
+	}
+	if matchMasks(mig.Config.NewIncludes, name) {
+		return FileNew
+	}
+	if matchMasks(mig.Config.OnceIncludes, name) {
+		return FileOnce
+	}
+	return FileInit
+}
+
+// matchMasks returns true if name matches masks, "!" masks exclude names
+func matchMasks(masks []string, name string) bool {
+	matched := false
+	for _, m := range masks {
+		if strings.HasPrefix(m, "!") {
+			if ok, _ := filepath.Match(m[1:], name); ok {
+				return false
+			}
+		} else if ok, _ := filepath.Match(m, name); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// writeNewFile writes file which must not exist
+func writeNewFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+package pgmig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPackage(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{Manifest: "pgmig.json", InitIncludes: []string{"*.sql", "!*.test.sql"}, TestIncludes: []string{"*.test.sql"},
+		NewIncludes: []string{"*.new.sql"}, OnceIncludes: []string{"*.once.sql"}}
+	mig := New(logr.Discard(), cfg, nil, root)
+	files, err := mig.NewPackage(root, "app")
+	require.NoError(t, err)
+	dir := filepath.Join(root, "app")
+	assert.Equal(t, []string{
+		filepath.Join(dir, "00_init.sql"),
+		filepath.Join(dir, "01_app.new.sql"),
+		filepath.Join(dir, "02_app.test.sql"),
+		filepath.Join(dir, "pgmig.json"),
+	}, files)
+	_, err = mig.NewPackage(root, "app")
+	assert.Error(t, err)
+
+	name, err := mig.NewFile(root, "app", FileOnce, "Add user email")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "03_add_user_email.once.sql"), name)
+	name, err = mig.NewFile(root, "app", FileInit, "Functions")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "04_functions.sql"), name)
+	_, err = mig.NewFile(root, "app", "bad", "Functions")
+	assert.EqualError(t, err, "Unknown file kind bad")
+
+	pkgs, err := mig.lookupFiles(CmdInit, cfg.InitIncludes, cfg.NewIncludes, cfg.OnceIncludes, false, []string{"app"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, []fileDef{
+		{Name: "00_init.sql"},
+		{Name: "01_app.new.sql", IfNewPkg: true},
+		{Name: "03_add_user_email.once.sql", IfNewFile: true},
+		{Name: "04_functions.sql"},
+	}, pkgs[0].Files)
+	assert.Equal(t, &Manifest{Settings: Settings{SearchPath: "app, public"}, Schemas: []string{"app"}}, pkgs[0].Manifest)
+
+	test, err := os.ReadFile(filepath.Join(dir, "02_app.test.sql"))
+	require.NoError(t, err)
+	assert.Contains(t, string(test), "format('got: %s, want: %s', v_got, v_want)")
+}
+
+func TestNewFileMasks(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "app"), 0o755))
+	mig := New(logr.Discard(), Config{InitIncludes: []string{"*.sql"}, OnceIncludes: []string{"once_*.sql"}}, nil, root)
+	_, err := mig.NewFile(root, "app", FileOnce, "x")
+	assert.EqualError(t, err, "no mask like *.suffix for once files")
+
+	mig.Config.OnceIncludes = []string{"*.sql"}
+	_, err = mig.NewFile(root, "app", FileInit, "x")
+	assert.EqualError(t, err, `file 00_x.sql would be run as "once", check file masks`)
+}
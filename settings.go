@@ -0,0 +1,145 @@
+// This file holds package manifest and session settings support.
+// Settings are set for transaction before package files run and restored afterwards.
+// Package manifest settings override global ones.
+
+package pgmig
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Settings holds session settings.
+type Settings struct {
+	Role             string `json:"role,omitempty" long:"role" description:"Role for running package files (SET LOCAL ROLE)"`
+	SearchPath       string `json:"search_path,omitempty" long:"search_path" description:"search_path for running package files"`
+	LockTimeout      string `json:"lock_timeout,omitempty" long:"lock_timeout" description:"lock_timeout for running package files (e.g. 5s)"`
+	StatementTimeout string `json:"statement_timeout,omitempty" long:"statement_timeout" description:"statement_timeout for running package files (e.g. 1min)"`
+}
+
+// Setting holds session setting name and value.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// List returns non empty settings in fixed order.
+func (s Settings) List() (rv []Setting) {
+	for _, v := range []Setting{
+		{"role", s.Role},
+		{"search_path", s.SearchPath},
+		{"lock_timeout", s.LockTimeout},
+		{"statement_timeout", s.StatementTimeout},
+	} {
+		if v.Value != "" {
+			rv = append(rv, v)
+		}
+	}
+	return
+}
+
+// Merge returns settings with non empty fields of other overriding s ones.
+func (s Settings) Merge(other Settings) Settings {
+	if other.Role != "" {
+		s.Role = other.Role
+	}
+	if other.SearchPath != "" {
+		s.SearchPath = other.SearchPath
+	}
+	if other.LockTimeout != "" {
+		s.LockTimeout = other.LockTimeout
+	}
+	if other.StatementTimeout != "" {
+		s.StatementTimeout = other.StatementTimeout
+	}
+	return s
+}
+
+// Manifest holds package metadata loaded from Config.Manifest file of package directory.
+type Manifest struct {
+	Settings Settings `json:"settings"`
+	// Schemas holds schemas created by package, used by snapshot, drift and coverage. Package name is used if empty
+	Schemas []string `json:"schemas,omitempty"`
+}
+
+// SessionSettings holds fields of package settings event.
+type SessionSettings struct {
+	Pkg      string
+	Settings []Setting
+}
+
+// Kind returns event kind
+func (*SessionSettings) Kind() EventKind { return KindSettings }
+
+// readManifest loads package manifest, nil returned if package has no manifest
+func (mig *Migrator) readManifest(root string) (*Manifest, error) {
+	if mig.Config.Manifest == "" {
+		return nil, nil
+	}
+	name := filepath.Join(root, mig.Config.Manifest)
+	fh, err := mig.FS.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Open "+name)
+	}
+	defer fh.Close()
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading "+name)
+	}
+	rv := &Manifest{}
+	if err = json.Unmarshal(data, rv); err != nil {
+		return nil, errors.Wrap(err, "Parse "+name)
+	}
+	return rv, nil
+}
+
+// pkgSettings returns settings for package
+func (mig *Migrator) pkgSettings(pkg pkgDef) Settings {
+	rv := mig.Config.Settings
+	if pkg.Manifest != nil {
+		rv = rv.Merge(pkg.Manifest.Settings)
+	}
+	return rv
+}
+
+// applySettings sets package session settings and returns func which restores previous values
+func (mig *Migrator) applySettings(tx Executor, pkg pkgDef) (func() error, error) {
+	settings := mig.pkgSettings(pkg).List()
+	if len(settings) == 0 {
+		return func() error { return nil }, nil
+	}
+	ctx := context.Background()
+	prev := make([]Setting, 0, len(settings))
+	for _, s := range settings {
+		var value *string
+		if err := queryValue(tx, &value, SQLPgMigVar, s.Name); err != nil {
+			return nil, errors.Wrap(err, "Get "+s.Name)
+		}
+		v := ""
+		if value != nil {
+			v = *value
+		}
+		prev = append(prev, Setting{Name: s.Name, Value: v})
+		if err := tx.Exec(ctx, SQLSetVar, "", s.Name, s.Value); err != nil {
+			return nil, errors.Wrap(err, "Set "+s.Name)
+		}
+	}
+	mig.emit(&SessionSettings{Pkg: pkg.Name, Settings: settings})
+	return func() error {
+		// restore in reverse order, so role is restored last
+		for i := len(prev) - 1; i >= 0; i-- {
+			if err := tx.Exec(ctx, SQLSetVar, "", prev[i].Name, prev[i].Value); err != nil {
+				return errors.Wrap(err, "Restore "+prev[i].Name)
+			}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,67 @@
+package pgmig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettingsMerge(t *testing.T) {
+	global := Settings{Role: "app", LockTimeout: "1s"}
+	got := global.Merge(Settings{LockTimeout: "5s", SearchPath: "b"})
+	assert.Equal(t, Settings{Role: "app", LockTimeout: "5s", SearchPath: "b"}, got)
+	assert.Equal(t, []Setting{
+		{"role", "app"},
+		{"search_path", "b"},
+		{"lock_timeout", "5s"},
+	}, got.List())
+	assert.Nil(t, Settings{}.List())
+}
+
+func TestReadManifest(t *testing.T) {
+	mig := New(logr.Discard(), Config{Manifest: "pgmig.json"}, nil, "testdata")
+	pkgs, err := mig.lookupFiles(CmdInit, []string{"*.sql"}, nil, nil, false, []string{"a", "b"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+	assert.Nil(t, pkgs[0].Manifest)
+	assert.Equal(t, &Manifest{Settings: Settings{LockTimeout: "5s", SearchPath: "b, public"}}, pkgs[1].Manifest)
+}
+
+func TestApplySettings(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+	rows := NewMockRows(ctrl)
+	ctx := context.Background()
+
+	mig := New(logr.Discard(), Config{Settings: Settings{Role: "app", LockTimeout: "1s"}}, nil, "")
+	got := []Event{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Event)
+	}))
+	pkg := pkgDef{Name: "b", Manifest: &Manifest{Settings: Settings{LockTimeout: "5s"}}}
+	ex := tx.EXPECT()
+	ct := pgconn.CommandTag{}
+	gomock.InOrder(
+		ex.Query(ctx, SQLPgMigVar, "role").Return(rows, nil),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Close(),
+		ex.Exec(ctx, SQLSetVar, "", "role", "app").Return(ct, nil),
+		ex.Query(ctx, SQLPgMigVar, "lock_timeout").Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).SetArg(0, func() *string { s := "0"; return &s }()),
+		rows.EXPECT().Close(),
+		ex.Exec(ctx, SQLSetVar, "", "lock_timeout", "5s").Return(ct, nil),
+		ex.Exec(ctx, SQLSetVar, "", "lock_timeout", "0").Return(ct, nil),
+		ex.Exec(ctx, SQLSetVar, "", "role", "").Return(ct, nil),
+	)
+	restore, err := mig.applySettings(wrapTx(tx), pkg)
+	require.NoError(t, err)
+	assert.Equal(t, []Event{&SessionSettings{Pkg: "b", Settings: []Setting{{"role", "app"}, {"lock_timeout", "5s"}}}}, got)
+	assert.NoError(t, restore())
+}
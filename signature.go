@@ -0,0 +1,146 @@
+// This file holds archive signature verification.
+// Signature is made over bundle manifest (SHA256SUMS) which holds checksums of all bundle files,
+// so signed manifest proves bundle content. Raw ed25519 (base64) and minisign signatures are supported.
+
+package pgmig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// ArchiveSignature holds name of bundle manifest ed25519 signature file (base64)
+	ArchiveSignature = ArchiveManifest + ".sig"
+	// ArchiveMinisig holds name of bundle manifest minisign signature file
+	ArchiveMinisig = ArchiveManifest + ".minisig"
+
+	// minisign signature algorithms: pure ed25519 and ed25519 over BLAKE2b-512 hash
+	minisignAlg       = "Ed"
+	minisignHashedAlg = "ED"
+	minisignKeyIDSize = 8
+
+	minisignUntrusted = "untrusted comment:"
+	minisignTrusted   = "trusted comment: "
+)
+
+var (
+	// ErrNoSignature returned if archive has no manifest or its signature
+	ErrNoSignature = errors.New("archive is not signed")
+	// ErrBadSignature returned if signature does not match
+	ErrBadSignature = errors.New("signature verification failed")
+)
+
+// PublicKey holds bundle signature verification key.
+type PublicKey struct {
+	// ID holds minisign key id, nil for raw ed25519 key
+	ID  []byte
+	Key ed25519.PublicKey
+}
+
+// ParsePublicKey parses base64 ed25519 public key or minisign public key (file content or key line)
+func ParsePublicKey(s string) (*PublicKey, error) {
+	var line string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, minisignUntrusted) {
+			line = l
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decode public key")
+	}
+	switch {
+	case len(data) == ed25519.PublicKeySize:
+		return &PublicKey{Key: data}, nil
+	case len(data) == 2+minisignKeyIDSize+ed25519.PublicKeySize && string(data[:2]) == minisignAlg:
+		return &PublicKey{ID: data[2 : 2+minisignKeyIDSize], Key: data[2+minisignKeyIDSize:]}, nil
+	}
+	return nil, errors.New("Unknown public key format")
+}
+
+// Verify checks signature of message. Signature is base64 ed25519 signature or minisign signature file content
+func (pk *PublicKey) Verify(message, sig []byte) error {
+	text := strings.TrimSpace(string(sig))
+	if strings.HasPrefix(text, minisignUntrusted) {
+		return pk.verifyMinisign(message, text)
+	}
+	raw, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return errors.New("Unknown signature format")
+	}
+	if !ed25519.Verify(pk.Key, message, raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// verifyMinisign checks minisign signature and its trusted comment
+func (pk *PublicKey) verifyMinisign(message []byte, text string) error {
+	lines := strings.Split(strings.ReplaceAll(text, "\r", ""), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], minisignTrusted) {
+		return errors.New("Bad minisign signature format")
+	}
+	data, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(data) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return errors.New("Bad minisign signature")
+	}
+	alg, keyID, sig := string(data[:2]), data[2:2+minisignKeyIDSize], data[2+minisignKeyIDSize:]
+	if pk.ID != nil && !bytes.Equal(keyID, pk.ID) {
+		return errors.New("Signature is made by another key")
+	}
+	switch alg {
+	case minisignAlg:
+	case minisignHashedAlg:
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	default:
+		return errors.New("Unknown minisign signature algorithm " + alg)
+	}
+	if !ed25519.Verify(pk.Key, message, sig) {
+		return ErrBadSignature
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("Bad minisign global signature")
+	}
+	trusted := strings.TrimPrefix(lines[2], minisignTrusted)
+	if !ed25519.Verify(pk.Key, append(append([]byte{}, sig...), trusted...), global) {
+		return errors.Wrap(ErrBadSignature, "Trusted comment")
+	}
+	return nil
+}
+
+// VerifySignature checks signature of archive manifest.
+// If sig is nil, signature is read from archive (SHA256SUMS.minisig or SHA256SUMS.sig).
+// ErrNoSignature is returned if archive has no manifest or signature
+func (fs *ArchiveFS) VerifySignature(key *PublicKey, sig []byte) error {
+	m, ok := fs.files[ArchiveManifest]
+	if !ok || !fs.verified {
+		return ErrNoSignature
+	}
+	if sig == nil {
+		for _, name := range []string{ArchiveMinisig, ArchiveSignature} {
+			if f, ok := fs.files[name]; ok {
+				sig = f.data
+				break
+			}
+		}
+		if sig == nil {
+			return ErrNoSignature
+		}
+	}
+	if err := key.Verify(m.data, sig); err != nil {
+		return errors.Wrap(err, "Verify "+fs.name+" signature")
+	}
+	fs.signed = true
+	return nil
+}
+
+// Signed returns true if archive manifest signature was verified
+func (fs *ArchiveFS) Signed() bool { return fs.signed }
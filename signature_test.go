@@ -0,0 +1,110 @@
+package pgmig
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign returns minisign signature of message and public key file content
+func minisign(priv ed25519.PrivateKey, keyID []byte, alg string, message []byte) (sig, pub string) {
+	if alg == minisignHashedAlg {
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	}
+	raw := ed25519.Sign(priv, message)
+	trusted := "timestamp:1700000000\tfile:SHA256SUMS"
+	global := ed25519.Sign(priv, append(append([]byte{}, raw...), trusted...))
+	sigData := append(append([]byte(alg), keyID...), raw...)
+	sig = "untrusted comment: signature from minisign secret key\n" + base64.StdEncoding.EncodeToString(sigData) +
+		"\n" + minisignTrusted + trusted + "\n" + base64.StdEncoding.EncodeToString(global) + "\n"
+	pubData := append(append([]byte(minisignAlg), keyID...), priv.Public().(ed25519.PublicKey)...)
+	pub = "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(pubData) + "\n"
+	return
+}
+
+func TestPublicKeyVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	message := []byte("manifest")
+	keyID := []byte("12345678")
+
+	key, err := ParsePublicKey(base64.StdEncoding.EncodeToString(pub))
+	require.NoError(t, err)
+	assert.Nil(t, key.ID)
+	rawSig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, message))
+	assert.NoError(t, key.Verify(message, []byte(rawSig+"\n")))
+	assert.Equal(t, ErrBadSignature, key.Verify([]byte("tampered"), []byte(rawSig)))
+
+	for _, alg := range []string{minisignAlg, minisignHashedAlg} {
+		sig, pubFile := minisign(priv, keyID, alg, message)
+		key, err := ParsePublicKey(pubFile)
+		require.NoError(t, err)
+		assert.Equal(t, keyID, key.ID)
+		assert.NoError(t, key.Verify(message, []byte(sig)), alg)
+		assert.Equal(t, ErrBadSignature, key.Verify([]byte("tampered"), []byte(sig)), alg)
+	}
+
+	sig, _ := minisign(priv, []byte("87654321"), minisignHashedAlg, message)
+	key, err = ParsePublicKey(base64.StdEncoding.EncodeToString(append(append([]byte(minisignAlg), keyID...), pub...)))
+	require.NoError(t, err)
+	assert.EqualError(t, key.Verify(message, []byte(sig)), "Signature is made by another key")
+
+	_, err = ParsePublicKey("bm90IGEga2V5")
+	assert.EqualError(t, err, "Unknown public key format")
+}
+
+func TestArchiveVerifySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	key := &PublicKey{Key: pub}
+	dir := t.TempDir()
+
+	files := withManifest(bundleFiles)
+	sig, _ := minisign(priv, []byte("12345678"), minisignHashedAlg, []byte(files[ArchiveManifest]))
+	files[ArchiveMinisig] = sig
+	name := filepath.Join(dir, "signed.tgz")
+	writeTarGz(t, name, files)
+	fs, err := OpenArchive(name)
+	require.NoError(t, err)
+	assert.False(t, fs.Signed())
+	require.NoError(t, fs.VerifySignature(key, nil))
+	assert.True(t, fs.Signed())
+
+	// manifest changed after signing
+	files = map[string]string{"app/01_schema.sql": "DROP SCHEMA app;"}
+	for k, v := range bundleFiles {
+		if _, ok := files[k]; !ok {
+			files[k] = v
+		}
+	}
+	files = withManifest(files)
+	files[ArchiveMinisig] = sig
+	name = filepath.Join(dir, "tampered.tgz")
+	writeTarGz(t, name, files)
+	fs, err = OpenArchive(name)
+	require.NoError(t, err)
+	assert.EqualError(t, fs.VerifySignature(key, nil), "Verify "+name+" signature: "+ErrBadSignature.Error())
+
+	// detached signature
+	files = withManifest(bundleFiles)
+	name = filepath.Join(dir, "unsigned.tgz")
+	writeTarGz(t, name, files)
+	fs, err = OpenArchive(name)
+	require.NoError(t, err)
+	assert.Equal(t, ErrNoSignature, fs.VerifySignature(key, nil))
+	rawSig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(files[ArchiveManifest])))
+	assert.NoError(t, fs.VerifySignature(key, []byte(rawSig)))
+
+	// no manifest
+	name = filepath.Join(dir, "plain.tgz")
+	writeTarGz(t, name, bundleFiles)
+	fs, err = OpenArchive(name)
+	require.NoError(t, err)
+	assert.Equal(t, ErrNoSignature, fs.VerifySignature(key, []byte(rawSig)))
+}
@@ -0,0 +1,128 @@
+// This file holds event sinks for machine readable output.
+
+package pgmig
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JSONSink writes every event as JSON line.
+type JSONSink struct {
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONSink returns sink which writes events to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+// Emit writes event
+func (js *JSONSink) Emit(e Envelope) {
+	if js.err != nil {
+		return
+	}
+	js.err = js.enc.Encode(e)
+}
+
+// Close returns first write error if any
+func (js *JSONSink) Close() error { return js.err }
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr,omitempty"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitReport struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Errors   int           `xml:"errors,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+// JUnitSink collects test results and writes them in JUnit XML format on Close.
+// Every test file is reported as testsuite and every assertion as testcase.
+type JUnitSink struct {
+	w   io.Writer
+	rep junitReport
+	cur *junitSuite
+}
+
+// NewJUnitSink returns sink which writes report to w.
+func NewJUnitSink(w io.Writer) *JUnitSink {
+	return &JUnitSink{w: w}
+}
+
+// Emit collects test results
+func (js *JUnitSink) Emit(e Envelope) {
+	switch v := e.Event.(type) {
+	case *RunFile:
+		js.cur = &junitSuite{Name: e.Package + "/" + v.Name}
+		js.rep.Suites = append(js.rep.Suites, js.cur)
+	case *FileDone:
+		if js.cur != nil {
+			js.cur.Time = fmt.Sprintf("%.3f", v.Duration.Seconds())
+		}
+	case *TestOk:
+		js.add(e, junitCase{Name: v.Message})
+	case *TestFail:
+		js.add(e, junitCase{Name: v.Message, Failure: &junitFailure{Message: v.Message, Body: v.Detail}})
+	case *PgError:
+		msg := fmt.Sprintf("%s:%d %s %s", v.File, v.Line, v.Code, v.Message)
+		js.add(e, junitCase{Name: "error", Error: &junitFailure{Message: msg, Body: v.Detail}})
+	}
+}
+
+func (js *JUnitSink) add(e Envelope, c junitCase) {
+	if js.cur == nil {
+		js.cur = &junitSuite{Name: e.Package}
+		js.rep.Suites = append(js.rep.Suites, js.cur)
+	}
+	c.ClassName = strings.TrimSuffix(js.cur.Name, ".sql")
+	js.cur.Cases = append(js.cur.Cases, c)
+	js.cur.Tests++
+	js.rep.Tests++
+	if c.Failure != nil {
+		js.cur.Failures++
+		js.rep.Failures++
+	}
+	if c.Error != nil {
+		js.cur.Errors++
+		js.rep.Errors++
+	}
+}
+
+// Close writes report
+func (js *JUnitSink) Close() error {
+	if _, err := io.WriteString(js.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(js.w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(js.rep); err != nil {
+		return err
+	}
+	_, err := io.WriteString(js.w, "\n")
+	return err
+}
@@ -0,0 +1,57 @@
+package pgmig
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewJSONSink(buf)
+	sink.Emit(Envelope{
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Sequence: 1,
+		Package:  "a",
+		File:     "01.test.sql",
+		Kind:     KindTestOk,
+		Event:    &TestOk{Current: 1, Message: "ok"},
+	})
+	assert.NoError(t, sink.Close())
+	assert.Equal(t, `{"time":"2020-01-02T03:04:05Z","seq":1,"pkg":"a","file":"01.test.sql","kind":"test_ok","data":{"Current":1,"Message":"ok"}}`+"\n", buf.String())
+}
+
+func TestJUnitSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewJUnitSink(buf)
+	for _, e := range []Envelope{
+		{Package: "a", Event: &Op{Pkg: "a", Op: CmdTest}},
+		{Package: "a", Event: &RunFile{Name: "01.test.sql"}},
+		{Package: "a", Event: &TestCount{Count: 2}},
+		{Package: "a", Event: &TestOk{Current: 1, Message: "first"}},
+		{Package: "a", Event: &TestFail{Current: 2, Message: "second", Detail: "detail"}},
+		{Package: "a", Event: &RunFile{Name: "02.test.sql"}},
+		{Package: "a", Event: &PgError{&DBError{File: "02.test.sql", Line: 3, Code: "42P01", Message: "no table"}}},
+	} {
+		sink.Emit(e)
+	}
+	assert.NoError(t, sink.Close())
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="3" failures="1" errors="1">
+  <testsuite name="a/01.test.sql" tests="2" failures="1" errors="0">
+    <testcase name="first" classname="a/01.test"></testcase>
+    <testcase name="second" classname="a/01.test">
+      <failure message="second">detail</failure>
+    </testcase>
+  </testsuite>
+  <testsuite name="a/02.test.sql" tests="1" failures="0" errors="1">
+    <testcase name="error" classname="a/02.test">
+      <error message="02.test.sql:3 42P01 no table"></error>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	assert.Equal(t, want, buf.String())
+}
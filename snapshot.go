@@ -0,0 +1,329 @@
+// This file holds schema snapshot and drift detection.
+// Snapshot is a sorted list of package schema objects loaded from pg_catalog and saved in package directory.
+// Drift is the difference between saved snapshot and live database.
+
+package pgmig
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CmdSnapshot holds name of snapshot command
+	CmdSnapshot = "snapshot"
+	// CmdDrift holds name of drift command
+	CmdDrift = "drift"
+
+	// DriftMissing means object from snapshot does not exist in database
+	DriftMissing = "missing"
+	// DriftExtra means database object is not in snapshot
+	DriftExtra = "extra"
+	// DriftChanged means database object differs from snapshot
+	DriftChanged = "changed"
+
+	// SQLSnapshot fetches objects of schemas $1 as kind, name and definition
+	SQLSnapshot = `WITH ns AS (SELECT oid, nspname FROM pg_namespace WHERE nspname = ANY($1))
+, ext AS (SELECT objid FROM pg_depend WHERE deptype = 'e')
+SELECT 'table', format('%I.%I', ns.nspname, c.relname)
+     , CASE c.relkind WHEN 'r' THEN 'table' WHEN 'p' THEN 'partitioned table' WHEN 'f' THEN 'foreign table'
+       WHEN 'S' THEN 'sequence' WHEN 'v' THEN 'view md5 ' || md5(pg_get_viewdef(c.oid))
+       ELSE 'materialized view md5 ' || md5(pg_get_viewdef(c.oid)) END
+  FROM pg_class c JOIN ns ON ns.oid = c.relnamespace
+ WHERE c.relkind IN ('r', 'p', 'f', 'S', 'v', 'm') AND c.oid NOT IN (SELECT objid FROM ext)
+UNION ALL
+SELECT 'column', format('%I.%I.%I', ns.nspname, c.relname, a.attname)
+     , format_type(a.atttypid, a.atttypmod) || CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+       || coalesce(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+  FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid JOIN ns ON ns.oid = c.relnamespace
+  LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+ WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm') AND a.attnum > 0 AND NOT a.attisdropped
+   AND c.oid NOT IN (SELECT objid FROM ext)
+UNION ALL
+SELECT 'constraint', format('%I.%I.%I', ns.nspname, c.relname, k.conname), pg_get_constraintdef(k.oid)
+  FROM pg_constraint k JOIN pg_class c ON c.oid = k.conrelid JOIN ns ON ns.oid = c.relnamespace
+UNION ALL
+SELECT 'index', format('%I.%I', ns.nspname, i.relname), pg_get_indexdef(i.oid)
+  FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid JOIN ns ON ns.oid = i.relnamespace
+ WHERE x.indexrelid NOT IN (SELECT conindid FROM pg_constraint WHERE contype IN ('p', 'u', 'x'))
+UNION ALL
+SELECT 'trigger', format('%I.%I.%I', ns.nspname, c.relname, t.tgname), pg_get_triggerdef(t.oid)
+  FROM pg_trigger t JOIN pg_class c ON c.oid = t.tgrelid JOIN ns ON ns.oid = c.relnamespace
+ WHERE NOT t.tgisinternal
+UNION ALL
+SELECT 'function', format('%I.%I(%s)', ns.nspname, p.proname, pg_get_function_identity_arguments(p.oid))
+     , format('returns %s language %s %s%s md5 %s', coalesce(pg_get_function_result(p.oid), 'void'), l.lanname
+       , CASE p.provolatile WHEN 'i' THEN 'immutable' WHEN 's' THEN 'stable' ELSE 'volatile' END
+       , CASE WHEN p.prosecdef THEN ' security definer' ELSE '' END, md5(p.prosrc))
+  FROM pg_proc p JOIN ns ON ns.oid = p.pronamespace JOIN pg_language l ON l.oid = p.prolang
+ WHERE p.oid NOT IN (SELECT objid FROM ext)
+UNION ALL
+SELECT 'grant', format('%s %I.%I TO %s', CASE c.relkind WHEN 'S' THEN 'SEQUENCE' ELSE 'TABLE' END, ns.nspname, c.relname
+     , CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END)
+     , string_agg(a.privilege_type || CASE WHEN a.is_grantable THEN '*' ELSE '' END, ',' ORDER BY a.privilege_type)
+  FROM pg_class c JOIN ns ON ns.oid = c.relnamespace, aclexplode(c.relacl) a
+ GROUP BY ns.nspname, c.relname, a.grantee
+UNION ALL
+SELECT 'grant', format('%s %I.%I(%s) TO %s', CASE p.prokind WHEN 'p' THEN 'PROCEDURE' ELSE 'FUNCTION' END
+     , ns.nspname, p.proname, pg_get_function_identity_arguments(p.oid)
+     , CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END)
+     , string_agg(a.privilege_type || CASE WHEN a.is_grantable THEN '*' ELSE '' END, ',' ORDER BY a.privilege_type)
+  FROM pg_proc p JOIN ns ON ns.oid = p.pronamespace, aclexplode(p.proacl) a
+ GROUP BY ns.nspname, p.proname, p.oid, a.grantee
+UNION ALL
+SELECT 'grant', format('SCHEMA %I TO %s', ns.nspname
+     , CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END)
+     , string_agg(a.privilege_type || CASE WHEN a.is_grantable THEN '*' ELSE '' END, ',' ORDER BY a.privilege_type)
+  FROM pg_namespace n JOIN ns ON ns.oid = n.oid, aclexplode(n.nspacl) a
+ GROUP BY ns.nspname, a.grantee`
+)
+
+// SchemaObject holds database object description.
+type SchemaObject struct {
+	Kind string
+	Name string
+	Def  string
+}
+
+// Snapshot holds package schema objects.
+type Snapshot struct {
+	Pkg     string
+	Schemas []string
+	Objects []SchemaObject
+}
+
+// DriftItem holds object difference between snapshot and database.
+type DriftItem struct {
+	Change string
+	Kind   string
+	Name   string
+	Want   string `json:",omitempty"` // snapshot definition
+	Got    string `json:",omitempty"` // database definition
+}
+
+// Drift holds fields of package drift event.
+type Drift struct {
+	Pkg   string
+	File  string
+	Items []DriftItem
+}
+
+// Kind returns event kind
+func (*Drift) Kind() EventKind { return KindDrift }
+
+// pkgSchemas returns schemas of package, package name if manifest does not list them
+func pkgSchemas(pkg pkgDef) []string {
+	if pkg.Manifest != nil && len(pkg.Manifest.Schemas) > 0 {
+		return pkg.Manifest.Schemas
+	}
+	return []string{pkg.Name}
+}
+
+// Snapshot loads schema objects of packages from database.
+func (mig *Migrator) Snapshot(tx Executor, packages []string) ([]*Snapshot, error) {
+	pkgs, err := mig.lookupFiles(CmdSnapshot, nil, nil, nil, false, packages)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*Snapshot, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		snap, err := querySnapshot(tx, pkg.Name, pkgSchemas(pkg))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, snap)
+	}
+	return rv, nil
+}
+
+// querySnapshot loads objects of schemas from database
+func querySnapshot(tx Executor, pkg string, schemas []string) (*Snapshot, error) {
+	rows, err := tx.Query(context.Background(), SQLSnapshot, schemas)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQLSnapshot")
+	}
+	defer rows.Close()
+	rv := &Snapshot{Pkg: pkg, Schemas: schemas}
+	for rows.Next() {
+		o := SchemaObject{}
+		if err = rows.Scan(&o.Kind, &o.Name, &o.Def); err != nil {
+			return nil, errors.Wrap(err, "Incompartible value returned")
+		}
+		o.Def = strings.Join(strings.Fields(o.Def), " ") // one line per object
+		rv.Objects = append(rv.Objects, o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rv.sort()
+	return rv, nil
+}
+
+// sort orders objects by kind and name, so snapshot does not depend on catalog order and collation
+func (s *Snapshot) sort() {
+	sort.Slice(s.Objects, func(i, j int) bool {
+		a, b := s.Objects[i], s.Objects[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+}
+
+// Write writes snapshot as tab separated kind, name and definition lines
+func (s *Snapshot) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# pgmig snapshot of package %s, schemas: %s\n", s.Pkg, strings.Join(s.Schemas, ","))
+	for _, o := range s.Objects {
+		fmt.Fprintf(bw, "%s\t%s\t%s\n", o.Kind, o.Name, o.Def)
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot parses snapshot written by Write
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	rv := &Snapshot{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := scanner.Text()
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		f := strings.SplitN(s, "\t", 3)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: kind, name and definition expected", line)
+		}
+		rv.Objects = append(rv.Objects, SchemaObject{Kind: f[0], Name: f[1], Def: f[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	rv.sort()
+	return rv, nil
+}
+
+// SaveSnapshot writes snapshot to package directory under root and returns file name.
+// root is the OS directory of packages, Migrator FileSystem is read only.
+func (mig *Migrator) SaveSnapshot(root string, s *Snapshot) (string, error) {
+	name := filepath.Join(root, s.Pkg, mig.Config.SnapshotFile)
+	f, err := os.Create(name)
+	if err != nil {
+		return name, err
+	}
+	if err = s.Write(f); err != nil {
+		f.Close()
+		return name, err
+	}
+	return name, f.Close()
+}
+
+// readSnapshot loads package snapshot, nil returned if package has no snapshot
+func (mig *Migrator) readSnapshot(pkg pkgDef) (*Snapshot, error) {
+	name := filepath.Join(pkg.Root, mig.Config.SnapshotFile)
+	fh, err := mig.FS.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Open "+name)
+	}
+	defer fh.Close()
+	rv, err := ReadSnapshot(fh)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse "+name)
+	}
+	rv.Pkg = pkg.Name
+	return rv, nil
+}
+
+// Drift compares packages schema with their snapshots.
+// Packages without snapshot are skipped, drift event is emitted for others.
+func (mig *Migrator) Drift(tx Executor, packages []string) ([]*Drift, error) {
+	pkgs, err := mig.lookupFiles(CmdDrift, nil, nil, nil, false, packages)
+	if err != nil {
+		return nil, err
+	}
+	return mig.pkgDrift(tx, pkgs)
+}
+
+// pkgDrift compares schema of pkgs with their snapshots
+func (mig *Migrator) pkgDrift(tx Executor, pkgs []pkgDef) ([]*Drift, error) {
+	var rv []*Drift
+	for _, pkg := range pkgs {
+		want, err := mig.readSnapshot(pkg)
+		if err != nil {
+			return nil, err
+		}
+		if want == nil {
+			mig.Log.Info("Package has no snapshot", "pkg", pkg.Name, "file", mig.Config.SnapshotFile)
+			continue
+		}
+		got, err := querySnapshot(tx, pkg.Name, pkgSchemas(pkg))
+		if err != nil {
+			return nil, err
+		}
+		d := &Drift{Pkg: pkg.Name, File: mig.Config.SnapshotFile, Items: CompareSnapshots(want, got)}
+		mig.emit(d)
+		rv = append(rv, d)
+	}
+	return rv, nil
+}
+
+// CompareSnapshots returns objects which differ in want and got
+func CompareSnapshots(want, got *Snapshot) []DriftItem {
+	key := func(o SchemaObject) string { return o.Kind + "\t" + o.Name }
+	gotDefs := make(map[string]string, len(got.Objects))
+	for _, o := range got.Objects {
+		gotDefs[key(o)] = o.Def
+	}
+	var rv []DriftItem
+	seen := make(map[string]bool, len(want.Objects))
+	for _, o := range want.Objects {
+		k := key(o)
+		seen[k] = true
+		def, ok := gotDefs[k]
+		switch {
+		case !ok:
+			rv = append(rv, DriftItem{Change: DriftMissing, Kind: o.Kind, Name: o.Name, Want: o.Def})
+		case def != o.Def:
+			rv = append(rv, DriftItem{Change: DriftChanged, Kind: o.Kind, Name: o.Name, Want: o.Def, Got: def})
+		}
+	}
+	for _, o := range got.Objects {
+		if !seen[key(o)] {
+			rv = append(rv, DriftItem{Change: DriftExtra, Kind: o.Kind, Name: o.Name, Got: o.Def})
+		}
+	}
+	return rv
+}
+
+// verifySnapshots returns error if schema of initialized packages differs from their snapshots
+func (mig *Migrator) verifySnapshots(tx Executor, pkgs []pkgDef) error {
+	var initPkgs []pkgDef
+	for _, pkg := range pkgs {
+		if pkg.Op == CmdInit {
+			initPkgs = append(initPkgs, pkg)
+		}
+	}
+	drifts, err := mig.pkgDrift(tx, initPkgs)
+	if err != nil {
+		return err
+	}
+	for _, d := range drifts {
+		if len(d.Items) > 0 {
+			return fmt.Errorf("package %s schema differs from snapshot %s", d.Pkg, d.File)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pgmig
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotWriteRead(t *testing.T) {
+	s := &Snapshot{Pkg: "snap", Schemas: []string{"snap"}, Objects: []SchemaObject{
+		{"table", "snap.t", "table"},
+		{"column", "snap.t.id", "integer NOT NULL"},
+	}}
+	s.sort()
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.Write(buf))
+	assert.Equal(t, "# pgmig snapshot of package snap, schemas: snap\ncolumn\tsnap.t.id\tinteger NOT NULL\ntable\tsnap.t\ttable\n",
+		buf.String())
+	got, err := ReadSnapshot(buf)
+	require.NoError(t, err)
+	assert.Equal(t, s.Objects, got.Objects)
+
+	_, err = ReadSnapshot(bytes.NewBufferString("table snap.t"))
+	assert.EqualError(t, err, "line 1: kind, name and definition expected")
+}
+
+func TestCompareSnapshots(t *testing.T) {
+	want := &Snapshot{Objects: []SchemaObject{
+		{"column", "snap.t.id", "integer NOT NULL"},
+		{"column", "snap.t.name", "text"},
+		{"table", "snap.t", "table"},
+	}}
+	got := &Snapshot{Objects: []SchemaObject{
+		{"column", "snap.t.id", "bigint NOT NULL"},
+		{"index", "snap.t_name", "CREATE INDEX t_name ON snap.t USING btree (name)"},
+		{"table", "snap.t", "table"},
+	}}
+	assert.Equal(t, []DriftItem{
+		{Change: DriftChanged, Kind: "column", Name: "snap.t.id", Want: "integer NOT NULL", Got: "bigint NOT NULL"},
+		{Change: DriftMissing, Kind: "column", Name: "snap.t.name", Want: "text"},
+		{Change: DriftExtra, Kind: "index", Name: "snap.t_name", Got: "CREATE INDEX t_name ON snap.t USING btree (name)"},
+	}, CompareSnapshots(want, got))
+	assert.Nil(t, CompareSnapshots(want, want))
+}
+
+func TestDrift(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+	rows := NewMockRows(ctrl)
+	ctx := context.Background()
+
+	mig := New(logr.Discard(), Config{Manifest: "pgmig.json", SnapshotFile: "pgmig.snapshot"}, nil, "testdata")
+	got := []Event{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Event)
+	}))
+	objects := []SchemaObject{
+		{"table", "snap.t", "table"},
+		{"column", "snap.t.id", "integer NOT NULL"},
+		{"function", "snap.f(integer)", "returns integer  language sql\nimmutable md5 1f0e3dad99908345f7439f8ffabdffc4"},
+	}
+	calls := []*gomock.Call{tx.EXPECT().Query(ctx, SQLSnapshot, []string{"snap", "snap_priv"}).Return(rows, nil)}
+	for _, o := range objects {
+		o := o
+		calls = append(calls,
+			rows.EXPECT().Next().Return(true),
+			rows.EXPECT().Scan(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+				*dest[0].(*string), *dest[1].(*string), *dest[2].(*string) = o.Kind, o.Name, o.Def
+				return nil
+			}),
+		)
+	}
+	calls = append(calls,
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close(),
+	)
+	gomock.InOrder(calls...)
+	drifts, err := mig.Drift(wrapTx(tx), []string{"a", "snap"})
+	require.NoError(t, err)
+	want := &Drift{Pkg: "snap", File: "pgmig.snapshot", Items: []DriftItem{
+		{Change: DriftMissing, Kind: "column", Name: "snap.t.name", Want: "text"},
+	}}
+	assert.Equal(t, []*Drift{want}, drifts)
+	assert.Equal(t, []Event{want}, got)
+}
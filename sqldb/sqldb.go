@@ -0,0 +1,147 @@
+// Package sqldb holds pgmig executor adapters for database/sql transactions, connections and pools.
+// Driver must be PostgreSQL one, e.g. pgx stdlib or lib/pq.
+// database/sql does not pass notices, so test results and RAISE output are not shown
+// and tests are not checked. Array arguments (used by history) depend on driver support.
+// Driver errors are converted by SQLSTATE only, use Adapter with pgxv4.Error or pgxv5.Error
+// for pgx stdlib to keep error position.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/pgmig/pgmig"
+)
+
+// querier is implemented by sql.Tx, sql.Conn and sql.DB
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// beginner is implemented by sql.Conn and sql.DB
+type beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+type executor struct {
+	q    querier
+	conv func(error) error
+}
+
+func (e executor) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := e.q.ExecContext(ctx, query, args...)
+	return e.error(err)
+}
+
+func (e executor) Query(ctx context.Context, query string, args ...interface{}) (pgmig.Rows, error) {
+	r, err := e.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, e.error(err)
+	}
+	return rows{r, e.error}, nil
+}
+
+// error converts driver error by conv if it is set, by Error otherwise
+func (e executor) error(err error) error {
+	if e.conv != nil {
+		if rv := e.conv(err); rv != err {
+			return rv
+		}
+	}
+	return Error(err)
+}
+
+type rows struct {
+	*sql.Rows
+	conv func(error) error
+}
+
+func (r rows) Err() error { return r.conv(r.Rows.Err()) }
+
+func (r rows) Close() { _ = r.Rows.Close() }
+
+type tx struct {
+	executor
+	tx *sql.Tx
+}
+
+func (t tx) Commit(context.Context) error { return t.error(t.tx.Commit()) }
+
+func (t tx) Rollback(context.Context) error {
+	if err := t.tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		return t.error(err)
+	}
+	return nil
+}
+
+type db struct {
+	executor
+	b beginner
+}
+
+func (d db) BeginTx(ctx context.Context) (pgmig.TxExecutor, error) {
+	t, err := d.b.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, d.error(err)
+	}
+	return tx{executor{t, d.conv}, t}, nil
+}
+
+// Adapter makes executors which convert driver errors by Convert.
+type Adapter struct {
+	// Convert converts driver error to *pgmig.DBError, e.g. pgxv5.Error for pgx v5 stdlib.
+	// Error is used if Convert is nil or returns error as is
+	Convert func(error) error
+}
+
+// WrapTx returns executor for database/sql transaction
+func (a Adapter) WrapTx(t *sql.Tx) pgmig.TxExecutor {
+	return tx{executor{t, a.Convert}, t}
+}
+
+// WrapConn returns pgmig.DB for database/sql connection
+func (a Adapter) WrapConn(conn *sql.Conn) pgmig.DB {
+	return db{executor{conn, a.Convert}, conn}
+}
+
+// WrapDB returns pgmig.DB for database/sql pool
+func (a Adapter) WrapDB(pool *sql.DB) pgmig.DB {
+	return db{executor{pool, a.Convert}, pool}
+}
+
+// WrapTx returns executor for database/sql transaction, errors are converted by Error
+func WrapTx(t *sql.Tx) pgmig.TxExecutor {
+	return Adapter{}.WrapTx(t)
+}
+
+// WrapConn returns pgmig.DB for database/sql connection, errors are converted by Error
+func WrapConn(conn *sql.Conn) pgmig.DB {
+	return Adapter{}.WrapConn(conn)
+}
+
+// WrapDB returns pgmig.DB for database/sql pool, errors are converted by Error
+func WrapDB(pool *sql.DB) pgmig.DB {
+	return Adapter{}.WrapDB(pool)
+}
+
+// sqlStateError is implemented by lib/pq and pgx errors
+type sqlStateError interface {
+	error
+	SQLState() string
+}
+
+// Error converts driver error with SQLSTATE to the type used by pgmig, other errors are returned as is.
+// Only code and message are kept, so error position in file is not shown.
+func Error(err error) error {
+	var dbErr *pgmig.DBError
+	if errors.As(err, &dbErr) {
+		return dbErr
+	}
+	var e sqlStateError
+	if !errors.As(err, &e) {
+		return err
+	}
+	return &pgmig.DBError{Severity: "ERROR", Code: e.SQLState(), Message: e.Error()}
+}
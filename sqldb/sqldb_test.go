@@ -0,0 +1,56 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgmig/pgmig"
+	"github.com/pgmig/pgmig/pgxv5"
+)
+
+type stateError string
+
+func (e stateError) Error() string    { return "relation does not exist" }
+func (e stateError) SQLState() string { return string(e) }
+
+func TestError(t *testing.T) {
+	assert.Equal(t, &pgmig.DBError{Severity: "ERROR", Code: "42P01", Message: "relation does not exist"},
+		Error(stateError("42P01")))
+
+	dbErr := &pgmig.DBError{Code: "42601", Position: 5}
+	assert.Same(t, dbErr, Error(dbErr))
+
+	other := errors.New("other")
+	assert.Equal(t, other, Error(other))
+	assert.NoError(t, Error(nil))
+}
+
+// errQuerier is a querier which returns err
+type errQuerier struct {
+	err error
+}
+
+func (q errQuerier) ExecContext(context.Context, string, ...any) (sql.Result, error) {
+	return nil, q.err
+}
+
+func (q errQuerier) QueryContext(context.Context, string, ...any) (*sql.Rows, error) {
+	return nil, q.err
+}
+
+func TestAdapterConvert(t *testing.T) {
+	pgErr := &pgconn.PgError{Severity: "ERROR", Code: "42601", Message: "syntax error", Position: 5}
+	ex := executor{errQuerier{pgErr}, Adapter{Convert: pgxv5.Error}.Convert}
+	assert.Equal(t, &pgmig.DBError{Severity: "ERROR", Code: "42601", Message: "syntax error", Position: 5},
+		ex.Exec(context.Background(), "SELEC"))
+
+	// position is lost without converter
+	ex = executor{errQuerier{pgErr}, nil}
+	_, err := ex.Query(context.Background(), "SELEC")
+	assert.Equal(t, &pgmig.DBError{Severity: "ERROR", Code: "42601", Message: pgErr.Error()}, err)
+}
@@ -0,0 +1,195 @@
+// This file holds SQL script splitter.
+// Script is split by semicolons outside of quotes, comments and BEGIN ATOMIC bodies of SQL routines.
+
+package pgmig
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sqlStatement holds script statement
+type sqlStatement struct {
+	// Line holds line number of statement start
+	Line int
+	// Text holds statement without comments
+	Text string
+	// Source holds statement as it is in script, with comments before it
+	Source string
+	// SourceLine holds line number of Source start
+	SourceLine int
+}
+
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// splitStatements splits SQL script into statements.
+// Quotes, dollar quotes and comments are taken into account.
+func splitStatements(query string) []sqlStatement {
+	rv, _ := splitScript(query)
+	return rv
+}
+
+// splitScript splits SQL script into statements.
+// Like psql, it treats BEGIN and CASE as block start and END as block end in CREATE FUNCTION and CREATE PROCEDURE,
+// so BEGIN ATOMIC body is not split.
+// ok is false if script ends inside quote, comment or routine body, so it can not be split safely.
+func splitScript(query string) (rv []sqlStatement, ok bool) {
+	var buf strings.Builder
+	line, start, depth := 1, 0, 0
+	var words []string // first words of statement
+	st := sqlStatement{SourceLine: 1}
+	flush := func(end int) {
+		if text := strings.TrimSpace(buf.String()); text != "" {
+			src := query[start:end]
+			trimmed := strings.TrimLeft(src, " \t\r\n")
+			st.Text = text
+			st.Source = strings.TrimRight(trimmed, " \t\r\n")
+			st.SourceLine += strings.Count(src[:len(src)-len(trimmed)], "\n")
+			rv = append(rv, st)
+		}
+		buf.Reset()
+		st = sqlStatement{SourceLine: line}
+		start = end + 1
+		depth, words = 0, nil
+	}
+	ok = true
+	for i := 0; i < len(query); {
+		c := query[i]
+		end := i + 1
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			if end = strings.IndexByte(query[i:], '\n'); end < 0 {
+				end = len(query)
+			} else {
+				end += i
+			}
+			buf.WriteByte(' ')
+			i = end
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end = commentEnd(query, i); end < 0 {
+				ok, end = false, len(query)
+			}
+			line += strings.Count(query[i:end], "\n")
+			buf.WriteByte(' ')
+			i = end
+			continue
+		case c == ';' && depth == 0:
+			flush(i)
+			i++
+			continue
+		case c == '\'':
+			end = quoteEnd(query, i, isEscapeString(query, i))
+		case c == '"':
+			end = quoteEnd(query, i, false)
+		case c == '$' && (i == 0 || !isIdentChar(query[i-1])):
+			if tag := dollarTag.FindString(query[i:]); tag != "" {
+				if end = strings.Index(query[i+len(tag):], tag); end >= 0 {
+					end += i + 2*len(tag)
+				}
+			}
+		case isWordStart(c):
+			for end < len(query) && (isIdentChar(query[end]) || query[end] == '$' || query[end] >= 0x80) {
+				end++
+			}
+			word := strings.ToLower(query[i:end])
+			depth = blockDepth(words, word, depth)
+			if len(words) < 4 {
+				words = append(words, word)
+			}
+		}
+		if end < 0 {
+			ok, end = false, len(query)
+		}
+		if st.Line == 0 && c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			st.Line = line
+		}
+		token := query[i:end]
+		buf.WriteString(token)
+		line += strings.Count(token, "\n")
+		i = end
+	}
+	if depth > 0 {
+		ok = false
+	}
+	flush(len(query))
+	return
+}
+
+// blockDepth returns routine body block depth after word of statement started with words
+func blockDepth(words []string, word string, depth int) int {
+	if len(words) < 2 || words[0] != "create" {
+		return depth
+	}
+	kind := words[1]
+	if kind == "or" && len(words) >= 4 {
+		// CREATE OR REPLACE
+		kind = words[3]
+	}
+	if kind != "function" && kind != "procedure" {
+		return depth
+	}
+	switch word {
+	case "begin", "case":
+		return depth + 1
+	case "end":
+		if depth > 0 {
+			return depth - 1
+		}
+	}
+	return depth
+}
+
+// commentEnd returns position after end of block comment started at pos, -1 if it is not closed.
+// Block comments may be nested
+func commentEnd(query string, pos int) int {
+	depth := 0
+	for i := pos; i+1 < len(query); i++ {
+		switch {
+		case query[i] == '/' && query[i+1] == '*':
+			depth++
+			i++
+		case query[i] == '*' && query[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// quoteEnd returns position after closing quote of string started at pos, -1 if it is not closed.
+// Doubled quote is a part of string, backslash escapes next char if escapes is true
+func quoteEnd(query string, pos int, escapes bool) int {
+	q := query[pos]
+	for i := pos + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case q:
+			if i+1 < len(query) && query[i+1] == q {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// isEscapeString returns true if quote at pos starts E'...' string
+func isEscapeString(query string, pos int) bool {
+	return pos > 0 && (query[pos-1] == 'E' || query[pos-1] == 'e') && (pos == 1 || !isIdentChar(query[pos-2]))
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,62 @@
+package pgmig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	query := `-- header; comment
+CREATE TABLE a (id int); /* block; /* nested */ comment */
+CREATE FUNCTION f() RETURNS int LANGUAGE sql AS $_$
+  SELECT 1;
+$_$;
+
+SELECT 'a;b', "c;d"
+ , $1;`
+	got := splitStatements(query)
+	require.Len(t, got, 3)
+	assert.Equal(t, 2, got[0].Line)
+	assert.Equal(t, "CREATE TABLE a (id int)", got[0].Text)
+	assert.Equal(t, 3, got[1].Line)
+	assert.Contains(t, got[1].Text, "SELECT 1;\n$_$")
+	assert.Equal(t, 7, got[2].Line)
+	assert.Equal(t, "SELECT 'a;b', \"c;d\"\n , $1", got[2].Text)
+}
+
+func TestSplitScript(t *testing.T) {
+	query := `-- header
+CREATE TABLE a (id int); /* multi
+line; comment */ COMMENT ON TABLE a IS 'it''s a;
+table';
+SELECT E'a\';b', e'\\', 'c\';
+CREATE FUNCTION f(a int) RETURNS int LANGUAGE sql
+BEGIN ATOMIC
+  SELECT CASE WHEN a > 0 THEN 1 END;
+  SELECT 2;
+END;
+create or replace procedure p() begin atomic insert into a values (1); end;
+SELECT 3`
+	got, ok := splitScript(query)
+	require.True(t, ok)
+	require.Len(t, got, 6)
+	assert.Equal(t, sqlStatement{Line: 2, Text: "CREATE TABLE a (id int)", SourceLine: 1,
+		Source: "-- header\nCREATE TABLE a (id int)"}, got[0])
+	assert.Equal(t, 2, got[1].SourceLine)
+	assert.Equal(t, 3, got[1].Line)
+	assert.Equal(t, "/* multi\nline; comment */ COMMENT ON TABLE a IS 'it''s a;\ntable'", got[1].Source)
+	assert.Equal(t, `SELECT E'a\';b', e'\\', 'c\'`, got[2].Text)
+	assert.Equal(t, 5, got[2].Line)
+	assert.Equal(t, 6, got[3].Line)
+	assert.Contains(t, got[3].Text, "SELECT 2;\nEND")
+	assert.Equal(t, "create or replace procedure p() begin atomic insert into a values (1); end", got[4].Text)
+	assert.Equal(t, sqlStatement{Line: 12, Text: "SELECT 3", Source: "SELECT 3", SourceLine: 12}, got[5])
+
+	for _, bad := range []string{"SELECT 'a;", "SELECT E'a\\'; SELECT 1;", "SELECT 1 /* a; /* b */;",
+		"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1;"} {
+		_, ok = splitScript(bad)
+		assert.False(t, ok, bad)
+	}
+}
@@ -0,0 +1,13 @@
+-- regular file, run on every init
+CREATE OR REPLACE FUNCTION f() RETURNS int LANGUAGE sql AS $_$
+  BEGIN; SELECT 1; COMMIT;
+$_$;
+CREATE FUNCTION g() RETURNS int LANGUAGE sql AS 'SELECT 2';
+CREATE TABLE IF NOT EXISTS t (id int);
+CREATE INDEX IF NOT EXISTS t_id ON t (id);
+CREATE INDEX IF NOT EXISTS old_id ON old (id);
+DROP VIEW v;
+SET search_path = a;
+SET LOCAL search_path = a;
+COMMIT;
+DROP INDEX CONCURRENTLY IF EXISTS t_id;
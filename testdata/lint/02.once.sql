@@ -0,0 +1,3 @@
+ALTER TABLE old ADD COLUMN created_at timestamptz DEFAULT clock_timestamp();
+DROP TABLE IF EXISTS tmp;
+ALTER TABLE old ADD COLUMN updated_at timestamptz DEFAULT now();
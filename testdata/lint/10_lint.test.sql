@@ -0,0 +1,4 @@
+-- test file, rolled back after run
+SET search_path = a;
+CREATE INDEX CONCURRENTLY t_name ON t (name);
+ROLLBACK;
@@ -0,0 +1,199 @@
+// This file holds run timing support.
+// File run time is limited by statement_timeout which is set to time left before every statement,
+// so PG cancels statement itself and run transaction is rolled back as usual.
+// Context cancel is not used because pgx v4 closes connection on it.
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SQLStatementTimeout fetches statement_timeout value
+	SQLStatementTimeout = "SELECT current_setting('statement_timeout')"
+	// SQLSetStatementTimeout sets statement_timeout until transaction end
+	SQLSetStatementTimeout = "SELECT set_config('statement_timeout', $1, true)"
+
+	// pgQueryCanceled is the code of error raised by statement_timeout
+	pgQueryCanceled = "57014"
+)
+
+// FileTiming holds file run duration.
+type FileTiming struct {
+	Pkg      string
+	File     string
+	Duration time.Duration
+	Failed   bool `json:",omitempty"`
+}
+
+// FileDone holds fields of file run finish event.
+type FileDone struct {
+	Name     string
+	Duration time.Duration
+}
+
+// HookDone holds fields of package hook call finish event.
+type HookDone struct {
+	Hook     string
+	Pkg      string
+	Duration time.Duration
+}
+
+// StatementDone holds fields of statement run finish event (statement mode only).
+type StatementDone struct {
+	Line      int
+	Statement string
+	Duration  time.Duration
+}
+
+// Summary holds fields of run finish event.
+type Summary struct {
+	Duration time.Duration
+	// Slowest holds slowest files, slowest first
+	Slowest []FileTiming
+}
+
+// Kind returns event kind
+func (*FileDone) Kind() EventKind { return KindFileDone }
+
+// Kind returns event kind
+func (*HookDone) Kind() EventKind { return KindHookDone }
+
+// Kind returns event kind
+func (*Summary) Kind() EventKind { return KindSummary }
+
+// Kind returns event kind
+func (*StatementDone) Kind() EventKind { return KindStatementDone }
+
+// execStatements runs query statement by statement.
+// Statements are sent with their comments, so PG error line is the file line.
+// If query can not be split safely, it is run as a whole.
+// limit is called before every statement, see withFileTimeout.
+func (mig *Migrator) execStatements(ctx context.Context, tx Executor, query string, limit func() error) error {
+	stmts, ok := splitScript(query)
+	if !ok {
+		mig.Log.Info("Warning: file can not be split into statements, it is run as a whole", "file", mig.curFile)
+		st := sqlStatement{Line: 1, Source: query, SourceLine: 1}
+		if len(stmts) > 0 {
+			st.Line, st.Text = stmts[0].Line, stmts[0].Text
+		}
+		stmts = []sqlStatement{st}
+	}
+	for _, st := range stmts {
+		if err := limit(); err != nil {
+			return err
+		}
+		started := time.Now()
+		if err := tx.Exec(ctx, st.Source); err != nil {
+			if pgErr, ok := err.(*DBError); ok {
+				pgErr.Line = int32(st.SourceLine + positionLine(st.Source, pgErr.Position) - 1)
+			}
+			return err
+		}
+		mig.emit(&StatementDone{Line: st.Line, Statement: shortStatement(st.Text), Duration: time.Since(started)})
+	}
+	return nil
+}
+
+// positionLine returns line number of PG error position in query
+func positionLine(query string, pos int32) int {
+	runes := []rune(query)
+	if int(pos) > len(runes) {
+		pos = int32(len(runes))
+	}
+	return strings.Count(string(runes[:pos]), "\n") + 1
+}
+
+// shortStatement returns statement as one line, truncated if it is too long
+func shortStatement(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > 80 {
+		return string(r[:77]) + "..."
+	}
+	return s
+}
+
+// addTiming saves file run duration and sends it if file succeeded.
+// Failed file is reported by error event
+func (mig *Migrator) addTiming(pkg, file string, d time.Duration, failed bool) {
+	mig.timings = append(mig.timings, FileTiming{Pkg: pkg, File: file, Duration: d, Failed: failed})
+	if !failed {
+		mig.emit(&FileDone{Name: file, Duration: d})
+	}
+}
+
+// emitSummary sends run summary with configured count of slowest files
+func (mig *Migrator) emitSummary(started time.Time) {
+	mig.emit(&Summary{Duration: time.Since(started), Slowest: slowest(mig.timings, mig.Config.SlowFiles)})
+	mig.timings = nil
+}
+
+// slowest returns n slowest files, slowest first
+func slowest(timings []FileTiming, n int) []FileTiming {
+	if n <= 0 || len(timings) == 0 {
+		return nil
+	}
+	rv := append([]FileTiming{}, timings...)
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].Duration > rv[j].Duration })
+	if len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+// execHook calls package hook and sends its duration
+func (mig *Migrator) execHook(tx Executor, hook string, pkg pkgDef, version, repo string) error {
+	started := time.Now()
+	err := tx.Exec(context.Background(), fmt.Sprintf(SQLPkgOp, CorePackage, hook), pkg.Op, pkg.Name, version, repo)
+	if err != nil {
+		return err
+	}
+	mig.emit(&HookDone{Hook: hook, Pkg: pkg.Name, Duration: time.Since(started)})
+	return nil
+}
+
+// withFileTimeout runs fn with file run time limited by Config.FileTimeout.
+// fn must call limit before every statement, it sets statement_timeout to time left.
+// If file is run as a whole, PG 13+ applies statement_timeout to each statement of file.
+// Error of statement canceled by timeout gets hint with file timeout, statement_timeout is restored after fn.
+func (mig *Migrator) withFileTimeout(tx Executor, fn func(limit func() error) error) error {
+	timeout := mig.Config.FileTimeout
+	if timeout <= 0 {
+		return fn(noLimit)
+	}
+	var prev string
+	if err := queryValue(tx, &prev, SQLStatementTimeout); err != nil {
+		return errors.Wrap(err, "SQLStatementTimeout")
+	}
+	deadline := time.Now().Add(timeout)
+	err := fn(func() error {
+		// round up, so statement is not canceled before deadline
+		left := (time.Until(deadline) + time.Millisecond - 1).Milliseconds()
+		if left < 1 {
+			left = 1
+		}
+		if err := tx.Exec(context.Background(), SQLSetStatementTimeout, strconv.FormatInt(left, 10)); err != nil {
+			return errors.Wrap(err, "SQLSetStatementTimeout")
+		}
+		return nil
+	})
+	if pgErr, ok := err.(*DBError); ok && pgErr.Code == pgQueryCanceled && !time.Now().Before(deadline) {
+		pgErr.Hint = fmt.Sprintf("File timeout %s exceeded", timeout)
+		return pgErr
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Exec(context.Background(), SQLSetStatementTimeout, prev), "SQLSetStatementTimeout")
+}
+
+// noLimit is the limit func which does nothing
+func noLimit() error { return nil }
@@ -0,0 +1,148 @@
+package pgmig
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowest(t *testing.T) {
+	timings := []FileTiming{
+		{Pkg: "a", File: "1.sql", Duration: time.Second},
+		{Pkg: "a", File: "2.sql", Duration: 3 * time.Second},
+		{Pkg: "b", File: "3.sql", Duration: 2 * time.Second},
+	}
+	assert.Nil(t, slowest(timings, 0))
+	assert.Equal(t, []FileTiming{timings[1], timings[2]}, slowest(timings, 2))
+	assert.Equal(t, []FileTiming{timings[1], timings[2], timings[0]}, slowest(timings, 5))
+}
+
+func TestWithFileTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	rows := NewMockRows(ctrl)
+	rows.EXPECT().Next().Return(true).Times(2)
+	rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+		*dest[0].(*string) = "5s"
+		return nil
+	}).Times(2)
+	rows.EXPECT().Close().Times(2)
+	tx := NewMockTx(ctrl)
+	var left string
+	gomock.InOrder(
+		tx.EXPECT().Query(ctx, SQLStatementTimeout).Return(rows, nil),
+		tx.EXPECT().Exec(ctx, SQLSetStatementTimeout, gomock.Any()).
+			DoAndReturn(func(_ context.Context, _ string, args ...interface{}) (pgconn.CommandTag, error) {
+				left = args[0].(string)
+				return pgconn.CommandTag{}, nil
+			}),
+		tx.EXPECT().Exec(ctx, SQLSetStatementTimeout, "5s").Return(pgconn.CommandTag{}, nil),
+		tx.EXPECT().Query(ctx, SQLStatementTimeout).Return(rows, nil),
+		tx.EXPECT().Exec(ctx, SQLSetStatementTimeout, "1").Return(pgconn.CommandTag{}, nil),
+	)
+
+	mig := &Migrator{Config: &Config{FileTimeout: 1500 * time.Millisecond}}
+	err := mig.withFileTimeout(wrapTx(tx), func(limit func() error) error {
+		return limit()
+	})
+	assert.NoError(t, err)
+	ms, err := strconv.Atoi(left)
+	require.NoError(t, err)
+	assert.True(t, ms > 1000 && ms <= 1500, left)
+
+	// statement canceled by PG, statement_timeout is not restored in aborted transaction
+	mig.Config.FileTimeout = time.Millisecond
+	err = mig.withFileTimeout(wrapTx(tx), func(limit func() error) error {
+		require.NoError(t, limit())
+		time.Sleep(5 * time.Millisecond)
+		return &DBError{Code: pgQueryCanceled, Message: "canceling statement due to statement timeout"}
+	})
+	pgErr, ok := err.(*DBError)
+	require.True(t, ok)
+	assert.Equal(t, "File timeout 1ms exceeded", pgErr.Hint)
+
+	// no limit
+	mig.Config.FileTimeout = 0
+	assert.NoError(t, mig.withFileTimeout(nil, func(limit func() error) error {
+		return limit()
+	}))
+}
+
+func TestPrintSummary(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewConsoleSink(buf, false)
+	sink.Emit(Envelope{Event: &Summary{
+		Duration: 2500 * time.Millisecond,
+		Slowest: []FileTiming{{Pkg: "a", File: "01.sql", Duration: 1200 * time.Millisecond},
+			{Pkg: "a", File: "02.sql", Duration: time.Second, Failed: true}},
+	}})
+	assert.Equal(t, "\n# Done in 2.5s\n# Slowest files:\n#        1.2s a/01.sql\n#          1s a/02.sql (failed)\n", buf.String())
+}
+
+func TestExecStatements(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+	ctx := context.Background()
+
+	mig := &Migrator{Config: &Config{}}
+	var events []*StatementDone
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		if v, ok := e.Event.(*StatementDone); ok {
+			events = append(events, v)
+		}
+	}))
+	query := "CREATE TABLE t (\n  id INT\n);\n\nSELECT 1\n  FROM nothing;\n"
+	ex := tx.EXPECT()
+	gomock.InOrder(
+		ex.Exec(ctx, gomock.Any()).Return(pgconn.CommandTag{}, nil),
+		ex.Exec(ctx, gomock.Any()).DoAndReturn(func(context.Context, string, ...interface{}) (pgconn.CommandTag, error) {
+			return pgconn.CommandTag{}, &pgconn.PgError{Code: "42P01", Position: int32(len("SELECT 1\n  F"))}
+		}),
+	)
+	err := mig.execStatements(ctx, wrapTx(tx), query, noLimit)
+	pgErr, ok := err.(*DBError)
+	assert.True(t, ok)
+	assert.Equal(t, int32(6), pgErr.Line)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, 1, events[0].Line)
+		assert.Equal(t, "CREATE TABLE t ( id INT )", events[0].Statement)
+	}
+}
+
+func TestExecStatementsWholeFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+	ctx := context.Background()
+
+	mig := &Migrator{Config: &Config{}, Log: logr.Discard()}
+	var events []*StatementDone
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		if v, ok := e.Event.(*StatementDone); ok {
+			events = append(events, v)
+		}
+	}))
+	query := "-- unclosed\nSELECT 1;\nSELECT 'x;\n"
+	tx.EXPECT().Exec(ctx, query).Return(pgconn.CommandTag{}, nil)
+	assert.NoError(t, mig.execStatements(ctx, wrapTx(tx), query, noLimit))
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, 2, events[0].Line)
+	}
+}
+
+func TestShortStatement(t *testing.T) {
+	assert.Equal(t, "SELECT 1", shortStatement("  SELECT\n\t1  "))
+	long := strings.Repeat("a", 100)
+	assert.Equal(t, strings.Repeat("a", 77)+"...", shortStatement(long))
+}
@@ -0,0 +1,118 @@
+// This file holds transaction variable sources.
+// Var value may be given as is, read from file (@file) or environment (env:NAME).
+// Leading @@ is replaced by @ and the value is taken as is.
+// Values read from files, environment and vars file are secret, they are hidden in logs and events.
+
+package pgmig
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// VarFilePrefix marks var value read from file, e.g. --var password=@/run/secrets/password
+	VarFilePrefix = "@"
+	// VarEnvPrefix marks var value read from environment variable, e.g. --var password=env:FDW_PASSWORD
+	VarEnvPrefix = "env:"
+	// VarEscapePrefix marks var value which starts with @, e.g. --var name=@@admin sets name to @admin
+	VarEscapePrefix = "@@"
+)
+
+// ResolveVars loads vars file and replaces file and environment var references by their values.
+// Vars given in Vars override vars file ones. Resolved vars are added to SecretVars.
+// It does nothing if vars are resolved already.
+func (cfg *Config) ResolveVars() error {
+	if cfg.varsResolved {
+		return nil
+	}
+	vars := map[string]string{}
+	var secrets []string
+	if cfg.VarsFile != "" {
+		fileVars, err := readVarsFile(cfg.VarsFile)
+		if err != nil {
+			return err
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+			if _, ok := cfg.Vars[k]; !ok {
+				secrets = append(secrets, k)
+			}
+		}
+	}
+	for k, v := range cfg.Vars {
+		vars[k] = v
+	}
+	for k, v := range vars {
+		val, isRef, err := resolveVar(v)
+		if err != nil {
+			return errors.Wrap(err, "Var "+k)
+		}
+		vars[k] = val
+		if isRef {
+			secrets = append(secrets, k)
+		}
+	}
+	for _, k := range secrets {
+		if !cfg.IsSecretVar(k) {
+			cfg.SecretVars = append(cfg.SecretVars, k)
+		}
+	}
+	if len(vars) != 0 {
+		cfg.Vars = vars
+	}
+	cfg.varsResolved = true
+	return nil
+}
+
+// resolveVar returns value of var reference, isRef is false if v is not a reference
+func resolveVar(v string) (value string, isRef bool, err error) {
+	switch {
+	case strings.HasPrefix(v, VarEscapePrefix):
+		return v[len(VarEscapePrefix)-1:], false, nil
+	case strings.HasPrefix(v, VarFilePrefix):
+		data, err := os.ReadFile(v[len(VarFilePrefix):])
+		if err != nil {
+			return "", true, err
+		}
+		// secret files usually end with newline which is not a part of value
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	case strings.HasPrefix(v, VarEnvPrefix):
+		name := v[len(VarEnvPrefix):]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", true, errors.New("Environment variable " + name + " is not set")
+		}
+		return value, true, nil
+	}
+	return v, false, nil
+}
+
+// readVarsFile reads vars from file with name=value lines.
+// Empty lines and lines started with # are skipped
+func readVarsFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rv := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		pos := strings.Index(s, "=")
+		if pos <= 0 {
+			return nil, errors.Errorf("%s:%d: name=value expected", name, line)
+		}
+		rv[strings.TrimSpace(s[:pos])] = strings.TrimSpace(s[pos+1:])
+	}
+	return rv, scanner.Err()
+}
@@ -0,0 +1,110 @@
+package pgmig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveVars(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0o600))
+	varsFile := filepath.Join(dir, "vars")
+	require.NoError(t, os.WriteFile(varsFile, []byte("# fdw access\nfdw_user = app\nfdw_pass=@"+secretFile+
+		"\n\nname=from file\n"), 0o600))
+	t.Setenv("PGMIG_TEST_TOKEN", "env-secret")
+
+	cfg := Config{VarsFile: varsFile, Vars: map[string]string{
+		"token": "env:PGMIG_TEST_TOKEN",
+		"name":  "app",
+		"owner": "@@admin",
+	}}
+	require.NoError(t, cfg.ResolveVars())
+	assert.Equal(t, map[string]string{
+		"fdw_user": "app",
+		"fdw_pass": "file-secret",
+		"name":     "app",
+		"token":    "env-secret",
+		"owner":    "@admin",
+	}, cfg.Vars)
+	for _, name := range []string{"fdw_user", "fdw_pass", "token"} {
+		assert.True(t, cfg.IsSecretVar(name), name)
+	}
+	assert.False(t, cfg.IsSecretVar("name"))
+	assert.False(t, cfg.IsSecretVar("owner"))
+	assert.Equal(t, []string{"file-secret", "env-secret", "app"}, cfg.SecretValues())
+
+	// resolved vars are not read again
+	cfg.Vars["token"] = "env:PGMIG_TEST_UNSET"
+	assert.NoError(t, cfg.ResolveVars())
+}
+
+func TestResolveVarsErrors(t *testing.T) {
+	dir := t.TempDir()
+	badFile := filepath.Join(dir, "vars")
+	require.NoError(t, os.WriteFile(badFile, []byte("a=1\nnot a var\n"), 0o600))
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"Env", Config{Vars: map[string]string{"a": "env:PGMIG_TEST_UNSET"}},
+			"Var a: Environment variable PGMIG_TEST_UNSET is not set"},
+		{"File", Config{Vars: map[string]string{"a": "@" + filepath.Join(dir, "none")}},
+			"Var a: open " + filepath.Join(dir, "none") + ": no such file or directory"},
+		{"VarsFile", Config{VarsFile: badFile}, badFile + ":2: name=value expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, tt.cfg.ResolveVars(), tt.want)
+		})
+	}
+}
+
+func TestSecretVars(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := NewMockTx(ctrl)
+	rows := NewMockRows(ctrl)
+	ctx := context.Background()
+	t.Setenv("PGMIG_TEST_PASS", "s3cr3t")
+
+	mig := New(logr.Discard(), Config{Vars: map[string]string{"pass": "env:PGMIG_TEST_PASS"}}, nil, "")
+	got := []Event{}
+	mig.AddSink(SinkFunc(func(e Envelope) {
+		got = append(got, e.Event)
+	}))
+	ex := tx.EXPECT()
+	gomock.InOrder(
+		ex.Query(ctx, SQLPgMigVar, CorePrefix).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			prefix := "pgmig.var."
+			*(dest[0].(**string)) = &prefix
+			return nil
+		}),
+		rows.EXPECT().Close(),
+		ex.Exec(ctx, SQLSetVar, gomock.Any(), "pass", "s3cr3t").Return(pgconn.CommandTag{}, nil),
+	)
+	require.NoError(t, mig.setVars(wrapTx(tx)))
+
+	pgErr := &DBError{Code: "28P01", Message: `password "s3cr3t" rejected`}
+	mig.emit(&PgError{DBError: pgErr})
+	mig.emit(&TestFail{Message: "login", Detail: "got: s3cr3t"})
+	assert.Equal(t, []Event{
+		&PgError{DBError: &DBError{Code: "28P01", Message: `password "*****" rejected`}},
+		&TestFail{Message: "login", Detail: "got: *****"},
+	}, got)
+	assert.Equal(t, `password "s3cr3t" rejected`, pgErr.Message, "source error must not be changed")
+
+	mig = New(logr.Discard(), Config{Vars: map[string]string{"pass": "env:PGMIG_TEST_UNSET"}}, nil, "")
+	assert.EqualError(t, mig.setVars(wrapTx(tx)), "Var pass: Environment variable PGMIG_TEST_UNSET is not set")
+}
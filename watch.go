@@ -0,0 +1,152 @@
+// This file holds watch mode.
+// Package files are polled via Migrator FileSystem, changed package and packages after it
+// (which may depend on it, packages are given in create order) are run again.
+
+package pgmig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// CmdWatch holds name of watch command
+	CmdWatch = "watch"
+)
+
+// WatchOptions holds watch mode options.
+type WatchOptions struct {
+	// Interval holds package files poll interval
+	Interval time.Duration
+	// Test enables test command run after successful command
+	Test bool
+}
+
+// WatchChange holds fields of watched files change event.
+type WatchChange struct {
+	Files    []string
+	Packages []string
+}
+
+// Kind returns event kind
+func (*WatchChange) Kind() EventKind { return KindWatch }
+
+// fileState holds watched file attributes
+type fileState struct {
+	size int64
+	mod  time.Time
+}
+
+// Watch runs command for packages and repeats it for changed package and packages after it
+// until ctx is done. Run errors are shown and do not stop watching.
+func (mig *Migrator) Watch(ctx context.Context, db TxStarter, command string, packages []string, opts WatchOptions) error {
+	if IsDestructive(command) && !mig.Config.Force {
+		return fmt.Errorf("%s is destructive, use --force to watch it", command)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	state, err := mig.watchState(packages)
+	if err != nil {
+		return err
+	}
+	mig.watchRun(ctx, db, command, packages, opts)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur, err := mig.watchState(packages)
+		if err != nil {
+			mig.Log.Error(err, "Watch error")
+			continue
+		}
+		files := changedFiles(state, cur)
+		state = cur
+		if len(files) == 0 {
+			continue
+		}
+		pkgs := affectedPackages(packages, files)
+		mig.emit(&WatchChange{Files: files, Packages: pkgs})
+		mig.watchRun(ctx, db, command, pkgs, opts)
+	}
+}
+
+// watchRun runs command and test if enabled, errors are logged
+func (mig *Migrator) watchRun(ctx context.Context, db TxStarter, command string, packages []string, opts WatchOptions) {
+	commands := []string{command}
+	if opts.Test && command != CmdTest {
+		commands = append(commands, CmdTest)
+	}
+	for _, cmd := range commands {
+		_, err := mig.runTx(ctx, db, cmd, packages, "")
+		if er := mig.SaveHistory(ctx, db, err); er != nil {
+			mig.Log.Error(er, "Save history error")
+		}
+		if err != nil {
+			mig.Log.Error(err, "Run error", "command", cmd)
+			return
+		}
+		if mig.runErr != nil {
+			// PG error is shown already
+			return
+		}
+	}
+}
+
+// watchState returns attributes of package files keyed by pkg/file
+func (mig *Migrator) watchState(packages []string) (map[string]fileState, error) {
+	rv := map[string]fileState{}
+	for _, pkg := range packages {
+		err := mig.FS.Walk(filepath.Join(mig.Root, pkg), func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !f.IsDir() {
+				rv[pkg+"/"+f.Name()] = fileState{size: f.Size(), mod: f.ModTime()}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// changedFiles returns sorted names of added, removed and modified files
+func changedFiles(prev, cur map[string]fileState) []string {
+	var rv []string
+	for name, s := range cur {
+		if p, ok := prev[name]; !ok || p.size != s.size || !p.mod.Equal(s.mod) {
+			rv = append(rv, name)
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// affectedPackages returns first changed package and packages after it
+func affectedPackages(packages, files []string) []string {
+	for i, pkg := range packages {
+		for _, f := range files {
+			if strings.HasPrefix(f, pkg+"/") {
+				return packages[i:]
+			}
+		}
+	}
+	return nil
+}
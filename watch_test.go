@@ -0,0 +1,49 @@
+package pgmig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchState(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"a/01.sql", "a/02.sql", "b/01.sql"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, f), []byte("SELECT 1;"), 0o644))
+	}
+	mig := New(logr.Discard(), Config{}, nil, root)
+	packages := []string{"a", "b"}
+	prev, err := mig.watchState(packages)
+	require.NoError(t, err)
+	assert.Len(t, prev, 3)
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "a/02.sql"), later, later))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "b/02.sql"), []byte("SELECT 2;"), 0o644))
+	cur, err := mig.watchState(packages)
+	require.NoError(t, err)
+	files := changedFiles(prev, cur)
+	assert.Equal(t, []string{"a/02.sql", "b/02.sql"}, files)
+	assert.Equal(t, []string{"a", "b"}, affectedPackages(packages, files))
+
+	require.NoError(t, os.Remove(filepath.Join(root, "b/01.sql")))
+	next, err := mig.watchState(packages)
+	require.NoError(t, err)
+	files = changedFiles(cur, next)
+	assert.Equal(t, []string{"b/01.sql"}, files)
+	assert.Equal(t, []string{"b"}, affectedPackages(packages, files))
+	assert.Nil(t, changedFiles(next, next))
+}
+
+func TestWatchDestructive(t *testing.T) {
+	mig := New(logr.Discard(), Config{}, nil, "testdata")
+	err := mig.Watch(context.Background(), nil, CmdReInit, []string{"a"}, WatchOptions{})
+	assert.EqualError(t, err, "reinit is destructive, use --force to watch it")
+}